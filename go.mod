@@ -9,4 +9,5 @@ require (
 	github.com/influxdata/influxdb-client-go v1.4.0
 	github.com/mattn/go-sqlite3 v1.14.9
 	gitlab.void-ptr.org/go/reflection v0.0.45
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 )
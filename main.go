@@ -5,9 +5,14 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"gitlab.void-ptr.org/go/reflection/pkg/server"
+	"gitlab.void-ptr.org/go/schism/pkg/api"
 	"gitlab.void-ptr.org/go/schism/pkg/api/router"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/config"
 	"gitlab.void-ptr.org/go/schism/pkg/db"
 	"gitlab.void-ptr.org/go/schism/pkg/util"
 )
@@ -15,6 +20,9 @@ import (
 func main() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
+	// Reload the api keys on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -32,6 +40,66 @@ func main() {
 		return
 	}
 
+	// Stored tokens are hashed with the pepper, clear text ones of older versions are converted once
+	business.TokenPepper = []byte(api.ReadSecret("schism.token.pepper"))
+	if len(business.TokenPepper) == 0 {
+		util.Log.Panic("the token pepper secret is empty")
+		return
+	}
+	err = business.MigrateAccesstokens(sqlite)
+	if err != nil {
+		util.Log.Panic(err)
+		return
+	}
+
+	// Signing keys of devices are sealed with the pepper, clear text ones of older versions are converted once
+	err = business.SealSigningKeys(sqlite)
+	if err != nil {
+		util.Log.Panic(err)
+		return
+	}
+
+	// Devices are unique by mac address, duplicates of older versions are soft deleted once
+	err = business.DeduplicateDevices(sqlite)
+	if err != nil {
+		util.Log.Panic(err)
+		return
+	}
+
+	// Admins and provisioning authenticate with the api keys, several may be valid at once
+	err = api.ApiKeys.Load()
+	if err != nil {
+		util.Log.Panic(err)
+		return
+	}
+	go api.ApiKeys.Watch(ctx, config.ApiKeysReloadInterval, hup)
+
+	// Payloads are parsed by sensor type definitions, those compiled in are kept up to date
+	err = business.LoadBuiltinSensorTypes(sqlite)
+	if err != nil {
+		util.Log.Panic(err)
+		return
+	}
+
+	// Device client certificates are issued by the internal ca
+	business.DeviceCA, err = business.LoadDeviceCA(sqlite)
+	if err != nil {
+		util.Log.Panic(err)
+		return
+	}
+
+	// Jwts are verified in memory, load their keys and revocations
+	err = business.JwtKeys.Load(sqlite)
+	if err != nil {
+		util.Log.Panic(err)
+		return
+	}
+	err = business.JwtRevocations.Load(sqlite)
+	if err != nil {
+		util.Log.Panic(err)
+		return
+	}
+
 	var influxHost = os.Getenv("INFLUXDB_HOST")
 	var influxPort = os.Getenv("INFLUXDB_PORT")
 	var influxOrg = os.Getenv("DOCKER_INFLUXDB_INIT_ORG")
@@ -44,8 +112,50 @@ func main() {
 		return
 	}
 
+	// Flush device presence periodically
+	go business.Presence.Run(ctx, sqlite, config.PresenceFlushInterval)
+	// Flush accesstoken usage along with it
+	go business.TokenUsage.Run(ctx, sqlite, config.PresenceFlushInterval)
+	// Remove soft deleted devices after their grace period
+	go util.Every(ctx, config.DeviceSweepInterval, func() {
+		business.SweepDeletedDevices(sqlite, influxdb)
+	})
+	// Remove accesstokens that can no longer be refreshed and expired sessions
+	go util.Every(ctx, config.TokenSweepInterval, func() {
+		business.SweepExpiredAccesstokens(sqlite)
+		business.SweepExpiredSessions(sqlite)
+		business.SweepJwtRevocations(sqlite)
+	})
+	// Forget the rate limits of idle clients and old failed attempts
+	go util.Every(ctx, time.Minute, func() {
+		api.RateLimits.Sweep()
+		api.Lockouts.Sweep()
+	})
+	// Rotate the jwt signing key
+	go util.Every(ctx, config.JwtKeyRotationInterval, func() {
+		business.JwtKeys.Rotate(sqlite, nil)
+	})
+
+	schismRouter := router.SchismRouter(sqlite, influxdb)
+
+	// Serve mutual tls for devices with client certificates next to plain http
+	if len(config.TlsAddress) > 0 {
+		go func() {
+			if err := api.ServeTLS(ctx, config.TlsAddress, schismRouter, business.DeviceCA, config.TlsHosts); err != nil {
+				util.Log.Errorf("failed to serve tls:+%v\n", err)
+			}
+		}()
+	}
+
 	s := server.NewSaveServer(util.Log)
-	if err := s.Serve(ctx, router.SchismRouter(sqlite, influxdb), func() {
+	if err := s.Serve(ctx, schismRouter, func() {
+		// Write out pending presence and token usage
+		if err := business.Presence.Flush(sqlite); err != nil {
+			util.Log.Error(err)
+		}
+		if err := business.TokenUsage.Flush(sqlite); err != nil {
+			util.Log.Error(err)
+		}
 		// Close db connection
 		sqlite.Close()
 		influxdb.Close()
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// Scopes of api keys, each one includes the ones listed after it
+const (
+	ApiKeyScopeAdmin = "admin"
+	ApiKeyScopeWrite = "write"
+	ApiKeyScopeRead  = "read"
+	// ApiKeyScopeProvision only registers and logs in devices, for keys built into firmware
+	ApiKeyScopeProvision = "provision"
+)
+
+var apiKeyScopesIncluded = map[string][]string{
+	ApiKeyScopeAdmin:     {ApiKeyScopeAdmin, ApiKeyScopeWrite, ApiKeyScopeRead, ApiKeyScopeProvision},
+	ApiKeyScopeWrite:     {ApiKeyScopeWrite, ApiKeyScopeRead, ApiKeyScopeProvision},
+	ApiKeyScopeRead:      {ApiKeyScopeRead},
+	ApiKeyScopeProvision: {ApiKeyScopeProvision},
+}
+
+// ApiKeyLegacyName is the key read from the single api secret file
+const ApiKeyLegacyName = "default"
+
+// Secret files of the api keys, both are re-read on change
+const (
+	apiSecretFile = "schism.api.secret"
+	apiKeysFile   = "schism.api.keys"
+)
+
+// ApiKey authorizes administration, only the sha256 of the key is known
+type ApiKey struct {
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires"`
+	hash      []byte
+}
+
+// HasScope checks if a key has a scope or one including it
+func (k *ApiKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		for _, included := range apiKeyScopesIncluded[s] {
+			if included == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ApiKeyring holds all valid api keys, several at once allow rotating without downtime
+type ApiKeyring struct {
+	mutex    sync.RWMutex
+	keys     []*ApiKey
+	modTimes map[string]time.Time
+}
+
+// ApiKeys of the api, loaded on startup
+var ApiKeys = &ApiKeyring{modTimes: map[string]time.Time{}}
+
+func hashApiKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// Load the api keys from the secret files, the current keys stay if they are invalid.
+// The legacy api secret file holds a single key with all scopes, the keys file a json list of hashed keys.
+// The files are remembered either way, rejected ones are only read again once they change.
+func (k *ApiKeyring) Load() error {
+	modTimes := map[string]time.Time{}
+	keys, err := readApiKeys(modTimes)
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.modTimes = modTimes
+	if err != nil {
+		return err
+	}
+	k.keys = keys
+	util.Log.Infof("loaded %d api keys", len(keys))
+	return nil
+}
+
+// readApiKeys from the secret files, noting the modification time of every file read
+func readApiKeys(modTimes map[string]time.Time) ([]*ApiKey, error) {
+	keys := []*ApiKey{}
+
+	if secret, modTime, ok := readOptionalSecret(apiSecretFile); ok {
+		modTimes[apiSecretFile] = modTime
+		if secret = strings.TrimSpace(secret); len(secret) > 0 {
+			keys = append(keys, &ApiKey{Name: ApiKeyLegacyName, Scopes: []string{ApiKeyScopeAdmin}, hash: hashApiKey(secret)})
+		}
+	}
+
+	if content, modTime, ok := readOptionalSecret(apiKeysFile); ok {
+		modTimes[apiKeysFile] = modTime
+		var fileKeys []*ApiKey
+		if err := json.Unmarshal([]byte(content), &fileKeys); err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", apiKeysFile, err)
+		}
+		for _, key := range fileKeys {
+			hash, err := hex.DecodeString(strings.TrimPrefix(key.Hash, "sha256:"))
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("invalid hash of api key '%s'", key.Name)
+			}
+			for _, scope := range key.Scopes {
+				if _, ok := apiKeyScopesIncluded[scope]; !ok {
+					return nil, fmt.Errorf("invalid scope '%s' of api key '%s'", scope, key.Name)
+				}
+			}
+			key.hash = hash
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no api keys configured in %s or %s", apiSecretFile, apiKeysFile)
+	}
+	return keys, nil
+}
+
+// Authenticate a key, all keys are compared in constant time so the time taken reveals nothing
+func (k *ApiKeyring) Authenticate(key string) (*ApiKey, bool) {
+	if len(key) == 0 {
+		return nil, false
+	}
+	hash := hashApiKey(key)
+
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	var match *ApiKey
+	for _, apiKey := range k.keys {
+		if subtle.ConstantTimeCompare(hash, apiKey.hash) == 1 {
+			match = apiKey
+		}
+	}
+	if match == nil || (match.ExpiresAt != nil && !time.Now().Before(*match.ExpiresAt)) {
+		return nil, false
+	}
+	return match, true
+}
+
+// changed checks if any secret file appeared, vanished or was modified since the last load
+func (k *ApiKeyring) changed() bool {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	for _, name := range []string{apiSecretFile, apiKeysFile} {
+		info, err := os.Stat(secretsDir + name)
+		modTime, known := k.modTimes[name]
+		if (err == nil) != known || (err == nil && !info.ModTime().Equal(modTime)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the keys when the secret files change or a reload is signalled, until the context is done
+func (k *ApiKeyring) Watch(ctx context.Context, interval time.Duration, reload <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+		case <-ticker.C:
+			if !k.changed() {
+				continue
+			}
+		}
+		if err := k.Load(); err != nil {
+			util.Log.Errorf("reloading api keys failed, keeping the current ones: %s", err)
+		}
+	}
+}
+
+// readOptionalSecret reads a secret file if it exists
+func readOptionalSecret(name string) (string, time.Time, bool) {
+	info, err := os.Stat(secretsDir + name)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	bytes, err := ioutil.ReadFile(secretsDir + name)
+	if err != nil {
+		util.Log.Error(err)
+		return "", time.Time{}, false
+	}
+	return string(bytes), info.ModTime(), true
+}
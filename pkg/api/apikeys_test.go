@@ -0,0 +1,65 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testSecretsDir points the secret files to a directory of the test
+func testSecretsDir(t *testing.T) string {
+	t.Helper()
+	previous := secretsDir
+	t.Cleanup(func() { secretsDir = previous })
+	secretsDir = t.TempDir() + string(filepath.Separator)
+	return secretsDir
+}
+
+// testWriteSecret writes a secret file with a modification time, changes within a second are still told apart
+func testWriteSecret(t *testing.T, dir string, name string, content string, modTime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(dir+name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dir+name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApiKeyringLoad(t *testing.T) {
+	dir := testSecretsDir(t)
+	now := time.Now()
+	testWriteSecret(t, dir, apiSecretFile, "secret", now)
+
+	keyring := &ApiKeyring{modTimes: map[string]time.Time{}}
+	if err := keyring.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if keyring.changed() {
+		t.Errorf("changed() right after Load(), want unchanged")
+	}
+
+	testWriteSecret(t, dir, apiKeysFile, "not json", now.Add(time.Second))
+	if !keyring.changed() {
+		t.Fatalf("changed() after the keys file appeared, want changed")
+	}
+	if err := keyring.Load(); err == nil {
+		t.Fatalf("Load() of an invalid keys file succeeded, want an error")
+	}
+	if keyring.changed() {
+		t.Errorf("changed() after the keys file was rejected, want it not read again until it changes")
+	}
+	if _, ok := keyring.Authenticate("secret"); !ok {
+		t.Errorf("Authenticate() with the current key after a rejected reload, want it kept")
+	}
+
+	testWriteSecret(t, dir, apiKeysFile, "[]", now.Add(2*time.Second))
+	if !keyring.changed() {
+		t.Fatalf("changed() after the keys file was fixed, want changed")
+	}
+	if err := keyring.Load(); err != nil {
+		t.Fatal(err)
+	}
+}
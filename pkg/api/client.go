@@ -0,0 +1,23 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+)
+
+// ClientIp of a request, the first x-forwarded-for entry if the proxy in front is trusted
+func ClientIp(r *http.Request) string {
+	if config.TrustForwardedFor {
+		if forwarded := r.Header.Get("x-forwarded-for"); len(forwarded) > 0 {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
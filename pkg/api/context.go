@@ -4,3 +4,8 @@ type ContextKey string
 
 const ContextKeyDevice ContextKey = "device"
 const ContextKeyToken ContextKey = "accesstoken"
+const ContextKeyRequestId ContextKey = "requestId"
+const ContextKeyUser ContextKey = "user"
+const ContextKeySession ContextKey = "session"
+const ContextKeyApiKey ContextKey = "apikey"
+const ContextKeyPermissions ContextKey = "permissions"
@@ -3,3 +3,4 @@ package errors
 var StatusUnauthorized = "Not authorized or no valid authorization provided"
 var StatusForbidden = "Access to this resource is forbidden"
 var StatusBadRequest = "Bad request"
+var StatusLockedOut = "Too many failed attempts, try again later"
@@ -8,6 +8,8 @@ import (
 type FeatureSet struct {
 	Devices business.DeviceSupport `json:"devices"`
 	Data    business.DataSupport   `json:"data"`
+	Groups  business.GroupSupport  `json:"groups"`
+	Users   business.UserSupport   `json:"users"`
 }
 
 // Features supported
@@ -18,4 +20,10 @@ var Features = FeatureSet{
 	Data: business.DataSupport{
 		Enabled: true,
 	},
+	Groups: business.GroupSupport{
+		Enabled: true,
+	},
+	Users: business.UserSupport{
+		Enabled: true,
+	},
 }
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/api"
+	"gitlab.void-ptr.org/go/schism/pkg/api/errors"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+// AuditActorAdmin is recorded for requests without a known user, device or api key
+const AuditActorAdmin = "admin"
+
+// auditor of a request, a logged in user, an authenticated device, the api key used or else the admin
+func auditor(r *http.Request) *business.Auditor {
+	a := &business.Auditor{Actor: AuditActorAdmin}
+	if user, ok := r.Context().Value(api.ContextKeyUser).(*business.User); ok {
+		a.Actor = "user:" + *user.Id
+	} else if device, ok := r.Context().Value(api.ContextKeyDevice).(*business.Device); ok {
+		a.Actor = "device:" + *device.Id
+	} else if key, ok := r.Context().Value(api.ContextKeyApiKey).(*api.ApiKey); ok {
+		a.Actor = "apikey:" + key.Name
+	}
+	if requestId, ok := r.Context().Value(api.ContextKeyRequestId).(string); ok {
+		a.RequestId = requestId
+	}
+	return a
+}
+
+type AuditHandler struct {
+	Database *db.Sqlite `json:"-"`
+}
+
+// ListAudit ...
+func (ah *AuditHandler) ListAudit() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		query := r.URL.Query()
+		list := &business.AuditList{DeviceId: query.Get("device")}
+		if since := query.Get("since"); len(since) > 0 {
+			t, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				http.Error(w, errors.StatusBadRequest, http.StatusBadRequest)
+				return
+			}
+			list.Since = &t
+		}
+		if limit := query.Get("limit"); len(limit) > 0 {
+			n, err := strconv.Atoi(limit)
+			if err != nil {
+				http.Error(w, errors.StatusBadRequest, http.StatusBadRequest)
+				return
+			}
+			list.Limit = n
+		}
+
+		entries, status, err := business.ListAudit(ah.Database, list)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, entries)
+	}
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+type CalibrationHandler struct {
+	Database *db.Sqlite `json:"-"`
+}
+
+// CreateCalibration ...
+func (ch *CalibrationHandler) CreateCalibration() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		var calibrationCreate business.CalibrationCreate
+		err := json.NewDecoder(r.Body).Decode(&calibrationCreate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		calibration, status, err := business.NewCalibration(nil, deviceId, ch.Database).Create(&calibrationCreate)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, calibration)
+	}
+}
+
+// ListCalibrations ...
+func (ch *CalibrationHandler) ListCalibrations() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+		history := r.URL.Query().Get("history") == "true"
+
+		calibrations, status, err := business.NewCalibration(nil, deviceId, ch.Database).List(history)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, calibrations)
+	}
+}
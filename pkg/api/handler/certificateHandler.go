@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/api"
+	"gitlab.void-ptr.org/go/schism/pkg/api/errors"
+	"gitlab.void-ptr.org/go/schism/pkg/api/permissions"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+type CertificateHandler struct {
+	Database *db.Sqlite `json:"-"`
+}
+
+// ReadCA ...
+func (ch *CertificateHandler) ReadCA() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		if business.DeviceCA == nil {
+			http.Error(w, "no device ca loaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.WriteHeader(http.StatusOK)
+		w.Write(business.DeviceCA.CertPEM)
+	}
+}
+
+// ListCertificates ...
+func (ch *CertificateHandler) ListCertificates() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionRead) {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
+		certificates, status, err := business.NewDeviceCertificate(nil, deviceId, ch.Database).List()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, certificates)
+	}
+}
+
+// CreateCertificate ...
+func (ch *CertificateHandler) CreateCertificate() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionWrite) {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
+		csr, status, err := decodeCsr(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		certificate := business.NewDeviceCertificate(nil, deviceId, ch.Database)
+		certificate.Auditor = auditor(r)
+		certificate.Scopes = credentialScopes(r)
+		certificate, status, err = certificate.Create(csr)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, certificate)
+	}
+}
+
+// RenewCertificate ...
+func (ch *CertificateHandler) RenewCertificate() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+		serial := mux.Vars(r)["serial"]
+
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionWrite) {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
+		csr, status, err := decodeCsr(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		certificate := business.NewDeviceCertificate(&serial, deviceId, ch.Database)
+		certificate.Auditor = auditor(r)
+		certificate.Scopes = credentialScopes(r)
+		certificate, status, err = certificate.Renew(csr)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, certificate)
+	}
+}
+
+// RevokeCertificate ...
+func (ch *CertificateHandler) RevokeCertificate() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+		serial := mux.Vars(r)["serial"]
+
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionWrite) {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
+		certificate := business.NewDeviceCertificate(&serial, deviceId, ch.Database)
+		certificate.Auditor = auditor(r)
+		certificate, status, err := certificate.Revoke()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, certificate)
+	}
+}
+
+// credentialScopes a device authenticated with, certificates it requests never carry more.
+// Users and api keys are checked by their role and issue certificates with all scopes.
+func credentialScopes(r *http.Request) []string {
+	if accesstoken, ok := r.Context().Value(api.ContextKeyToken).(*business.Accesstoken); ok {
+		return accesstoken.Scopes
+	}
+	return nil
+}
+
+// decodeCsr of a request body
+func decodeCsr(r *http.Request) (*x509.CertificateRequest, int, error) {
+	var create business.DeviceCertificateCreate
+	err := json.NewDecoder(r.Body).Decode(&create)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return business.ParseCsr(&create)
+}
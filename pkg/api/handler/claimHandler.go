@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+type ClaimHandler struct {
+	Database *db.Sqlite `json:"-"`
+}
+
+// CreateClaimCode ...
+func (ch *ClaimHandler) CreateClaimCode() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		var claimCodeCreate business.ClaimCodeCreate
+		err := json.NewDecoder(r.Body).Decode(&claimCodeCreate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		claimCode := business.NewClaimCode(nil, ch.Database)
+		claimCode, status, err := claimCode.Create(&claimCodeCreate)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, claimCode)
+	}
+}
+
+// ListClaimCodes ...
+func (ch *ClaimHandler) ListClaimCodes() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		claimCodes, status, err := business.NewClaimCode(nil, ch.Database).List()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, claimCodes)
+	}
+}
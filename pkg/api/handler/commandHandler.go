@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/api/errors"
+	"gitlab.void-ptr.org/go/schism/pkg/api/permissions"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+type CommandHandler struct {
+	Database *db.Sqlite `json:"-"`
+}
+
+// CreateCommand ...
+func (ch *CommandHandler) CreateCommand() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		var commandCreate business.CommandCreate
+		err := json.NewDecoder(r.Body).Decode(&commandCreate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		command := business.NewCommand(nil, deviceId, ch.Database)
+		command, status, err := command.Create(&commandCreate)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, command)
+	}
+}
+
+// ListCommands ...
+func (ch *CommandHandler) ListCommands() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		commands, status, err := business.NewCommand(nil, deviceId, ch.Database).List(r.URL.Query().Get("state"))
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, commands)
+	}
+}
+
+// PendingCommands ...
+func (ch *CommandHandler) PendingCommands() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		// Only the device itself fetches its pending commands, fetching marks them delivered
+		if !permissions.IsDevice(r) || !permissions.HasPermission(w, r, deviceId, permissions.ActionRead) {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
+		commands, status, err := business.NewCommand(nil, deviceId, ch.Database).Pending()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, commands)
+	}
+}
+
+// AckCommand ...
+func (ch *CommandHandler) AckCommand() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+		commandId := mux.Vars(r)["commandId"]
+
+		// Only the device itself acknowledges its commands
+		if !permissions.IsDevice(r) || !permissions.HasPermission(w, r, deviceId, permissions.ActionWrite) {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
+		var commandAck business.CommandAck
+		err := json.NewDecoder(r.Body).Decode(&commandAck)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		command, status, err := business.NewCommand(&commandId, deviceId, ch.Database).Ack(&commandAck)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, command)
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/gorilla/mux"
 	_business "gitlab.void-ptr.org/go/reflection/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/api"
 	"gitlab.void-ptr.org/go/schism/pkg/api/errors"
 	"gitlab.void-ptr.org/go/schism/pkg/api/permissions"
 	"gitlab.void-ptr.org/go/schism/pkg/business"
@@ -18,6 +19,7 @@ type DataRequest struct {
 
 type DataHandler struct {
 	Database *db.Influx `json:"-"`
+	Sqlite   *db.Sqlite `json:"-"`
 }
 
 // CreateData ...
@@ -25,6 +27,13 @@ func (dh *DataHandler) CreateData() func(w http.ResponseWriter, r *http.Request)
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 
+		// Only devices ingest data
+		device, ok := r.Context().Value(api.ContextKeyDevice).(*business.Device)
+		if !ok {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
 		var dataCreate _business.DataCreate
 		err := json.NewDecoder(r.Body).Decode(&dataCreate)
 		if err != nil {
@@ -32,8 +41,8 @@ func (dh *DataHandler) CreateData() func(w http.ResponseWriter, r *http.Request)
 			return
 		}
 
-		data := business.NewData(dh.Database)
-		created, status, err := data.Create(dataCreate)
+		data := business.NewData(dh.Database, dh.Sqlite)
+		created, status, err := data.Create(*device.Id, dataCreate)
 		if err != nil {
 			http.Error(w, err.Error(), status)
 			return
@@ -56,7 +65,7 @@ func (dh *DataHandler) ReadData() func(w http.ResponseWriter, r *http.Request) {
 		deviceId := mux.Vars(r)["deviceId"]
 		source := mux.Vars(r)["source"]
 
-		if !permissions.HasPermission(w, r, deviceId) {
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionReadData) {
 			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
 			return
 		}
@@ -68,8 +77,8 @@ func (dh *DataHandler) ReadData() func(w http.ResponseWriter, r *http.Request) {
 			Stop:     r.URL.Query().Get("stop"),
 		}
 
-		data := business.NewData(dh.Database)
-		result, status, err := data.Read(read)
+		data := business.NewData(dh.Database, dh.Sqlite)
+		result, status, err := data.Read(read, nil)
 		if err != nil {
 			http.Error(w, err.Error(), status)
 			return
@@ -82,3 +91,42 @@ func (dh *DataHandler) ReadData() func(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// ReadSiteData ...
+func (dh *DataHandler) ReadSiteData() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		siteId := mux.Vars(r)["id"]
+		dh.readGroupData(w, r, &business.DataSelector{SiteId: &siteId})
+	}
+}
+
+// ReadZoneData ...
+func (dh *DataHandler) ReadZoneData() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		zoneId := mux.Vars(r)["id"]
+		dh.readGroupData(w, r, &business.DataSelector{ZoneId: &zoneId})
+	}
+}
+
+func (dh *DataHandler) readGroupData(w http.ResponseWriter, r *http.Request, selector *business.DataSelector) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	var read = &_business.DataRead{
+		Source: mux.Vars(r)["source"],
+		Start:  r.URL.Query().Get("start"),
+		Stop:   r.URL.Query().Get("stop"),
+	}
+
+	data := business.NewData(dh.Database, dh.Sqlite)
+	result, status, err := data.Read(read, selector)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -1,14 +1,17 @@
 package handler
 
 import (
+	"crypto/x509"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
-	_business "gitlab.void-ptr.org/go/reflection/pkg/business"
 	"gitlab.void-ptr.org/go/schism/pkg/api"
 	"gitlab.void-ptr.org/go/schism/pkg/api/errors"
-	"gitlab.void-ptr.org/go/schism/pkg/api/headers"
 	"gitlab.void-ptr.org/go/schism/pkg/api/permissions"
 	"gitlab.void-ptr.org/go/schism/pkg/business"
 	"gitlab.void-ptr.org/go/schism/pkg/db"
@@ -21,6 +24,7 @@ type DeviceRequest struct {
 
 type DeviceHandler struct {
 	Database *db.Sqlite `json:"-"`
+	Influx   *db.Influx `json:"-"`
 }
 
 // CreateDevice ...
@@ -28,22 +32,183 @@ func (dh *DeviceHandler) CreateDevice() func(w http.ResponseWriter, r *http.Requ
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 
-		var deviceCreate _business.DeviceCreate
+		var deviceCreate business.DeviceCreate
 		err := json.NewDecoder(r.Body).Decode(&deviceCreate)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		deviceCreate.Upsert = r.URL.Query().Get("upsert") == "true"
 
 		device := business.NewDevice(nil, dh.Database)
+		device.Auditor = auditor(r)
 		device, status, err := device.Create(&deviceCreate)
 		if err != nil {
 			http.Error(w, err.Error(), status)
 			return
 		}
 
+		// Known devices are returned as they are, pending ones only get their state as the enrollment
+		// token is handed out once on creation
+		if status == http.StatusOK {
+			enrollment := &business.DeviceEnrollment{State: device.State}
+			if device.State == business.DeviceStateActive {
+				enrollment.Device = device
+			}
+			writeJSON(w, status, enrollment)
+			return
+		}
+
+		// Pending devices only get a handle to poll for their approval
+		if device.State != business.DeviceStateActive {
+			writeJSON(w, http.StatusAccepted, &business.DeviceEnrollment{
+				State:      device.State,
+				Enrollment: device.EnrollmentToken,
+			})
+			return
+		}
+
+		accesstoken := business.NewAccesstoken(nil, dh.Database)
+		accesstoken.Auditor = auditor(r)
+		accesstoken, _, err = accesstoken.Create(&business.AccesstokenCreate{DeviceId: *device.Id})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, status, &business.DeviceEnrollment{
+			State:       device.State,
+			Device:      device,
+			Accesstoken: accesstoken,
+		})
+	}
+}
+
+// ReadEnrollment ...
+func (dh *DeviceHandler) ReadEnrollment() func(w http.ResponseWriter, r *http.Request) {
+	return dh.enrollment(false)
+}
+
+// SubmitEnrollment is ReadEnrollment with a certificate signing request, approved devices get their client certificate too
+func (dh *DeviceHandler) SubmitEnrollment() func(w http.ResponseWriter, r *http.Request) {
+	return dh.enrollment(true)
+}
+
+func (dh *DeviceHandler) enrollment(withCsr bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		token := mux.Vars(r)["token"]
+
+		// Check the signing request before the enrollment is completed, it can only be completed once
+		var csr *x509.CertificateRequest
+		if withCsr {
+			var status int
+			var err error
+			csr, status, err = decodeCsr(r)
+			if err != nil {
+				http.Error(w, err.Error(), status)
+				return
+			}
+		}
+
+		device := business.NewDevice(nil, dh.Database)
+		device, status, err := device.ReadEnrollment(token)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		switch device.State {
+		case business.DeviceStatePending:
+			writeJSON(w, http.StatusAccepted, &business.DeviceEnrollment{State: device.State})
+			return
+		case business.DeviceStateDisabled:
+			writeJSON(w, http.StatusForbidden, &business.DeviceEnrollment{State: device.State})
+			return
+		}
+
+		// Approved, hand out the device id, its first accesstoken and certificate exactly once
+		device.Auditor = auditor(r)
+		enrollment, status, err := device.CompleteEnrollment(token, csr)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, enrollment)
+	}
+}
+
+// ApproveDevice ...
+func (dh *DeviceHandler) ApproveDevice() func(w http.ResponseWriter, r *http.Request) {
+	return dh.setDeviceState(business.DeviceStateActive)
+}
+
+// DisableDevice ...
+func (dh *DeviceHandler) DisableDevice() func(w http.ResponseWriter, r *http.Request) {
+	return dh.setDeviceState(business.DeviceStateDisabled)
+}
+
+func (dh *DeviceHandler) setDeviceState(state string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		device := business.NewDevice(&deviceId, dh.Database)
+		device.Auditor = auditor(r)
+		device, status, err := device.SetState(state)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, device)
+	}
+}
+
+// ListDevices ...
+func (dh *DeviceHandler) ListDevices() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get query parameters
+		query := r.URL.Query()
+		list := &business.DeviceList{
+			Cursor:     query.Get("cursor"),
+			Sort:       query.Get("sort"),
+			Descending: query.Get("order") == "desc",
+			Name:       query.Get("name"),
+			MacAddr:    query.Get("mac"),
+			State:      query.Get("state"),
+		}
+		if limit := query.Get("limit"); len(limit) > 0 {
+			l, err := strconv.Atoi(limit)
+			if err != nil || l < 1 {
+				http.Error(w, errors.StatusBadRequest, http.StatusBadRequest)
+				return
+			}
+			list.Limit = l
+		}
+		if createdAfter := query.Get("created_after"); len(createdAfter) > 0 {
+			t, err := time.Parse(time.RFC3339, createdAfter)
+			if err != nil {
+				http.Error(w, errors.StatusBadRequest, http.StatusBadRequest)
+				return
+			}
+			list.CreatedAfter = &t
+		}
+
+		device := business.NewDevice(nil, dh.Database)
+		devices, status, err := device.List(list)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
 		w.WriteHeader(status)
-		err = json.NewEncoder(w).Encode(device)
+		err = json.NewEncoder(w).Encode(devices)
 		if err != nil {
 			panic(err)
 		}
@@ -58,7 +223,7 @@ func (dh *DeviceHandler) ReadDevice() func(w http.ResponseWriter, r *http.Reques
 		// Get parameters
 		deviceId := mux.Vars(r)["id"]
 
-		if !permissions.HasPermission(w, r, deviceId) {
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionReadDevice) {
 			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
 			return
 		}
@@ -85,18 +250,19 @@ func (dh *DeviceHandler) UpdateDevice() func(w http.ResponseWriter, r *http.Requ
 		// Get parameters
 		deviceId := mux.Vars(r)["id"]
 
-		if !permissions.HasPermission(w, r, deviceId) {
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionWrite) {
 			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
 			return
 		}
 
-		var deviceUpdate _business.DeviceUpdate
+		var deviceUpdate business.DeviceUpdate
 		err := json.NewDecoder(r.Body).Decode(&deviceUpdate)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		device := business.NewDevice(&deviceId, dh.Database)
+		device.Auditor = auditor(r)
 		device, status, err := device.Update(&deviceUpdate)
 		if err != nil {
 			http.Error(w, err.Error(), status)
@@ -118,26 +284,66 @@ func (dh *DeviceHandler) DeleteDevice() func(w http.ResponseWriter, r *http.Requ
 
 		// Get parameters
 		deviceId := mux.Vars(r)["id"]
+		query := r.URL.Query()
 
-		if !permissions.HasPermission(w, r, deviceId) {
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionDelete) {
 			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
 			return
 		}
+
+		var del = &business.DeviceDelete{}
+		switch query.Get("purge") {
+		case "":
+		case "data":
+			del.Purge = true
+		default:
+			http.Error(w, errors.StatusBadRequest, http.StatusBadRequest)
+			return
+		}
+		switch query.Get("mode") {
+		case "", "hard":
+		case "soft":
+			del.Soft = true
+		default:
+			http.Error(w, errors.StatusBadRequest, http.StatusBadRequest)
+			return
+		}
+
 		device := business.NewDevice(&deviceId, dh.Database)
-		device, status, err := device.Delete()
+		device.Auditor = auditor(r)
+		summary, status, err := device.Delete(del, dh.Influx)
 		if err != nil {
 			http.Error(w, err.Error(), status)
 			return
 		}
 
 		w.WriteHeader(status)
-		err = json.NewEncoder(w).Encode(device)
+		err = json.NewEncoder(w).Encode(summary)
 		if err != nil {
 			panic(err)
 		}
 	}
 }
 
+// RestoreDevice ...
+func (dh *DeviceHandler) RestoreDevice() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		device := business.NewDevice(&deviceId, dh.Database)
+		device.Auditor = auditor(r)
+		device, status, err := device.Restore()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, device)
+	}
+}
+
 // LoginDevice ...
 func (dh *DeviceHandler) LoginDevice() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -146,11 +352,17 @@ func (dh *DeviceHandler) LoginDevice() func(w http.ResponseWriter, r *http.Reque
 		// Get parameters
 		deviceId := mux.Vars(r)["id"]
 
-		// Get secret header
-		secret := r.Header.Get(headers.HeaderSchismSecret)
+		// Logins with unknown device ids lock out the device from the client ip, the device and the ip itself
+		ip := api.ClientIp(r)
+		lockouts := []string{api.LockoutDeviceIp(deviceId, ip), api.LockoutDevice(deviceId), api.LockoutIp(ip)}
+		if remaining, locked := api.Lockouts.Locked(lockouts...); locked {
+			api.RejectLockedOut(w, remaining)
+			return
+		}
 
-		// Check for the valid api secret
-		if api.ApiSecret != secret {
+		// Only api keys log devices in, users can not
+		key, ok := r.Context().Value(api.ContextKeyApiKey).(*api.ApiKey)
+		if !ok || !key.HasScope(api.ApiKeyScopeProvision) {
 			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
 			return
 		}
@@ -161,18 +373,37 @@ func (dh *DeviceHandler) LoginDevice() func(w http.ResponseWriter, r *http.Reque
 			return
 		}
 		device := business.NewDevice(&deviceId, dh.Database)
-		_, status, err := device.Read()
+		device, status, err := device.Read()
 		if err != nil {
+			if status == http.StatusNotFound {
+				api.Lockouts.Fail(lockouts...)
+			}
 			http.Error(w, err.Error(), status)
 			return
 		}
+		if device.State != business.DeviceStateActive {
+			http.Error(w, fmt.Sprintf("device is %s", device.State), http.StatusForbidden)
+			return
+		}
+
+		// The body optionally limits the scopes of the token
+		accesstokenCreate := business.AccesstokenCreate{}
+		err = json.NewDecoder(r.Body).Decode(&accesstokenCreate)
+		if err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		accesstokenCreate.DeviceId = deviceId
 
 		accesstoken := business.NewAccesstoken(nil, dh.Database)
-		accesstoken, status, err = accesstoken.Create(&business.AccesstokenCreate{DeviceId: deviceId})
+		accesstoken.Auditor = auditor(r)
+		accesstoken, status, err = accesstoken.Create(&accesstokenCreate)
 		if err != nil {
 			http.Error(w, err.Error(), status)
 			return
 		}
+		business.TokenUsage.Used(*accesstoken.Id, ip, r.UserAgent())
+		api.Lockouts.Succeed(api.LockoutDeviceIp(deviceId, ip), api.LockoutDevice(deviceId))
 
 		w.WriteHeader(status)
 		err = json.NewEncoder(w).Encode(accesstoken)
@@ -182,6 +413,56 @@ func (dh *DeviceHandler) LoginDevice() func(w http.ResponseWriter, r *http.Reque
 	}
 }
 
+// RefreshToken ...
+func (dh *DeviceHandler) RefreshToken() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		// Wrong refresh tokens lock out the device from the client ip, the device and the ip itself like failed logins
+		ip := api.ClientIp(r)
+		lockouts := []string{api.LockoutDeviceIp(deviceId, ip), api.LockoutDevice(deviceId), api.LockoutIp(ip)}
+		if remaining, locked := api.Lockouts.Locked(lockouts...); locked {
+			api.RejectLockedOut(w, remaining)
+			return
+		}
+
+		var refresh business.AccesstokenRefresh
+		err := json.NewDecoder(r.Body).Decode(&refresh)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		device := business.NewDevice(&deviceId, dh.Database)
+		device, status, err := device.Read()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if device.State != business.DeviceStateActive {
+			http.Error(w, fmt.Sprintf("device is %s", device.State), http.StatusForbidden)
+			return
+		}
+
+		accesstoken := business.NewAccesstoken(nil, dh.Database)
+		accesstoken.Auditor = auditor(r)
+		accesstoken, status, err = accesstoken.Refresh(deviceId, &refresh)
+		if err != nil {
+			if status == http.StatusUnauthorized {
+				api.Lockouts.Fail(lockouts...)
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		business.TokenUsage.Used(*accesstoken.Id, ip, r.UserAgent())
+		api.Lockouts.Succeed(api.LockoutDeviceIp(deviceId, ip), api.LockoutDevice(deviceId))
+		writeJSON(w, status, accesstoken)
+	}
+}
+
 // LogoutDevice ...
 func (dh *DeviceHandler) LogoutDevice() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -190,19 +471,37 @@ func (dh *DeviceHandler) LogoutDevice() func(w http.ResponseWriter, r *http.Requ
 		// Get parameters
 		deviceId := mux.Vars(r)["id"]
 
-		if !permissions.HasPermission(w, r, deviceId) {
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionWrite) {
 			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
 			return
 		}
 
-		accesstoken := r.Context().Value(api.ContextKeyToken).(*business.Accesstoken)
+		// Users are logged out via their session, only a device has an accesstoken to end
+		accesstoken, ok := r.Context().Value(api.ContextKeyToken).(*business.Accesstoken)
+		if !ok || accesstoken.Certificate {
+			http.Error(w, errors.StatusBadRequest, http.StatusBadRequest)
+			return
+		}
+		// A jwt has no row to delete, it is revoked until it expires
+		if accesstoken.Jwt {
+			revocation, status, err := business.JwtRevocations.Revoke(dh.Database, &business.JwtRevocationCreate{JwtId: *accesstoken.Id}, auditor(r))
+			if err != nil {
+				http.Error(w, err.Error(), status)
+				return
+			}
+			writeJSON(w, status, revocation)
+			return
+		}
+		accesstoken.Auditor = auditor(r)
 		accesstoken, status, err := accesstoken.Delete()
 		if err != nil {
-			panic(err)
+			http.Error(w, err.Error(), status)
+			return
 		}
 
 		token := ""
 		accesstoken.Token = &token
+		accesstoken.RefreshToken = nil
 		w.WriteHeader(status)
 		err = json.NewEncoder(w).Encode(accesstoken)
 		if err != nil {
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+type GrantHandler struct {
+	Database *db.Sqlite `json:"-"`
+}
+
+// ListGrants ...
+func (gh *GrantHandler) ListGrants() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		query := r.URL.Query()
+		list := &business.GrantList{
+			ResourceKind:  query.Get("resource_kind"),
+			ResourceId:    query.Get("resource_id"),
+			PrincipalKind: query.Get("principal_kind"),
+			PrincipalId:   query.Get("principal_id"),
+		}
+
+		grants, status, err := business.NewGrant(nil, gh.Database).List(list)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, grants)
+	}
+}
+
+// CreateGrant ...
+func (gh *GrantHandler) CreateGrant() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		var grantCreate business.GrantCreate
+		err := json.NewDecoder(r.Body).Decode(&grantCreate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		grant := business.NewGrant(nil, gh.Database)
+		grant.Auditor = auditor(r)
+		grant, status, err := grant.Create(&grantCreate)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, grant)
+	}
+}
+
+// ReadGrant ...
+func (gh *GrantHandler) ReadGrant() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		grantId := mux.Vars(r)["id"]
+
+		grant, status, err := business.NewGrant(&grantId, gh.Database).Read()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, grant)
+	}
+}
+
+// DeleteGrant ...
+func (gh *GrantHandler) DeleteGrant() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		grantId := mux.Vars(r)["id"]
+
+		grant := business.NewGrant(&grantId, gh.Database)
+		grant.Auditor = auditor(r)
+		grant, status, err := grant.Delete()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, grant)
+	}
+}
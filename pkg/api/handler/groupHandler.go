@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+type GroupHandler struct {
+	Database *db.Sqlite `json:"-"`
+}
+
+// CreateSite ...
+func (gh *GroupHandler) CreateSite() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		var siteCreate business.SiteCreate
+		err := json.NewDecoder(r.Body).Decode(&siteCreate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		site := business.NewSite(nil, gh.Database)
+		site, status, err := site.Create(&siteCreate)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, site)
+	}
+}
+
+// ListSites ...
+func (gh *GroupHandler) ListSites() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		sites, status, err := business.NewSite(nil, gh.Database).List()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, sites)
+	}
+}
+
+// ReadSite ...
+func (gh *GroupHandler) ReadSite() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		siteId := mux.Vars(r)["id"]
+		site, status, err := business.NewSite(&siteId, gh.Database).Read()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, site)
+	}
+}
+
+// UpdateSite ...
+func (gh *GroupHandler) UpdateSite() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		siteId := mux.Vars(r)["id"]
+
+		var siteUpdate business.SiteUpdate
+		err := json.NewDecoder(r.Body).Decode(&siteUpdate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		site, status, err := business.NewSite(&siteId, gh.Database).Update(&siteUpdate)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, site)
+	}
+}
+
+// DeleteSite ...
+func (gh *GroupHandler) DeleteSite() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		siteId := mux.Vars(r)["id"]
+		site, status, err := business.NewSite(&siteId, gh.Database).Delete()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, site)
+	}
+}
+
+// CreateZone ...
+func (gh *GroupHandler) CreateZone() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		var zoneCreate business.ZoneCreate
+		err := json.NewDecoder(r.Body).Decode(&zoneCreate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		zone := business.NewZone(nil, gh.Database)
+		zone, status, err := zone.Create(&zoneCreate)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, zone)
+	}
+}
+
+// ListZones ...
+func (gh *GroupHandler) ListZones() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		zones, status, err := business.NewZone(nil, gh.Database).List(r.URL.Query().Get("site"))
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, zones)
+	}
+}
+
+// ReadZone ...
+func (gh *GroupHandler) ReadZone() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		zoneId := mux.Vars(r)["id"]
+		zone, status, err := business.NewZone(&zoneId, gh.Database).Read()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, zone)
+	}
+}
+
+// UpdateZone ...
+func (gh *GroupHandler) UpdateZone() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		zoneId := mux.Vars(r)["id"]
+
+		var zoneUpdate business.ZoneUpdate
+		err := json.NewDecoder(r.Body).Decode(&zoneUpdate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		zone, status, err := business.NewZone(&zoneId, gh.Database).Update(&zoneUpdate)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, zone)
+	}
+}
+
+// DeleteZone ...
+func (gh *GroupHandler) DeleteZone() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		zoneId := mux.Vars(r)["id"]
+		zone, status, err := business.NewZone(&zoneId, gh.Database).Delete()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, zone)
+	}
+}
+
+// ListZoneDevices ...
+func (gh *GroupHandler) ListZoneDevices() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		zoneId := mux.Vars(r)["id"]
+		zone, status, err := business.NewZone(&zoneId, gh.Database).Read()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		deviceIds, status, err := zone.DeviceIds()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, deviceIds)
+	}
+}
+
+// AddZoneDevice ...
+func (gh *GroupHandler) AddZoneDevice() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		zoneId := mux.Vars(r)["id"]
+
+		var zoneDevice business.ZoneDevice
+		err := json.NewDecoder(r.Body).Decode(&zoneDevice)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		member, status, err := business.NewZone(&zoneId, gh.Database).AddDevice(zoneDevice.DeviceId)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, member)
+	}
+}
+
+// RemoveZoneDevice ...
+func (gh *GroupHandler) RemoveZoneDevice() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		zoneId := mux.Vars(r)["id"]
+		deviceId := mux.Vars(r)["deviceId"]
+		member, status, err := business.NewZone(&zoneId, gh.Database).RemoveDevice(deviceId)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, member)
+	}
+}
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/api"
+	"gitlab.void-ptr.org/go/schism/pkg/api/errors"
+	"gitlab.void-ptr.org/go/schism/pkg/api/permissions"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+type JwtHandler struct {
+	Database *db.Sqlite `json:"-"`
+}
+
+// CreateJwt ...
+func (jh *JwtHandler) CreateJwt() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionRead) {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
+		// Only a device exchanges its own accesstoken
+		accesstoken, ok := r.Context().Value(api.ContextKeyToken).(*business.Accesstoken)
+		if !ok {
+			http.Error(w, errors.StatusBadRequest, http.StatusBadRequest)
+			return
+		}
+
+		// The body optionally narrows the scopes of the jwt
+		jwtCreate := business.JwtCreate{}
+		err := json.NewDecoder(r.Body).Decode(&jwtCreate)
+		if err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		jwt, status, err := business.IssueJwt(accesstoken, &jwtCreate)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, jwt)
+	}
+}
+
+// ReadJwks ...
+func (jh *JwtHandler) ReadJwks() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, http.StatusOK, business.JwtKeys.Jwks())
+	}
+}
+
+// ListJwtKeys ...
+func (jh *JwtHandler) ListJwtKeys() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		writeJSON(w, http.StatusOK, business.JwtKeys.List())
+	}
+}
+
+// RotateJwtKey ...
+func (jh *JwtHandler) RotateJwtKey() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		key, status, err := business.JwtKeys.Rotate(jh.Database, auditor(r))
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, key)
+	}
+}
+
+// ListJwtRevocations ...
+func (jh *JwtHandler) ListJwtRevocations() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		revocations, status, err := business.JwtRevocations.List(jh.Database)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, revocations)
+	}
+}
+
+// CreateJwtRevocation ...
+func (jh *JwtHandler) CreateJwtRevocation() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		var revocationCreate business.JwtRevocationCreate
+		err := json.NewDecoder(r.Body).Decode(&revocationCreate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		revocation, status, err := business.JwtRevocations.Revoke(jh.Database, &revocationCreate, auditor(r))
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, revocation)
+	}
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/api"
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+type RateLimitHandler struct {
+	Limiter  *api.RateLimiter    `json:"-"`
+	Lockouts *api.LockoutTracker `json:"-"`
+}
+
+// rateLimits are the configured limits and the requests counted since the start
+type rateLimits struct {
+	Default  config.RateLimit            `json:"default"`
+	Ip       config.RateLimit            `json:"ip"`
+	Routes   map[string]config.RateLimit `json:"routes"`
+	Counters []api.RateLimitCounter      `json:"counters"`
+}
+
+// ReadRateLimits ...
+func (rh *RateLimitHandler) ReadRateLimits() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		writeJSON(w, http.StatusOK, &rateLimits{
+			Default:  config.DefaultRateLimit,
+			Ip:       config.IpRateLimit,
+			Routes:   config.RateLimits,
+			Counters: rh.Limiter.Counters(),
+		})
+	}
+}
+
+// ListLockouts ...
+func (rh *RateLimitHandler) ListLockouts() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		writeJSON(w, http.StatusOK, rh.Lockouts.List())
+	}
+}
+
+// ClearLockouts ...
+func (rh *RateLimitHandler) ClearLockouts() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		n := rh.Lockouts.ClearAll()
+		util.Log.Infof("%s cleared %d lockouts", auditor(r).Actor, n)
+		writeJSON(w, http.StatusOK, map[string]int{"cleared": n})
+	}
+}
+
+// ClearLockout ...
+func (rh *RateLimitHandler) ClearLockout() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		key := mux.Vars(r)["key"]
+
+		if !rh.Lockouts.Clear(key) {
+			http.Error(w, fmt.Sprintf("no lockout of '%s'", key), http.StatusNotFound)
+			return
+		}
+		util.Log.Infof("%s cleared the lockout of %s", auditor(r).Actor, key)
+		writeJSON(w, http.StatusOK, map[string]int{"cleared": 1})
+	}
+}
@@ -0,0 +1,15 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// writeJSON writes a status and the json encoded value
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/reflection/pkg/sensors"
+	"gitlab.void-ptr.org/go/schism/pkg/api/errors"
+	"gitlab.void-ptr.org/go/schism/pkg/api/permissions"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+type SensorHandler struct {
+	Database *db.Sqlite `json:"-"`
+}
+
+// ReadSensors ...
+func (sh *SensorHandler) ReadSensors() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionReadDevice) {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
+		inventory, status, err := business.NewSensorInventory(deviceId, sh.Database).Read()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, inventory)
+	}
+}
+
+// UpdateSensors ...
+func (sh *SensorHandler) UpdateSensors() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		// Only the device itself declares its sensors
+		if !permissions.IsDevice(r) || !permissions.HasPermission(w, r, deviceId, permissions.ActionWrite) {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
+		var update business.SensorInventoryUpdate
+		err := json.NewDecoder(r.Body).Decode(&update)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		inventory, status, err := business.NewSensorInventory(deviceId, sh.Database).Replace(&update)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, inventory)
+	}
+}
+
+// FindSensors ...
+func (sh *SensorHandler) FindSensors() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		var sensorType *sensors.SensorType
+		if param := r.URL.Query().Get("type"); len(param) > 0 {
+			n, err := strconv.Atoi(param)
+			if err != nil {
+				http.Error(w, errors.StatusBadRequest, http.StatusBadRequest)
+				return
+			}
+			t := sensors.SensorType(n)
+			sensorType = &t
+		}
+
+		deviceSensors, status, err := business.FindSensors(sh.Database, sensorType)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, deviceSensors)
+	}
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+type SensorTypeHandler struct {
+	Database *db.Sqlite `json:"-"`
+}
+
+// ListSensorTypes ...
+func (sh *SensorTypeHandler) ListSensorTypes() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		definitions, status, err := business.NewSensorTypeDefinition("", sh.Database).List()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, definitions)
+	}
+}
+
+// CreateSensorType ...
+func (sh *SensorTypeHandler) CreateSensorType() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		var sensorTypeCreate business.SensorTypeCreate
+		err := json.NewDecoder(r.Body).Decode(&sensorTypeCreate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		definition := business.NewSensorTypeDefinition("", sh.Database)
+		definition.Auditor = auditor(r)
+		definition, status, err := definition.Create(&sensorTypeCreate)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, definition)
+	}
+}
+
+// ReadSensorType ...
+func (sh *SensorTypeHandler) ReadSensorType() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		name := mux.Vars(r)["name"]
+
+		definition, status, err := business.NewSensorTypeDefinition(name, sh.Database).Read()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, definition)
+	}
+}
+
+// UpdateSensorType ...
+func (sh *SensorTypeHandler) UpdateSensorType() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		name := mux.Vars(r)["name"]
+
+		var sensorTypeUpdate business.SensorTypeUpdate
+		err := json.NewDecoder(r.Body).Decode(&sensorTypeUpdate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		definition := business.NewSensorTypeDefinition(name, sh.Database)
+		definition.Auditor = auditor(r)
+		definition, status, err := definition.Update(&sensorTypeUpdate)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, definition)
+	}
+}
+
+// DeleteSensorType ...
+func (sh *SensorTypeHandler) DeleteSensorType() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		name := mux.Vars(r)["name"]
+
+		definition := business.NewSensorTypeDefinition(name, sh.Database)
+		definition.Auditor = auditor(r)
+		definition, status, err := definition.Delete()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, definition)
+	}
+}
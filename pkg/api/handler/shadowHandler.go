@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/api/errors"
+	"gitlab.void-ptr.org/go/schism/pkg/api/permissions"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+type ShadowHandler struct {
+	Database *db.Sqlite `json:"-"`
+}
+
+// shadowETag is derived from the desired version, that is what devices wait for
+func shadowETag(shadow *business.Shadow) string {
+	return fmt.Sprintf(`"%d"`, shadow.DesiredVersion)
+}
+
+// parseShadowETag returns the desired version of an etag
+func parseShadowETag(etag string) (int64, error) {
+	unquoted, err := strconv.Unquote(etag)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(unquoted, 10, 64)
+}
+
+// ReadShadow ...
+func (sh *ShadowHandler) ReadShadow() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+		ifNoneMatch := r.Header.Get("If-None-Match")
+
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionReadDevice) {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
+		// Long-poll for at most the configured time
+		var wait time.Duration
+		if param := r.URL.Query().Get("wait"); len(param) > 0 {
+			d, err := time.ParseDuration(param)
+			if err != nil || d < 0 {
+				http.Error(w, errors.StatusBadRequest, http.StatusBadRequest)
+				return
+			}
+			wait = d
+			if wait > config.ShadowMaxWait {
+				wait = config.ShadowMaxWait
+			}
+		}
+
+		// Watch before reading to not miss a change in between
+		changed := business.WatchShadow(deviceId)
+		shadow, status, err := business.NewShadow(deviceId, sh.Database).Read()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if len(ifNoneMatch) > 0 && ifNoneMatch == shadowETag(shadow) {
+			if wait == 0 {
+				w.Header().Set("ETag", shadowETag(shadow))
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-changed:
+				shadow, status, err = business.NewShadow(deviceId, sh.Database).Read()
+				if err != nil {
+					http.Error(w, err.Error(), status)
+					return
+				}
+			case <-timer.C:
+				w.Header().Set("ETag", shadowETag(shadow))
+				w.WriteHeader(http.StatusNotModified)
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		w.Header().Set("ETag", shadowETag(shadow))
+		writeJSON(w, status, shadow)
+	}
+}
+
+// ReportShadow ...
+func (sh *ShadowHandler) ReportShadow() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		// Only the device itself reports its state
+		if !permissions.IsDevice(r) || !permissions.HasPermission(w, r, deviceId, permissions.ActionWrite) {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
+		var reported map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&reported)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		shadow, status, err := business.NewShadow(deviceId, sh.Database).UpdateReported(reported)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("ETag", shadowETag(shadow))
+		writeJSON(w, status, shadow)
+	}
+}
+
+// ReadDesiredShadow ...
+func (sh *ShadowHandler) ReadDesiredShadow() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		shadow, status, err := business.NewShadow(deviceId, sh.Database).Read()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("ETag", shadowETag(shadow))
+		writeJSON(w, status, shadow)
+	}
+}
+
+// UpdateDesiredShadow ...
+func (sh *ShadowHandler) UpdateDesiredShadow() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+		ifMatch := r.Header.Get("If-Match")
+
+		var desired map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&desired)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Optionally reject updates based on an outdated version
+		var version *int64
+		if len(ifMatch) > 0 {
+			v, err := parseShadowETag(ifMatch)
+			if err != nil {
+				http.Error(w, "desired state was changed in the meantime", http.StatusPreconditionFailed)
+				return
+			}
+			version = &v
+		}
+
+		shadow, status, err := business.NewShadow(deviceId, sh.Database).UpdateDesired(desired, version)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("ETag", shadowETag(shadow))
+		writeJSON(w, status, shadow)
+	}
+}
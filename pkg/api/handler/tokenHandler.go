@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/api"
+	"gitlab.void-ptr.org/go/schism/pkg/api/errors"
+	"gitlab.void-ptr.org/go/schism/pkg/api/permissions"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+type TokenHandler struct {
+	Database *db.Sqlite `json:"-"`
+}
+
+// TokenRevokeOthers keeps a single accesstoken, the one of the requesting device if none is given
+type TokenRevokeOthers struct {
+	Keep string `json:"keep"`
+}
+
+type TokenRevokeOthersResponse struct {
+	Kept    string   `json:"kept"`
+	Revoked []string `json:"revoked"`
+}
+
+// ListTokens ...
+func (th *TokenHandler) ListTokens() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionRead) {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
+		accesstokens, status, err := business.ListAccesstokens(th.Database, deviceId)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, accesstokens)
+	}
+}
+
+// RevokeToken ...
+func (th *TokenHandler) RevokeToken() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+		tokenId := mux.Vars(r)["tokenId"]
+
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionWrite) {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
+		// Tokens of other devices do not exist for this one
+		accesstoken, status, err := business.NewAccesstoken(&tokenId, th.Database).Read()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if accesstoken.DeviceId != deviceId {
+			http.Error(w, fmt.Sprintf("accesstoken with id '%s' does not exist", tokenId), http.StatusNotFound)
+			return
+		}
+
+		accesstoken.Auditor = auditor(r)
+		accesstoken, status, err = accesstoken.Delete()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, accesstoken)
+	}
+}
+
+// RevokeOtherTokens ...
+func (th *TokenHandler) RevokeOtherTokens() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		deviceId := mux.Vars(r)["id"]
+
+		if !permissions.HasPermission(w, r, deviceId, permissions.ActionWrite) {
+			http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+			return
+		}
+
+		var revoke TokenRevokeOthers
+		err := json.NewDecoder(r.Body).Decode(&revoke)
+		if err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(revoke.Keep) == 0 {
+			accesstoken, ok := r.Context().Value(api.ContextKeyToken).(*business.Accesstoken)
+			if !ok || accesstoken.Jwt || accesstoken.Certificate {
+				http.Error(w, "no accesstoken given to keep", http.StatusBadRequest)
+				return
+			}
+			revoke.Keep = *accesstoken.Id
+		}
+
+		revoked, status, err := business.RevokeOtherAccesstokens(th.Database, deviceId, revoke.Keep, auditor(r))
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, &TokenRevokeOthersResponse{Kept: revoke.Keep, Revoked: revoked})
+	}
+}
@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/api"
+	"gitlab.void-ptr.org/go/schism/pkg/api/errors"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+type UserHandler struct {
+	Database *db.Sqlite `json:"-"`
+}
+
+// Login ...
+func (uh *UserHandler) Login() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		var login business.SessionLogin
+		err := json.NewDecoder(r.Body).Decode(&login)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Wrong passwords lock out the username from the client ip, the username and the ip itself
+		ip := api.ClientIp(r)
+		username := strings.TrimSpace(login.Username)
+		lockouts := []string{api.LockoutUserIp(username, ip), api.LockoutUser(username), api.LockoutIp(ip)}
+		if remaining, locked := api.Lockouts.Locked(lockouts...); locked {
+			api.RejectLockedOut(w, remaining)
+			return
+		}
+
+		session := business.NewSession(nil, uh.Database)
+		session.Auditor = auditor(r)
+		session, status, err := session.Login(&login)
+		if err != nil {
+			if status == http.StatusUnauthorized {
+				api.Lockouts.Fail(lockouts...)
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		api.Lockouts.Succeed(api.LockoutUserIp(username, ip), api.LockoutUser(username))
+		writeJSON(w, status, session)
+	}
+}
+
+// Logout ...
+func (uh *UserHandler) Logout() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		session, ok := r.Context().Value(api.ContextKeySession).(*business.Session)
+		if !ok {
+			http.Error(w, errors.StatusUnauthorized, http.StatusUnauthorized)
+			return
+		}
+		session.Auditor = auditor(r)
+		session, status, err := session.Logout()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, session)
+	}
+}
+
+// ReadMe ...
+func (uh *UserHandler) ReadMe() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		user, ok := r.Context().Value(api.ContextKeyUser).(*business.User)
+		if !ok {
+			http.Error(w, errors.StatusUnauthorized, http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, http.StatusOK, user)
+	}
+}
+
+// ListUsers ...
+func (uh *UserHandler) ListUsers() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		users, status, err := business.NewUser(nil, uh.Database).List()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, users)
+	}
+}
+
+// CreateUser ...
+func (uh *UserHandler) CreateUser() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		var userCreate business.UserCreate
+		err := json.NewDecoder(r.Body).Decode(&userCreate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user := business.NewUser(nil, uh.Database)
+		user.Auditor = auditor(r)
+		user, status, err := user.Create(&userCreate)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, user)
+	}
+}
+
+// ReadUser ...
+func (uh *UserHandler) ReadUser() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		userId := mux.Vars(r)["id"]
+
+		user, status, err := business.NewUser(&userId, uh.Database).Read()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, user)
+	}
+}
+
+// UpdateUser ...
+func (uh *UserHandler) UpdateUser() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		userId := mux.Vars(r)["id"]
+
+		var userUpdate business.UserUpdate
+		err := json.NewDecoder(r.Body).Decode(&userUpdate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user := business.NewUser(&userId, uh.Database)
+		user.Auditor = auditor(r)
+		user, status, err := user.Update(&userUpdate)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, user)
+	}
+}
+
+// DeleteUser ...
+func (uh *UserHandler) DeleteUser() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		// Get parameters
+		userId := mux.Vars(r)["id"]
+
+		user := business.NewUser(&userId, uh.Database)
+		user.Auditor = auditor(r)
+		user, status, err := user.Delete()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, status, user)
+	}
+}
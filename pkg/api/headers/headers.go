@@ -2,3 +2,12 @@ package headers
 
 const HeaderSchismToken = "x-schism-token"
 const HeaderSchismSecret = "x-schism-secret"
+const HeaderRequestId = "x-request-id"
+const HeaderSchismSession = "x-schism-session"
+const HeaderSchismTimestamp = "x-schism-timestamp"
+const HeaderSchismNonce = "x-schism-nonce"
+const HeaderSchismSignature = "x-schism-signature"
+const HeaderRateLimitLimit = "x-ratelimit-limit"
+const HeaderRateLimitRemaining = "x-ratelimit-remaining"
+const HeaderRateLimitReset = "x-ratelimit-reset"
+const HeaderRetryAfter = "retry-after"
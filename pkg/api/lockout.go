@@ -0,0 +1,197 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/api/errors"
+	"gitlab.void-ptr.org/go/schism/pkg/api/headers"
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// Lockout counts the failed attempts of a client ip, a device id or username, or one of those from a client ip.
+// It is locked out until LockedUntil.
+type Lockout struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"date_last_failure"`
+	LockedUntil   *time.Time `json:"date_locked_until"`
+}
+
+// LockoutTracker remembers failed attempts, past a threshold each one doubles the lockout
+type LockoutTracker struct {
+	mutex    sync.Mutex
+	lockouts map[string]*Lockout
+}
+
+// Lockouts of all clients, forgotten failures are swept by Sweep
+var Lockouts = NewLockoutTracker()
+
+func NewLockoutTracker() *LockoutTracker {
+	return &LockoutTracker{lockouts: map[string]*Lockout{}}
+}
+
+// LockoutIp is the key of a client ip
+func LockoutIp(ip string) string {
+	return "ip:" + ip
+}
+
+// LockoutDevice is the key of a device id used from any client ip, it has the higher config.LockoutIdThreshold
+func LockoutDevice(deviceId string) string {
+	return "device:" + deviceId
+}
+
+// LockoutDeviceIp is the key of a device id used from a client ip
+func LockoutDeviceIp(deviceId string, ip string) string {
+	return LockoutDevice(deviceId) + "@" + ip
+}
+
+// LockoutUser is the key of a username used from any client ip, it has the higher config.LockoutIdThreshold
+func LockoutUser(username string) string {
+	return "user:" + username
+}
+
+// LockoutUserIp is the key of a username used from a client ip
+func LockoutUserIp(username string, ip string) string {
+	return LockoutUser(username) + "@" + ip
+}
+
+// lockoutThreshold of a key, ids used from any ip take more failures to lock out
+func lockoutThreshold(key string) int {
+	if strings.HasPrefix(key, "ip:") || strings.Contains(key, "@") {
+		return config.LockoutThreshold
+	}
+	return config.LockoutIdThreshold
+}
+
+// forgotten failures are the ones older than the longest lockout
+func (l *Lockout) forgotten(now time.Time) bool {
+	return now.Sub(l.LastFailureAt) > config.LockoutMaxDuration && (l.LockedUntil == nil || !now.Before(*l.LockedUntil))
+}
+
+// Locked checks if any of the keys is locked out and returns the longest remaining time
+func (t *LockoutTracker) Locked(keys ...string) (time.Duration, bool) {
+	now := time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var remaining time.Duration
+	for _, key := range keys {
+		if lockout, ok := t.lockouts[key]; ok && lockout.LockedUntil != nil {
+			if d := lockout.LockedUntil.Sub(now); d > remaining {
+				remaining = d
+			}
+		}
+	}
+	return remaining, remaining > 0
+}
+
+// Fail records a failed attempt of all keys and locks out the ones past the threshold
+func (t *LockoutTracker) Fail(keys ...string) {
+	if config.LockoutThreshold == 0 {
+		return
+	}
+	now := time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, key := range keys {
+		threshold := lockoutThreshold(key)
+		if threshold == 0 {
+			continue
+		}
+		lockout, ok := t.lockouts[key]
+		if !ok || lockout.forgotten(now) {
+			lockout = &Lockout{Key: key}
+			t.lockouts[key] = lockout
+		}
+		lockout.Failures++
+		lockout.LastFailureAt = now
+
+		exceeded := lockout.Failures - threshold
+		if exceeded < 0 {
+			continue
+		}
+		duration := config.LockoutDuration
+		for i := 0; i < exceeded && duration < config.LockoutMaxDuration; i++ {
+			duration *= 2
+		}
+		if duration > config.LockoutMaxDuration {
+			duration = config.LockoutMaxDuration
+		}
+		lockedUntil := now.Add(duration)
+		lockout.LockedUntil = &lockedUntil
+		util.Log.Warningf("locked out %s for %s after %d failed attempts", key, duration, lockout.Failures)
+	}
+}
+
+// Succeed forgets the failed attempts of all keys
+func (t *LockoutTracker) Succeed(keys ...string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, key := range keys {
+		delete(t.lockouts, key)
+	}
+}
+
+// List the keys with remembered failures, ordered by key
+func (t *LockoutTracker) List() []Lockout {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	lockouts := make([]Lockout, 0, len(t.lockouts))
+	for _, lockout := range t.lockouts {
+		lockouts = append(lockouts, *lockout)
+	}
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].Key < lockouts[j].Key })
+	return lockouts
+}
+
+// Clear the failures and lockout of a key, false if there were none
+func (t *LockoutTracker) Clear(key string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	_, ok := t.lockouts[key]
+	delete(t.lockouts, key)
+	return ok
+}
+
+// ClearAll failures and lockouts, returns how many keys were cleared
+func (t *LockoutTracker) ClearAll() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	n := len(t.lockouts)
+	t.lockouts = map[string]*Lockout{}
+	return n
+}
+
+// Sweep removes forgotten failures
+func (t *LockoutTracker) Sweep() {
+	now := time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for key, lockout := range t.lockouts {
+		if lockout.forgotten(now) {
+			delete(t.lockouts, key)
+		}
+	}
+}
+
+// RejectLockedOut answers a request of a locked out client, telling it when to retry
+func RejectLockedOut(w http.ResponseWriter, remaining time.Duration) {
+	w.Header().Set(headers.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+	http.Error(w, errors.StatusLockedOut, http.StatusTooManyRequests)
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+)
+
+// testLockoutConfig sets the lockout config for a test, ids alone take ten times the failures
+func testLockoutConfig(t *testing.T, threshold int, duration time.Duration, maxDuration time.Duration) {
+	t.Helper()
+	previousThreshold, previousIdThreshold := config.LockoutThreshold, config.LockoutIdThreshold
+	previousDuration, previousMaxDuration := config.LockoutDuration, config.LockoutMaxDuration
+	t.Cleanup(func() {
+		config.LockoutThreshold, config.LockoutIdThreshold = previousThreshold, previousIdThreshold
+		config.LockoutDuration, config.LockoutMaxDuration = previousDuration, previousMaxDuration
+	})
+	config.LockoutThreshold, config.LockoutIdThreshold = threshold, 10*threshold
+	config.LockoutDuration, config.LockoutMaxDuration = duration, maxDuration
+}
+
+func TestLockoutTrackerFail(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		failures  int
+		want      time.Duration
+	}{
+		{"below threshold", 3, 2, 0},
+		{"at threshold", 3, 3, time.Minute},
+		{"doubled once", 3, 4, 2 * time.Minute},
+		{"doubled twice", 3, 5, 4 * time.Minute},
+		{"doubled three times", 3, 6, 8 * time.Minute},
+		{"capped", 3, 7, 10 * time.Minute},
+		{"capped after many", 3, 100, 10 * time.Minute},
+		{"disabled", 0, 100, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testLockoutConfig(t, tt.threshold, time.Minute, 10*time.Minute)
+			tracker := NewLockoutTracker()
+			for i := 0; i < tt.failures; i++ {
+				tracker.Fail("ip:127.0.0.1")
+			}
+
+			lockout, ok := tracker.lockouts["ip:127.0.0.1"]
+			var got time.Duration
+			if ok && lockout.LockedUntil != nil {
+				got = lockout.LockedUntil.Sub(lockout.LastFailureAt)
+			}
+			if got != tt.want {
+				t.Errorf("Fail() locked out for %s, want %s", got, tt.want)
+			}
+			if _, locked := tracker.Locked("ip:127.0.0.1"); locked != (tt.want > 0) {
+				t.Errorf("Locked() = %v, want %v", locked, tt.want > 0)
+			}
+		})
+	}
+
+	t.Run("forgotten failures start over", func(t *testing.T) {
+		testLockoutConfig(t, 3, time.Minute, 10*time.Minute)
+		tracker := NewLockoutTracker()
+		lockedUntil := time.Now().Add(-time.Hour)
+		tracker.lockouts["ip:127.0.0.1"] = &Lockout{Key: "ip:127.0.0.1", Failures: 10, LastFailureAt: lockedUntil, LockedUntil: &lockedUntil}
+
+		tracker.Fail("ip:127.0.0.1")
+		if lockout := tracker.lockouts["ip:127.0.0.1"]; lockout.Failures != 1 || lockout.LockedUntil != nil {
+			t.Errorf("Fail() = %+v, want a single failure without lockout", lockout)
+		}
+	})
+
+	t.Run("keys fail independently", func(t *testing.T) {
+		testLockoutConfig(t, 1, time.Minute, 10*time.Minute)
+		tracker := NewLockoutTracker()
+		tracker.Fail(LockoutDeviceIp("device", "127.0.0.1"))
+
+		if _, locked := tracker.Locked(LockoutDeviceIp("device", "127.0.0.2")); locked {
+			t.Errorf("Locked() of the device from another ip, want it not locked out")
+		}
+		if _, locked := tracker.Locked(LockoutDeviceIp("device", "127.0.0.1")); !locked {
+			t.Errorf("Locked() of the device from the failing ip, want it locked out")
+		}
+	})
+	t.Run("device ids fail from many ips", func(t *testing.T) {
+		testLockoutConfig(t, 2, time.Minute, 10*time.Minute)
+		tracker := NewLockoutTracker()
+		for i := 0; i < 20; i++ {
+			ip := fmt.Sprintf("10.0.0.%d", i)
+			if _, locked := tracker.Locked(LockoutDevice("device")); locked {
+				t.Fatalf("Locked() of the device after %d failures, want the threshold of ids", i)
+			}
+			tracker.Fail(LockoutDeviceIp("device", ip), LockoutDevice("device"), LockoutIp(ip))
+		}
+		if _, locked := tracker.Locked(LockoutDevice("device")); !locked {
+			t.Errorf("Locked() of the device after 20 failures from different ips, want it locked out")
+		}
+		if _, locked := tracker.Locked(LockoutDevice("other")); locked {
+			t.Errorf("Locked() of another device, want it not locked out")
+		}
+	})
+}
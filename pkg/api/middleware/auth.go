@@ -2,38 +2,97 @@ package middleware
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 
 	"github.com/gorilla/mux"
 	"gitlab.void-ptr.org/go/schism/pkg/api"
+	"gitlab.void-ptr.org/go/schism/pkg/api/errors"
 	"gitlab.void-ptr.org/go/schism/pkg/api/headers"
+	"gitlab.void-ptr.org/go/schism/pkg/api/permissions"
 	"gitlab.void-ptr.org/go/schism/pkg/business"
 	"gitlab.void-ptr.org/go/schism/pkg/db"
 )
 
-// AuthMiddleware checks if a request contains the x-schism-token header and attaches the according device
+// AuthMiddleware checks if a request contains the x-schism-token header or a client certificate and attaches the according device,
+// requests of users logged in by the secret middleware and requests with only an api key pass on to the permission checks
 type AuthMiddleware struct {
 	Database *db.Sqlite
+	// scopes required per route, routes without a declaration are rejected
+	scopes map[*mux.Route][]string
 }
 
 // NewAuthMiddleware creates a new middleware instance
 func NewAuthMiddleware(database *db.Sqlite) *AuthMiddleware {
-	return &AuthMiddleware{Database: database}
+	return &AuthMiddleware{Database: database, scopes: map[*mux.Route][]string{}}
+}
+
+// Require declares the scopes a token needs for a route, none means any authenticated token
+func (m *AuthMiddleware) Require(route *mux.Route, scopes ...string) *mux.Route {
+	m.scopes[route] = scopes
+	return route
+}
+
+// missingScope returns the first scope of the matched route the token lacks
+func (m *AuthMiddleware) missingScope(r *http.Request, accesstoken *business.Accesstoken) (string, bool) {
+	required, ok := m.scopes[mux.CurrentRoute(r)]
+	if !ok {
+		return "", false
+	}
+	for _, scope := range required {
+		if !accesstoken.HasScope(scope) {
+			return scope, false
+		}
+	}
+	return "", true
 }
 
 func (m *AuthMiddleware) Func() mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Check if device is authenticated
+			// Permissions evaluate grants, cached for the request
+			r = r.WithContext(permissions.WithCache(r.Context(), m.Database))
+
+			// Logged in users are checked by their role instead of a device token
+			if _, ok := r.Context().Value(api.ContextKeyUser).(*business.User); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Without any device credential the api key is only allowed what was granted to it
 			token := r.Header.Get(headers.HeaderSchismToken)
-			accesstoken, device, _, err := m.getAuthenticatedDevice(r, token)
+			if _, ok := r.Context().Value(api.ContextKeyApiKey).(*api.ApiKey); ok && len(token) == 0 && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Check if device is authenticated
+			accesstoken, device, status, err := m.getAuthenticatedDevice(r, token)
 
-			// Reject on any error
+			// Reject disabled devices, anything else is unauthorized
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
+				if status != http.StatusForbidden {
+					status = http.StatusUnauthorized
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+
+			// Reject tokens without the scopes of the route
+			if scope, ok := m.missingScope(r, accesstoken); !ok {
+				if len(scope) == 0 {
+					http.Error(w, errors.StatusForbidden, http.StatusForbidden)
+					return
+				}
+				http.Error(w, fmt.Sprintf("accesstoken lacks scope '%s'", scope), http.StatusForbidden)
 				return
 			}
 
+			business.Presence.Seen(*device.Id, "")
+			if !accesstoken.Jwt && !accesstoken.Certificate {
+				business.TokenUsage.Used(*accesstoken.Id, api.ClientIp(r), r.UserAgent())
+			}
+
 			// Attach authenticated device and token to request context
 			ctxWithDeviceAndToken := context.WithValue(r.Context(), api.ContextKeyDevice, device)
 			ctxWithDeviceAndToken = context.WithValue(ctxWithDeviceAndToken, api.ContextKeyToken, accesstoken)
@@ -46,9 +105,26 @@ func (m *AuthMiddleware) Func() mux.MiddlewareFunc {
 
 func (m *AuthMiddleware) getAuthenticatedDevice(r *http.Request, token string) (*business.Accesstoken, *business.Device, int, error) {
 
-	// Authenticate with accesstoken
-	accesstoken := business.NewAccesstoken(nil, m.Database)
-	accesstoken, status, err := accesstoken.Authenticate(token)
+	// Jwts are verified without the database, revocation covers disabled and deleted devices
+	if business.IsJwt(token) {
+		accesstoken, status, err := business.VerifyJwt(token)
+		if err != nil {
+			return nil, nil, status, err
+		}
+		device := business.NewDevice(&accesstoken.DeviceId, m.Database)
+		device.State = business.DeviceStateActive
+		return accesstoken, device, status, nil
+	}
+
+	// Authenticate with a client certificate the tls server verified against the device ca, or else the accesstoken
+	var accesstoken *business.Accesstoken
+	var status int
+	var err error
+	if len(token) == 0 && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		accesstoken, status, err = business.AuthenticateCertificate(m.Database, r.TLS.PeerCertificates[0])
+	} else {
+		accesstoken, status, err = business.NewAccesstoken(nil, m.Database).Authenticate(token)
+	}
 	if err != nil {
 		return nil, nil, status, err
 	}
@@ -59,6 +135,9 @@ func (m *AuthMiddleware) getAuthenticatedDevice(r *http.Request, token string) (
 	if err != nil {
 		return nil, nil, status, err
 	}
+	if device.State != business.DeviceStateActive {
+		return nil, nil, http.StatusForbidden, fmt.Errorf("device is %s", device.State)
+	}
 
 	return accesstoken, device, status, nil
 }
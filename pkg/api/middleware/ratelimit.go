@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/api"
+	"gitlab.void-ptr.org/go/schism/pkg/api/headers"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+)
+
+// RateLimitMiddleware limits the requests per route of each authenticated device, or of each client ip before one is known.
+// Attach it after the auth middleware, so requests of devices are limited by their id.
+type RateLimitMiddleware struct {
+	Limiter *api.RateLimiter
+	// ip limits all routes together per client ip, attached before the secret middleware
+	ip bool
+}
+
+// ipRateLimitRoute counts the requests limited per client ip
+const ipRateLimitRoute = "ip"
+
+// NewRateLimitMiddleware creates a new middleware instance
+func NewRateLimitMiddleware(limiter *api.RateLimiter) *RateLimitMiddleware {
+	return &RateLimitMiddleware{Limiter: limiter}
+}
+
+// NewIpRateLimitMiddleware creates a new middleware instance limiting client ips before they are authenticated
+func NewIpRateLimitMiddleware(limiter *api.RateLimiter) *RateLimitMiddleware {
+	return &RateLimitMiddleware{Limiter: limiter, ip: true}
+}
+
+// limit of a route, configured for the method and path, the path alone or else the default
+func (m *RateLimitMiddleware) limit(method string, path string) config.RateLimit {
+	if limit, ok := config.RateLimits[method+" "+path]; ok {
+		return limit
+	}
+	if limit, ok := config.RateLimits[path]; ok {
+		return limit
+	}
+	return config.DefaultRateLimit
+}
+
+// seconds rounded up, headers never announce less than the actual wait
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+func (m *RateLimitMiddleware) Func() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := mux.CurrentRoute(r)
+			if route == nil || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+			path, err := route.GetPathTemplate()
+			if err != nil {
+				path = r.URL.Path
+			}
+			limit := m.limit(r.Method, path)
+			key := r.Method + " " + path
+			if m.ip {
+				limit = config.IpRateLimit
+				key = ipRateLimitRoute
+			}
+			if limit.Rate <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			client := "ip:" + api.ClientIp(r)
+			if device, ok := r.Context().Value(api.ContextKeyDevice).(*business.Device); ok && !m.ip {
+				client = "device:" + *device.Id
+			}
+
+			decision := m.Limiter.Allow(key, client, limit)
+			w.Header().Set(headers.HeaderRateLimitLimit, strconv.Itoa(decision.Limit))
+			w.Header().Set(headers.HeaderRateLimitRemaining, strconv.Itoa(decision.Remaining))
+			w.Header().Set(headers.HeaderRateLimitReset, seconds(decision.Reset))
+			if !decision.Allowed {
+				w.Header().Set(headers.HeaderRetryAfter, seconds(decision.RetryAfter))
+				http.Error(w, fmt.Sprintf("rate limit of %s exceeded", path), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/api"
+	"gitlab.void-ptr.org/go/schism/pkg/api/headers"
+)
+
+// requestIdPattern limits request ids passed in by clients, anything else is replaced
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestIdMiddleware attaches an id to every request and echoes it in the x-request-id header
+type RequestIdMiddleware struct{}
+
+// NewRequestIdMiddleware creates a new middleware instance
+func NewRequestIdMiddleware() *RequestIdMiddleware {
+	return &RequestIdMiddleware{}
+}
+
+func (m *RequestIdMiddleware) Func() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestId := r.Header.Get(headers.HeaderRequestId)
+			if !requestIdPattern.MatchString(requestId) {
+				requestId = uuid.New().String()
+			}
+			w.Header().Set(headers.HeaderRequestId, requestId)
+
+			ctxWithRequestId := context.WithValue(r.Context(), api.ContextKeyRequestId, requestId)
+			next.ServeHTTP(w, r.WithContext(ctxWithRequestId))
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/api"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+)
+
+// roleScopes are the api key scopes equal to the user roles
+var roleScopes = map[string]string{
+	business.RoleViewer:   api.ApiKeyScopeRead,
+	business.RoleOperator: api.ApiKeyScopeWrite,
+	business.RoleAdmin:    api.ApiKeyScopeAdmin,
+}
+
+// RoleMiddleware checks the role of a logged in user or the scopes of the api key on admin routes
+type RoleMiddleware struct {
+	// Role required, none means viewer for reading and operator for changing requests
+	Role string
+	// Scope required of api keys, none means the one equal to the role
+	Scope string
+}
+
+// NewRoleMiddleware creates a new middleware instance
+func NewRoleMiddleware(role string, scope string) *RoleMiddleware {
+	return &RoleMiddleware{role, scope}
+}
+
+func (m *RoleMiddleware) required(r *http.Request) string {
+	if len(m.Role) > 0 {
+		return m.Role
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return business.RoleViewer
+	}
+	return business.RoleOperator
+}
+
+func (m *RoleMiddleware) requiredScope(r *http.Request) string {
+	if len(m.Scope) > 0 {
+		return m.Scope
+	}
+	return roleScopes[m.required(r)]
+}
+
+func (m *RoleMiddleware) Func() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user, ok := r.Context().Value(api.ContextKeyUser).(*business.User); ok {
+				if role := m.required(r); !user.HasRole(role) {
+					http.Error(w, fmt.Sprintf("user lacks role '%s'", role), http.StatusForbidden)
+					return
+				}
+			} else if key, ok := r.Context().Value(api.ContextKeyApiKey).(*api.ApiKey); ok {
+				if scope := m.requiredScope(r); !key.HasScope(scope) {
+					http.Error(w, fmt.Sprintf("api key lacks scope '%s'", scope), http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -1,34 +1,81 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/api"
 	"gitlab.void-ptr.org/go/schism/pkg/api/errors"
 	"gitlab.void-ptr.org/go/schism/pkg/api/headers"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
 )
 
-// SecretMiddleware checks if the x-schism-secret header is containing the API secret
+// SecretMiddleware checks if the x-schism-secret header is containing a valid API key and attaches it,
+// a user session in the x-schism-session header is accepted instead and attaches the according user.
+// Wrong secrets lock out the client ip for a while, requests carrying a valid device credential are let through
+// the lockout so devices sharing the ip behind nat keep working. Expired or unknown sessions are no failed attempts.
 type SecretMiddleware struct {
-	ApiSecret string
+	ApiKeys  *api.ApiKeyring
+	Database *db.Sqlite
 }
 
 // NewSecretMiddleware creates a new middleware instance
-func NewSecretMiddleware(secret string) *SecretMiddleware {
-	return &SecretMiddleware{secret}
+func NewSecretMiddleware(keys *api.ApiKeyring, database *db.Sqlite) *SecretMiddleware {
+	return &SecretMiddleware{keys, database}
 }
 
 func (m *SecretMiddleware) Func() mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			secret := r.Header.Get(headers.HeaderSchismSecret)
-			// Reject if secrets do not match
-			if secret != m.ApiSecret {
+			ip := api.LockoutIp(api.ClientIp(r))
+			if remaining, locked := api.Lockouts.Locked(ip); locked && !m.hasDeviceCredential(r) {
+				api.RejectLockedOut(w, remaining)
+				return
+			}
+
+			// Prefer a user session over the shared secret
+			if token := r.Header.Get(headers.HeaderSchismSession); len(token) > 0 {
+				session, status, err := business.NewSession(nil, m.Database).Authenticate(token)
+				if err != nil {
+					http.Error(w, err.Error(), status)
+					return
+				}
+				ctxWithUser := context.WithValue(r.Context(), api.ContextKeyUser, session.User)
+				ctxWithUser = context.WithValue(ctxWithUser, api.ContextKeySession, session)
+				next.ServeHTTP(w, r.WithContext(ctxWithUser))
+				return
+			}
+
+			// Reject if no key matches, or the matching one has expired
+			key, ok := m.ApiKeys.Authenticate(r.Header.Get(headers.HeaderSchismSecret))
+			if !ok {
+				api.Lockouts.Fail(ip)
 				http.Error(w, errors.StatusUnauthorized, http.StatusUnauthorized)
 				return
 			}
-			// Check passed, secret is fine
-			next.ServeHTTP(w, r)
+			// Check passed, secret is fine. Failures of the ip are kept, many devices may share one behind nat
+			ctxWithKey := context.WithValue(r.Context(), api.ContextKeyApiKey, key)
+			next.ServeHTTP(w, r.WithContext(ctxWithKey))
 		})
 	}
 }
+
+// hasDeviceCredential checks if the request carries a valid jwt, accesstoken or client certificate of a device,
+// the auth middleware checks the device itself later on
+func (m *SecretMiddleware) hasDeviceCredential(r *http.Request) bool {
+	token := r.Header.Get(headers.HeaderSchismToken)
+	var err error
+	switch {
+	case business.IsJwt(token):
+		_, _, err = business.VerifyJwt(token)
+	case len(token) > 0:
+		_, _, err = business.NewAccesstoken(nil, m.Database).Authenticate(token)
+	case r.TLS != nil && len(r.TLS.VerifiedChains) > 0:
+		_, _, err = business.AuthenticateCertificate(m.Database, r.TLS.PeerCertificates[0])
+	default:
+		return false
+	}
+	return err == nil
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gitlab.void-ptr.org/go/schism/pkg/api"
+	"gitlab.void-ptr.org/go/schism/pkg/api/errors"
+	"gitlab.void-ptr.org/go/schism/pkg/api/headers"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+// SignatureMiddleware verifies the x-schism-signature header of devices with a signing key,
+// it has to run after the AuthMiddleware attached the device
+type SignatureMiddleware struct {
+	Database *db.Sqlite
+}
+
+// NewSignatureMiddleware creates a new middleware instance
+func NewSignatureMiddleware(database *db.Sqlite) *SignatureMiddleware {
+	return &SignatureMiddleware{database}
+}
+
+func (m *SignatureMiddleware) Func() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Users are not signing their requests
+			device, ok := r.Context().Value(api.ContextKeyDevice).(*business.Device)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Devices without a signing key send unsigned requests, their bodies are left to the handler
+			signingKey := business.NewSigningKey(*device.Id, m.Database)
+			signed, status, err := signingKey.Exists()
+			if err != nil {
+				http.Error(w, err.Error(), status)
+				return
+			}
+			var body []byte
+			if signed {
+				// The body is covered by the signature, keep it readable for the handler
+				limit := int64(config.SignedBodyLimit)
+				body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+				if err != nil && int64(len(body)) >= limit {
+					http.Error(w, "request body is too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				if err != nil {
+					http.Error(w, errors.StatusBadRequest, http.StatusBadRequest)
+					return
+				}
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+
+			request := &business.SignedRequest{
+				Method:    r.Method,
+				Uri:       r.URL.RequestURI(),
+				Timestamp: r.Header.Get(headers.HeaderSchismTimestamp),
+				Nonce:     r.Header.Get(headers.HeaderSchismNonce),
+				Body:      body,
+				Signature: r.Header.Get(headers.HeaderSchismSignature),
+			}
+			status, err = signingKey.Verify(request)
+			if err != nil {
+				http.Error(w, err.Error(), status)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
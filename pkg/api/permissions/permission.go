@@ -1,16 +1,116 @@
 package permissions
 
 import (
+	"context"
 	"net/http"
+	"sync"
 
 	"gitlab.void-ptr.org/go/schism/pkg/api"
 	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
 )
 
-func HasPermission(w http.ResponseWriter, r *http.Request, deviceId string) bool {
-	self := r.Context().Value(api.ContextKeyDevice).(*business.Device)
-	if *self.Id != deviceId {
+// Actions on a device, a user needs the role of the action while a device may do all of them to itself.
+// Reading a device or its data can also be granted to other devices, users and api keys.
+const (
+	ActionRead       = "read"
+	ActionReadDevice = "read-device"
+	ActionReadData   = "read-data"
+	ActionWrite      = "write"
+	ActionDelete     = "delete"
+)
+
+var actionRoles = map[string]string{
+	ActionRead:       business.RoleViewer,
+	ActionReadDevice: business.RoleViewer,
+	ActionReadData:   business.RoleViewer,
+	ActionWrite:      business.RoleOperator,
+	ActionDelete:     business.RoleAdmin,
+}
+
+var actionGrants = map[string]string{
+	ActionReadDevice: business.GrantReadDevice,
+	ActionReadData:   business.GrantReadData,
+}
+
+// cache of the grants evaluated for a request
+type cache struct {
+	database *db.Sqlite
+	mutex    sync.Mutex
+	results  map[[2]string]bool
+}
+
+// WithCache attaches the database grants are read from, each grant is only evaluated once per request
+func WithCache(ctx context.Context, database *db.Sqlite) context.Context {
+	return context.WithValue(ctx, api.ContextKeyPermissions, &cache{database: database, results: map[[2]string]bool{}})
+}
+
+// principal of a request, a logged in user, an authenticated device or else the api key used
+func principal(r *http.Request) (string, string, bool) {
+	if user, ok := r.Context().Value(api.ContextKeyUser).(*business.User); ok {
+		return business.GrantPrincipalUser, *user.Id, true
+	}
+	if device, ok := r.Context().Value(api.ContextKeyDevice).(*business.Device); ok {
+		return business.GrantPrincipalDevice, *device.Id, true
+	}
+	if key, ok := r.Context().Value(api.ContextKeyApiKey).(*api.ApiKey); ok {
+		return business.GrantPrincipalApiKey, key.Name, true
+	}
+	return "", "", false
+}
+
+// granted checks the grants of the principal of a request, requests without a cache have none
+func granted(r *http.Request, deviceId string, action string) bool {
+	grant, ok := actionGrants[action]
+	if !ok {
+		return false
+	}
+	c, ok := r.Context().Value(api.ContextKeyPermissions).(*cache)
+	if !ok {
+		return false
+	}
+	kind, id, ok := principal(r)
+	if !ok {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := [2]string{deviceId, grant}
+	if result, ok := c.results[key]; ok {
+		return result
+	}
+	result, err := business.HasGrant(c.database, kind, id, deviceId, grant)
+	if err != nil {
+		util.Log.Error(err)
 		return false
 	}
-	return true
+	c.results[key] = result
+	return result
+}
+
+func HasPermission(w http.ResponseWriter, r *http.Request, deviceId string, action string) bool {
+	if user, ok := r.Context().Value(api.ContextKeyUser).(*business.User); ok {
+		role, ok := actionRoles[action]
+		return (ok && user.HasRole(role)) || granted(r, deviceId, action)
+	}
+	self, ok := r.Context().Value(api.ContextKeyDevice).(*business.Device)
+	if ok && *self.Id == deviceId {
+		return true
+	}
+	return granted(r, deviceId, action)
+}
+
+// IsUser checks if a request was authenticated by a user session instead of a device
+func IsUser(r *http.Request) bool {
+	_, ok := r.Context().Value(api.ContextKeyUser).(*business.User)
+	return ok
+}
+
+// IsDevice checks if a request was authenticated by a device
+func IsDevice(r *http.Request) bool {
+	_, ok := r.Context().Value(api.ContextKeyDevice).(*business.Device)
+	return ok
 }
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+)
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   config.RateLimit
+}
+
+// RateLimitDecision of a single request
+type RateLimitDecision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, zero if it is
+	RetryAfter time.Duration
+}
+
+// RateLimitCounter counts the requests of a route
+type RateLimitCounter struct {
+	Route   string `json:"route"`
+	Allowed int64  `json:"allowed"`
+	Limited int64  `json:"limited"`
+}
+
+// RateLimiter holds a token bucket per route and client
+type RateLimiter struct {
+	mutex    sync.Mutex
+	buckets  map[string]*bucket
+	counters map[string]*RateLimitCounter
+}
+
+// RateLimits of all routes, idle buckets are swept by Run
+var RateLimits = NewRateLimiter()
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: map[string]*bucket{}, counters: map[string]*RateLimitCounter{}}
+}
+
+// refill the bucket up to now
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*b.limit.Rate)
+	b.updated = now
+}
+
+// untilFull is the time the bucket takes to refill completely
+func (b *bucket) untilFull() time.Duration {
+	return time.Duration((float64(b.limit.Burst) - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// Allow takes a token from the bucket of a client on a route
+func (l *RateLimiter) Allow(route string, client string, limit config.RateLimit) RateLimitDecision {
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	key := route + "\x00" + client
+	b, ok := l.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{tokens: float64(limit.Burst), updated: now, limit: limit}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+
+	counter, ok := l.counters[route]
+	if !ok {
+		counter = &RateLimitCounter{Route: route}
+		l.counters[route] = counter
+	}
+
+	decision := RateLimitDecision{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+		counter.Allowed++
+	} else {
+		decision.RetryAfter = time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+		counter.Limited++
+	}
+	decision.Remaining = int(b.tokens)
+	decision.Reset = b.untilFull()
+	return decision
+}
+
+// Counters of all routes that saw requests, ordered by route
+func (l *RateLimiter) Counters() []RateLimitCounter {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	counters := make([]RateLimitCounter, 0, len(l.counters))
+	for _, counter := range l.counters {
+		counters = append(counters, *counter)
+	}
+	sort.Slice(counters, func(i, j int) bool { return counters[i].Route < counters[j].Route })
+	return counters
+}
+
+// Sweep removes the buckets that refilled completely, they are the same as new ones
+func (l *RateLimiter) Sweep() {
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
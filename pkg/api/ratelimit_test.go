@@ -0,0 +1,54 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limit := config.RateLimit{Rate: 2, Burst: 4}
+	// Allow runs a moment after the bucket was set up
+	const tolerance = 50 * time.Millisecond
+
+	tests := []struct {
+		name       string
+		tokens     float64
+		elapsed    time.Duration
+		limit      config.RateLimit
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+		reset      time.Duration
+	}{
+		{"full", 4, 0, limit, true, 3, 0, 500 * time.Millisecond},
+		{"empty", 0, 0, limit, false, 0, 500 * time.Millisecond, 2 * time.Second},
+		{"refilled one token", 0, 500 * time.Millisecond, limit, true, 0, 0, 2 * time.Second},
+		{"refilled half a token", 0, 250 * time.Millisecond, limit, false, 0, 250 * time.Millisecond, 1750 * time.Millisecond},
+		{"refill is capped by the burst", 1, 10 * time.Second, limit, true, 3, 0, 500 * time.Millisecond},
+		{"changed limit starts a full bucket", 0, 0, config.RateLimit{Rate: 1, Burst: 10}, true, 9, 0, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewRateLimiter()
+			limiter.buckets["route\x00client"] = &bucket{tokens: tt.tokens, updated: time.Now().Add(-tt.elapsed), limit: limit}
+
+			decision := limiter.Allow("route", "client", tt.limit)
+			if decision.Allowed != tt.allowed || decision.Remaining != tt.remaining || decision.Limit != tt.limit.Burst {
+				t.Errorf("Allow() = %+v, want allowed %v with %d of %d remaining", decision, tt.allowed, tt.remaining, tt.limit.Burst)
+			}
+			if d := decision.RetryAfter - tt.retryAfter; d > tolerance || d < -tolerance {
+				t.Errorf("Allow() retry after %s, want %s", decision.RetryAfter, tt.retryAfter)
+			}
+			if d := decision.Reset - tt.reset; d > tolerance || d < -tolerance {
+				t.Errorf("Allow() resets after %s, want %s", decision.Reset, tt.reset)
+			}
+
+			counters := limiter.Counters()
+			if len(counters) != 1 || (counters[0].Allowed == 1) != tt.allowed || counters[0].Allowed+counters[0].Limited != 1 {
+				t.Errorf("Counters() = %+v, want one request counted", counters)
+			}
+		})
+	}
+}
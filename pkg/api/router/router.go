@@ -11,13 +11,18 @@ import (
 	"gitlab.void-ptr.org/go/schism/pkg/api/handler"
 	"gitlab.void-ptr.org/go/schism/pkg/api/meta"
 	"gitlab.void-ptr.org/go/schism/pkg/api/middleware"
+	"gitlab.void-ptr.org/go/schism/pkg/business"
 	"gitlab.void-ptr.org/go/schism/pkg/db"
 	"gitlab.void-ptr.org/go/schism/pkg/util"
 )
 
 type routesMap struct {
-	Devices map[string][]string `json:"devices"`
-	Data    map[string][]string `json:"data"`
+	Devices    map[string][]string `json:"devices"`
+	Data       map[string][]string `json:"data"`
+	Groups     map[string][]string `json:"groups"`
+	Audit      map[string][]string `json:"audit"`
+	Users      map[string][]string `json:"users"`
+	RateLimits map[string][]string `json:"rate_limits"`
 }
 
 var routerMap = routesMap{}
@@ -27,13 +32,16 @@ func SchismRouter(sqlite *db.Sqlite, influxdb *db.Influx) *mux.Router {
 		util.Log.Fatalf("no database given for initialization")
 	}
 
-	api.ApiSecret = api.ReadSecret("schism.api.secret")
 	r := mux.NewRouter()
 
 	// Setup CORS
 	// IMPORTANT: you must specify an OPTIONS method matcher for the middleware to set CORS headers
 	r.Use(mux.CORSMethodMiddleware(r))
 
+	// Setup request ids, used by the audit trail
+	requestIdMiddleware := middleware.NewRequestIdMiddleware()
+	r.Use(requestIdMiddleware.Func())
+
 	// Setup request logging
 	logMiddleware := _middleware.NewLogMiddleware(util.Log)
 	r.Use(logMiddleware.Func())
@@ -43,35 +51,163 @@ func SchismRouter(sqlite *db.Sqlite, influxdb *db.Influx) *mux.Router {
 	// r.Use(timeOutMiddleware.Func())
 
 	// Create our middlewares
-	secretMiddleware := middleware.NewSecretMiddleware(api.ApiSecret)
+	secretMiddleware := middleware.NewSecretMiddleware(api.ApiKeys, sqlite)
 	authMiddleware := middleware.NewAuthMiddleware(sqlite)
+	signatureMiddleware := middleware.NewSignatureMiddleware(sqlite)
+	roleMiddleware := middleware.NewRoleMiddleware("", "")
+	adminRoleMiddleware := middleware.NewRoleMiddleware(business.RoleAdmin, "")
+	provisionRoleMiddleware := middleware.NewRoleMiddleware("", api.ApiKeyScopeProvision)
+	rateLimitMiddleware := middleware.NewRateLimitMiddleware(api.RateLimits)
+	ipRateLimitMiddleware := middleware.NewIpRateLimitMiddleware(api.RateLimits)
 
 	if api.Features.Devices.Enabled {
 		routerMap.Devices = map[string][]string{
-			"/devices":            {"POST"},
-			"/devices/{id}":       {"GET", "PATCH", "DELETE"},
-			"/devices/{id}/login": {"POST"},
+			"/devices":                                  {"GET", "POST"},
+			"/devices/{id}":                             {"GET", "PATCH", "DELETE"},
+			"/devices/{id}/login":                       {"POST"},
+			"/devices/{id}/token/refresh":               {"POST"},
+			"/devices/{id}/approve":                     {"POST"},
+			"/devices/{id}/disable":                     {"POST"},
+			"/devices/{id}/restore":                     {"POST"},
+			"/devices/{id}/shadow":                      {"GET", "PUT"},
+			"/devices/{id}/shadow/desired":              {"GET", "PUT"},
+			"/devices/{id}/commands":                    {"GET", "POST"},
+			"/devices/{id}/commands/pending":            {"GET"},
+			"/devices/{id}/commands/{commandId}/ack":    {"POST"},
+			"/devices/{id}/sensors":                     {"GET", "PUT"},
+			"/devices/{id}/tokens":                      {"GET"},
+			"/devices/{id}/tokens/{tokenId}":            {"DELETE"},
+			"/devices/{id}/tokens/revoke-others":        {"POST"},
+			"/devices/{id}/signing-key":                 {"GET", "POST", "DELETE"},
+			"/devices/{id}/token/jwt":                   {"POST"},
+			"/jwt/keys":                                 {"GET"},
+			"/jwt/keys/rotate":                          {"POST"},
+			"/jwt/revocations":                          {"GET", "POST"},
+			"/.well-known/jwks.json":                    {"GET"},
+			"/devices/{id}/calibrations":                {"GET", "POST"},
+			"/sensors":                                  {"GET"},
+			"/sensor-types":                             {"GET", "POST"},
+			"/sensor-types/{name}":                      {"GET", "PUT", "DELETE"},
+			"/devices/{id}/certificates":                {"GET", "POST"},
+			"/devices/{id}/certificates/{serial}":       {"DELETE"},
+			"/devices/{id}/certificates/{serial}/renew": {"POST"},
+			"/ca.pem":              {"GET"},
+			"/enrollments/{token}": {"GET", "POST"},
+			"/claims":              {"GET", "POST"},
+			"/grants":              {"GET", "POST"},
+			"/grants/{id}":         {"GET", "DELETE"},
 		}
-		deviceHandler := &handler.DeviceHandler{Database: sqlite}
+		deviceHandler := &handler.DeviceHandler{Database: sqlite, Influx: influxdb}
+		claimHandler := &handler.ClaimHandler{Database: sqlite}
+		shadowHandler := &handler.ShadowHandler{Database: sqlite}
+		commandHandler := &handler.CommandHandler{Database: sqlite}
+		sensorHandler := &handler.SensorHandler{Database: sqlite}
+		calibrationHandler := &handler.CalibrationHandler{Database: sqlite}
+		tokenHandler := &handler.TokenHandler{Database: sqlite}
+		signingKeyHandler := &handler.SigningKeyHandler{Database: sqlite}
+		jwtHandler := &handler.JwtHandler{Database: sqlite}
+		certificateHandler := &handler.CertificateHandler{Database: sqlite}
+		grantHandler := &handler.GrantHandler{Database: sqlite}
+		sensorTypeHandler := &handler.SensorTypeHandler{Database: sqlite}
+
+		// Published jwt keys, public without any secret
+		jwksRouter := r.NewRoute().Subrouter()
+
+		jwksRouter.Use(rateLimitMiddleware.Func())
+
+		jwksRouter.HandleFunc("/.well-known/jwks.json", jwtHandler.ReadJwks()).Methods("GET", "OPTIONS")
+		jwksRouter.HandleFunc("/ca.pem", certificateHandler.ReadCA()).Methods("GET", "OPTIONS")
 
 		// Public device route (POST)
 		publicDeviceRouter := r.NewRoute().Subrouter()
 
+		publicDeviceRouter.Use(ipRateLimitMiddleware.Func())
 		publicDeviceRouter.Use(secretMiddleware.Func())
+		publicDeviceRouter.Use(provisionRoleMiddleware.Func())
+		publicDeviceRouter.Use(rateLimitMiddleware.Func())
 
 		publicDeviceRouter.HandleFunc("/devices", deviceHandler.CreateDevice()).Methods("POST", "OPTIONS")
 		publicDeviceRouter.HandleFunc("/devices/{id}/login", deviceHandler.LoginDevice()).Methods("POST", "OPTIONS")
+		publicDeviceRouter.HandleFunc("/devices/{id}/token/refresh", deviceHandler.RefreshToken()).Methods("POST", "OPTIONS")
+		publicDeviceRouter.HandleFunc("/enrollments/{token}", deviceHandler.ReadEnrollment()).Methods("GET", "OPTIONS")
+		publicDeviceRouter.HandleFunc("/enrollments/{token}", deviceHandler.SubmitEnrollment()).Methods("POST", "OPTIONS")
+
+		// Admin device routes
+		adminDeviceRouter := r.NewRoute().Subrouter()
+
+		adminDeviceRouter.Use(ipRateLimitMiddleware.Func())
+		adminDeviceRouter.Use(secretMiddleware.Func())
+		adminDeviceRouter.Use(roleMiddleware.Func())
+		adminDeviceRouter.Use(rateLimitMiddleware.Func())
+
+		adminDeviceRouter.HandleFunc("/devices", deviceHandler.ListDevices()).Methods("GET", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/devices/{id}/approve", deviceHandler.ApproveDevice()).Methods("POST", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/devices/{id}/disable", deviceHandler.DisableDevice()).Methods("POST", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/devices/{id}/restore", deviceHandler.RestoreDevice()).Methods("POST", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/devices/{id}/shadow/desired", shadowHandler.ReadDesiredShadow()).Methods("GET", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/devices/{id}/shadow/desired", shadowHandler.UpdateDesiredShadow()).Methods("PUT", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/devices/{id}/commands", commandHandler.ListCommands()).Methods("GET", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/devices/{id}/commands", commandHandler.CreateCommand()).Methods("POST", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/devices/{id}/calibrations", calibrationHandler.ListCalibrations()).Methods("GET", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/devices/{id}/calibrations", calibrationHandler.CreateCalibration()).Methods("POST", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/sensors", sensorHandler.FindSensors()).Methods("GET", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/sensor-types", sensorTypeHandler.ListSensorTypes()).Methods("GET", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/sensor-types", sensorTypeHandler.CreateSensorType()).Methods("POST", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/sensor-types/{name}", sensorTypeHandler.ReadSensorType()).Methods("GET", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/sensor-types/{name}", sensorTypeHandler.UpdateSensorType()).Methods("PUT", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/sensor-types/{name}", sensorTypeHandler.DeleteSensorType()).Methods("DELETE", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/jwt/keys", jwtHandler.ListJwtKeys()).Methods("GET", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/jwt/keys/rotate", jwtHandler.RotateJwtKey()).Methods("POST", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/jwt/revocations", jwtHandler.ListJwtRevocations()).Methods("GET", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/jwt/revocations", jwtHandler.CreateJwtRevocation()).Methods("POST", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/claims", claimHandler.ListClaimCodes()).Methods("GET", "OPTIONS")
+		adminDeviceRouter.HandleFunc("/claims", claimHandler.CreateClaimCode()).Methods("POST", "OPTIONS")
+
+		// Admin grant routes, only admins share access to devices
+		adminGrantRouter := r.NewRoute().Subrouter()
+
+		adminGrantRouter.Use(ipRateLimitMiddleware.Func())
+		adminGrantRouter.Use(secretMiddleware.Func())
+		adminGrantRouter.Use(adminRoleMiddleware.Func())
+		adminGrantRouter.Use(rateLimitMiddleware.Func())
+
+		adminGrantRouter.HandleFunc("/grants", grantHandler.ListGrants()).Methods("GET", "OPTIONS")
+		adminGrantRouter.HandleFunc("/grants", grantHandler.CreateGrant()).Methods("POST", "OPTIONS")
+		adminGrantRouter.HandleFunc("/grants/{id}", grantHandler.ReadGrant()).Methods("GET", "OPTIONS")
+		adminGrantRouter.HandleFunc("/grants/{id}", grantHandler.DeleteGrant()).Methods("DELETE", "OPTIONS")
 
 		// Private device routes (GET, PATCH, DELETE)
 		privateDeviceRouter := r.NewRoute().Subrouter()
 
+		privateDeviceRouter.Use(ipRateLimitMiddleware.Func())
 		privateDeviceRouter.Use(secretMiddleware.Func())
 		privateDeviceRouter.Use(authMiddleware.Func())
+		privateDeviceRouter.Use(signatureMiddleware.Func())
+		privateDeviceRouter.Use(rateLimitMiddleware.Func())
 
-		privateDeviceRouter.HandleFunc("/devices/{id}", deviceHandler.ReadDevice()).Methods("GET", "OPTIONS")
-		privateDeviceRouter.HandleFunc("/devices/{id}", deviceHandler.UpdateDevice()).Methods("PATCH", "OPTIONS")
-		privateDeviceRouter.HandleFunc("/devices/{id}", deviceHandler.DeleteDevice()).Methods("DELETE", "OPTIONS")
-		publicDeviceRouter.HandleFunc("/devices/{id}/logout", deviceHandler.LogoutDevice()).Methods("POST", "OPTIONS")
+		// Authenticated routes declare the scopes they require, undeclared ones are rejected
+
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}", deviceHandler.ReadDevice()).Methods("GET", "OPTIONS"), business.ScopeDeviceRead)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}", deviceHandler.UpdateDevice()).Methods("PATCH", "OPTIONS"), business.ScopeDeviceWrite)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}", deviceHandler.DeleteDevice()).Methods("DELETE", "OPTIONS"), business.ScopeDeviceDelete)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/shadow", shadowHandler.ReadShadow()).Methods("GET", "OPTIONS"), business.ScopeDeviceRead)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/shadow", shadowHandler.ReportShadow()).Methods("PUT", "OPTIONS"), business.ScopeDeviceWrite)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/commands/pending", commandHandler.PendingCommands()).Methods("GET", "OPTIONS"), business.ScopeDeviceRead)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/commands/{commandId}/ack", commandHandler.AckCommand()).Methods("POST", "OPTIONS"), business.ScopeDeviceWrite)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/sensors", sensorHandler.ReadSensors()).Methods("GET", "OPTIONS"), business.ScopeDeviceRead)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/sensors", sensorHandler.UpdateSensors()).Methods("PUT", "OPTIONS"), business.ScopeDeviceWrite)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/tokens", tokenHandler.ListTokens()).Methods("GET", "OPTIONS"), business.ScopeDeviceRead)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/tokens/revoke-others", tokenHandler.RevokeOtherTokens()).Methods("POST", "OPTIONS"), business.ScopeDeviceWrite)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/tokens/{tokenId}", tokenHandler.RevokeToken()).Methods("DELETE", "OPTIONS"), business.ScopeDeviceWrite)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/signing-key", signingKeyHandler.ReadSigningKey()).Methods("GET", "OPTIONS"), business.ScopeDeviceRead)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/signing-key", signingKeyHandler.CreateSigningKey()).Methods("POST", "OPTIONS"), business.ScopeDeviceWrite)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/signing-key", signingKeyHandler.DeleteSigningKey()).Methods("DELETE", "OPTIONS"), business.ScopeDeviceWrite)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/token/jwt", jwtHandler.CreateJwt()).Methods("POST", "OPTIONS"))
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/certificates", certificateHandler.ListCertificates()).Methods("GET", "OPTIONS"), business.ScopeDeviceRead)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/certificates", certificateHandler.CreateCertificate()).Methods("POST", "OPTIONS"), business.ScopeDeviceWrite)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/certificates/{serial}", certificateHandler.RevokeCertificate()).Methods("DELETE", "OPTIONS"), business.ScopeDeviceWrite)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/certificates/{serial}/renew", certificateHandler.RenewCertificate()).Methods("POST", "OPTIONS"), business.ScopeDeviceWrite)
+		authMiddleware.Require(privateDeviceRouter.HandleFunc("/devices/{id}/logout", deviceHandler.LogoutDevice()).Methods("POST", "OPTIONS"))
 	}
 
 	if api.Features.Data.Enabled {
@@ -79,14 +215,133 @@ func SchismRouter(sqlite *db.Sqlite, influxdb *db.Influx) *mux.Router {
 			"/data":          {"POST"},
 			"/data/{source}": {"GET"},
 		}
-		dataHandler := &handler.DataHandler{Database: influxdb}
+		dataHandler := &handler.DataHandler{Database: influxdb, Sqlite: sqlite}
 		privateDataRouter := r.NewRoute().Subrouter()
 
+		privateDataRouter.Use(ipRateLimitMiddleware.Func())
 		privateDataRouter.Use(secretMiddleware.Func())
 		privateDataRouter.Use(authMiddleware.Func())
+		privateDataRouter.Use(signatureMiddleware.Func())
+		privateDataRouter.Use(rateLimitMiddleware.Func())
+
+		authMiddleware.Require(privateDataRouter.HandleFunc("/data", dataHandler.CreateData()).Methods("POST", "OPTIONS"), business.ScopeDataWrite)
+		authMiddleware.Require(privateDataRouter.HandleFunc("/data/{deviceId}/{source}", dataHandler.ReadData()).Methods("GET", "OPTIONS"), business.ScopeDataRead)
+	}
+
+	if api.Features.Groups.Enabled {
+		routerMap.Groups = map[string][]string{
+			"/sites":                         {"GET", "POST"},
+			"/sites/{id}":                    {"GET", "PATCH", "DELETE"},
+			"/sites/{id}/data/{source}":      {"GET"},
+			"/zones":                         {"GET", "POST"},
+			"/zones/{id}":                    {"GET", "PATCH", "DELETE"},
+			"/zones/{id}/data/{source}":      {"GET"},
+			"/zones/{id}/devices":            {"GET", "POST"},
+			"/zones/{id}/devices/{deviceId}": {"DELETE"},
+		}
+		groupHandler := &handler.GroupHandler{Database: sqlite}
+		dataHandler := &handler.DataHandler{Database: influxdb, Sqlite: sqlite}
+
+		// Admin group routes
+		adminGroupRouter := r.NewRoute().Subrouter()
+
+		adminGroupRouter.Use(ipRateLimitMiddleware.Func())
+		adminGroupRouter.Use(secretMiddleware.Func())
+		adminGroupRouter.Use(roleMiddleware.Func())
+		adminGroupRouter.Use(rateLimitMiddleware.Func())
+
+		adminGroupRouter.HandleFunc("/sites", groupHandler.ListSites()).Methods("GET", "OPTIONS")
+		adminGroupRouter.HandleFunc("/sites", groupHandler.CreateSite()).Methods("POST", "OPTIONS")
+		adminGroupRouter.HandleFunc("/sites/{id}", groupHandler.ReadSite()).Methods("GET", "OPTIONS")
+		adminGroupRouter.HandleFunc("/sites/{id}", groupHandler.UpdateSite()).Methods("PATCH", "OPTIONS")
+		adminGroupRouter.HandleFunc("/sites/{id}", groupHandler.DeleteSite()).Methods("DELETE", "OPTIONS")
+		adminGroupRouter.HandleFunc("/sites/{id}/data/{source}", dataHandler.ReadSiteData()).Methods("GET", "OPTIONS")
+		adminGroupRouter.HandleFunc("/zones", groupHandler.ListZones()).Methods("GET", "OPTIONS")
+		adminGroupRouter.HandleFunc("/zones", groupHandler.CreateZone()).Methods("POST", "OPTIONS")
+		adminGroupRouter.HandleFunc("/zones/{id}", groupHandler.ReadZone()).Methods("GET", "OPTIONS")
+		adminGroupRouter.HandleFunc("/zones/{id}", groupHandler.UpdateZone()).Methods("PATCH", "OPTIONS")
+		adminGroupRouter.HandleFunc("/zones/{id}", groupHandler.DeleteZone()).Methods("DELETE", "OPTIONS")
+		adminGroupRouter.HandleFunc("/zones/{id}/data/{source}", dataHandler.ReadZoneData()).Methods("GET", "OPTIONS")
+		adminGroupRouter.HandleFunc("/zones/{id}/devices", groupHandler.ListZoneDevices()).Methods("GET", "OPTIONS")
+		adminGroupRouter.HandleFunc("/zones/{id}/devices", groupHandler.AddZoneDevice()).Methods("POST", "OPTIONS")
+		adminGroupRouter.HandleFunc("/zones/{id}/devices/{deviceId}", groupHandler.RemoveZoneDevice()).Methods("DELETE", "OPTIONS")
+	}
+
+	routerMap.Audit = map[string][]string{
+		"/audit": {"GET"},
+	}
+	auditHandler := &handler.AuditHandler{Database: sqlite}
+
+	// Admin audit routes
+	adminAuditRouter := r.NewRoute().Subrouter()
+
+	adminAuditRouter.Use(ipRateLimitMiddleware.Func())
+	adminAuditRouter.Use(secretMiddleware.Func())
+	adminAuditRouter.Use(adminRoleMiddleware.Func())
+	adminAuditRouter.Use(rateLimitMiddleware.Func())
+
+	adminAuditRouter.HandleFunc("/audit", auditHandler.ListAudit()).Methods("GET", "OPTIONS")
+
+	routerMap.RateLimits = map[string][]string{
+		"/rate-limits":    {"GET"},
+		"/lockouts":       {"GET", "DELETE"},
+		"/lockouts/{key}": {"DELETE"},
+	}
+	rateLimitHandler := &handler.RateLimitHandler{Limiter: api.RateLimits, Lockouts: api.Lockouts}
+
+	// Admin rate limit and lockout routes
+	adminRateLimitRouter := r.NewRoute().Subrouter()
+
+	adminRateLimitRouter.Use(ipRateLimitMiddleware.Func())
+	adminRateLimitRouter.Use(secretMiddleware.Func())
+	adminRateLimitRouter.Use(adminRoleMiddleware.Func())
+	adminRateLimitRouter.Use(rateLimitMiddleware.Func())
+
+	adminRateLimitRouter.HandleFunc("/rate-limits", rateLimitHandler.ReadRateLimits()).Methods("GET", "OPTIONS")
+	adminRateLimitRouter.HandleFunc("/lockouts", rateLimitHandler.ListLockouts()).Methods("GET", "OPTIONS")
+	adminRateLimitRouter.HandleFunc("/lockouts", rateLimitHandler.ClearLockouts()).Methods("DELETE", "OPTIONS")
+	adminRateLimitRouter.HandleFunc("/lockouts/{key}", rateLimitHandler.ClearLockout()).Methods("DELETE", "OPTIONS")
+
+	if api.Features.Users.Enabled {
+		routerMap.Users = map[string][]string{
+			"/auth/login":  {"POST"},
+			"/auth/logout": {"POST"},
+			"/me":          {"GET"},
+			"/users":       {"GET", "POST"},
+			"/users/{id}":  {"GET", "PATCH", "DELETE"},
+		}
+		userHandler := &handler.UserHandler{Database: sqlite}
+
+		// Public login route, the password is the only credential
+		publicUserRouter := r.NewRoute().Subrouter()
+
+		publicUserRouter.Use(rateLimitMiddleware.Func())
+
+		publicUserRouter.HandleFunc("/auth/login", userHandler.Login()).Methods("POST", "OPTIONS")
+
+		// Session routes
+		sessionRouter := r.NewRoute().Subrouter()
+
+		sessionRouter.Use(ipRateLimitMiddleware.Func())
+		sessionRouter.Use(secretMiddleware.Func())
+		sessionRouter.Use(rateLimitMiddleware.Func())
+
+		sessionRouter.HandleFunc("/auth/logout", userHandler.Logout()).Methods("POST", "OPTIONS")
+		sessionRouter.HandleFunc("/me", userHandler.ReadMe()).Methods("GET", "OPTIONS")
+
+		// Admin user routes
+		adminUserRouter := r.NewRoute().Subrouter()
+
+		adminUserRouter.Use(ipRateLimitMiddleware.Func())
+		adminUserRouter.Use(secretMiddleware.Func())
+		adminUserRouter.Use(adminRoleMiddleware.Func())
+		adminUserRouter.Use(rateLimitMiddleware.Func())
 
-		privateDataRouter.HandleFunc("/data", dataHandler.CreateData()).Methods("POST", "OPTIONS")
-		privateDataRouter.HandleFunc("/data/{deviceId}/{source}", dataHandler.ReadData()).Methods("GET", "OPTIONS")
+		adminUserRouter.HandleFunc("/users", userHandler.ListUsers()).Methods("GET", "OPTIONS")
+		adminUserRouter.HandleFunc("/users", userHandler.CreateUser()).Methods("POST", "OPTIONS")
+		adminUserRouter.HandleFunc("/users/{id}", userHandler.ReadUser()).Methods("GET", "OPTIONS")
+		adminUserRouter.HandleFunc("/users/{id}", userHandler.UpdateUser()).Methods("PATCH", "OPTIONS")
+		adminUserRouter.HandleFunc("/users/{id}", userHandler.DeleteUser()).Methods("DELETE", "OPTIONS")
 	}
 
 	// Write out api infos
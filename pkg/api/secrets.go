@@ -6,10 +6,11 @@ import (
 	"gitlab.void-ptr.org/go/schism/pkg/util"
 )
 
-var ApiSecret string
+// secretsDir docker mounts the secrets in
+var secretsDir = "/run/secrets/"
 
 func ReadSecret(name string) string {
-	bytes, err := ioutil.ReadFile("/run/secrets/" + name)
+	bytes, err := ioutil.ReadFile(secretsDir + name)
 	if err != nil {
 		util.Log.Panic(err)
 	}
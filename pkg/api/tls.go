@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// tlsShutdownTimeout for open requests when the context is done
+const tlsShutdownTimeout = 5 * time.Second
+
+// ServeTLS serves the api with mutual tls until the context is done.
+// Client certificates are optional, devices without one keep using their tokens.
+func ServeTLS(ctx context.Context, address string, handler http.Handler, ca *business.DeviceCertificateAuthority, hosts []string) error {
+	cert, err := ca.ServerCertificate(hosts)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:    address,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{*cert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    ca.CertPool(),
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), tlsShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			util.Log.Error(err)
+		}
+	}()
+
+	util.Log.Infof("serving mutual tls on %s", address)
+	err = server.ListenAndServeTLS("", "")
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
@@ -1,18 +1,24 @@
 package business
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/google/uuid"
 	_business "gitlab.void-ptr.org/go/reflection/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/config"
 	"gitlab.void-ptr.org/go/schism/pkg/db"
 	"gitlab.void-ptr.org/go/schism/pkg/util"
 )
 
 const Table = "accesstokens"
 
+// ErrAccesstokenExpired is returned for known but expired accesstokens, they can still be refreshed
+var ErrAccesstokenExpired = errors.New("accesstoken has expired")
+
 type Accesstoken struct {
 	*_business.Accesstoken
 	Database  *db.Sqlite `json:"-"`
@@ -20,6 +26,22 @@ type Accesstoken struct {
 	DeviceId  string     `json:"device_id"`
 	CreatedAt time.Time  `json:"date_created"`
 	UpdatedAt time.Time  `json:"date_updated"`
+	ExpiresAt *time.Time `json:"date_expires"`
+	// RefreshToken rotates the accesstoken once, it is only handed out on creation
+	RefreshToken     *string    `json:"refresh_token,omitempty"`
+	RefreshExpiresAt *time.Time `json:"date_refresh_expires,omitempty"`
+	Scopes           []string   `json:"scopes"`
+	// Last use of the token, buffered by TokenUsage
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastIp     *string    `json:"last_ip"`
+	UserAgent  *string    `json:"user_agent"`
+	// Jwt is set for stateless jwts, they have no row in the database
+	Jwt bool `json:"-"`
+	// Certificate is set for devices authenticated by a client certificate, it has no row either
+	Certificate bool     `json:"-"`
+	Auditor     *Auditor `json:"-"`
+	// revocations of the jwts of evicted accesstokens, applied once the transaction is committed
+	revocations []*JwtRevocation
 }
 
 func NewAccesstoken(id *string, database *db.Sqlite) *Accesstoken {
@@ -28,25 +50,32 @@ func NewAccesstoken(id *string, database *db.Sqlite) *Accesstoken {
 
 // exists an accesstoken
 func (a *Accesstoken) exists() (bool, error) {
-	if a.Token == nil {
-		return false, fmt.Errorf("no accesstoken token given to read")
+	if a.Id == nil {
+		return false, fmt.Errorf("no accesstoken id given to read")
 	}
 
-	stmt, err := a.Database.Prepare(fmt.Sprintf("SELECT id from %s where token = ?", Table))
+	stmt, err := a.Database.Prepare(fmt.Sprintf("SELECT count(*) from %s where id = ?", Table))
 	if err != nil {
 		return false, err
 	}
 
-	row := stmt.QueryRow(*a.Token)
-	if err := row.Err(); err != nil {
+	var count int
+	err = stmt.QueryRow(*a.Id).Scan(&count)
+	if err != nil {
 		return false, err
 	}
 
-	return true, nil
+	return count > 0, nil
 }
 
 type AccesstokenCreate struct {
 	DeviceId string `json:"device_id"`
+	// Scopes the token is limited to, all scopes if empty
+	Scopes []string `json:"scopes"`
+}
+
+type AccesstokenRefresh struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
 // Create accesstoken
@@ -55,43 +84,225 @@ func (a *Accesstoken) Create(create *AccesstokenCreate) (*Accesstoken, int, erro
 		return nil, http.StatusBadRequest, fmt.Errorf("the accesstoken was already created with id '%s'", *a.Id)
 	}
 
-	u, err := uuid.NewUUID()
+	if err := validateScopes(create.Scopes); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	scopes := create.Scopes
+	if len(scopes) == 0 {
+		scopes = Scopes
+	}
+
+	tx, err := a.Database.Begin()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	status, err := a.create(tx, create.DeviceId, scopes)
+	if err != nil {
+		return nil, status, err
+	}
+	if err := tx.Commit(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	a.applyRevocations()
+	return a, http.StatusCreated, nil
+}
+
+// create an accesstoken within a transaction, audited and evicting the tokens beyond the cap
+func (a *Accesstoken) create(tx *sql.Tx, deviceId string, scopes []string) (int, error) {
+	status, err := a.insert(tx, deviceId, scopes)
+	if err != nil {
+		return status, err
+	}
+	err = a.Auditor.record(tx, AuditLogin, AuditResourceAccesstoken, *a.Id, a.DeviceId, nil, auditAccesstoken(a))
 	if err != nil {
 		util.Log.Error(err)
-		return nil, http.StatusInternalServerError, fmt.Errorf("uuid error")
+		return http.StatusInternalServerError, fmt.Errorf("database error")
 	}
+	if err := a.evict(tx); err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return http.StatusCreated, nil
+}
 
+// applyRevocations of the evicted accesstokens once the transaction creating the accesstoken is committed
+func (a *Accesstoken) applyRevocations() {
+	for _, revocation := range a.revocations {
+		JwtRevocations.apply(revocation)
+	}
+	a.revocations = nil
+}
+
+// evict the oldest accesstokens of the device beyond the configured cap, along with their jwts
+func (a *Accesstoken) evict(tx *sql.Tx) error {
+	if config.MaxAccesstokensPerDevice <= 0 {
+		return nil
+	}
+	rows, err := tx.Query(fmt.Sprintf("SELECT id FROM %s WHERE device_id = ? ORDER BY date_created DESC, id DESC LIMIT -1 OFFSET ?", Table),
+		a.DeviceId, config.MaxAccesstokensPerDevice)
+	if err != nil {
+		return err
+	}
+	evicted := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		evicted = append(evicted, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range evicted {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ?", Table), id); err != nil {
+			return err
+		}
+		err = a.Auditor.record(tx, AuditDelete, AuditResourceAccesstoken, id, a.DeviceId,
+			map[string]interface{}{"id": id, "device_id": a.DeviceId, "reason": "evicted"}, nil)
+		if err != nil {
+			return err
+		}
+		revocation, _, err := revokeAccesstokenJwts(tx, id, a.DeviceId, a.Auditor)
+		if err != nil {
+			return err
+		}
+		a.revocations = append(a.revocations, revocation)
+	}
+	if len(evicted) > 0 {
+		util.Log.Infof("evicted %d accesstokens of device %s", len(evicted), a.DeviceId)
+	}
+	return nil
+}
+
+// insert a new accesstoken with its refresh token, both expire after their configured lifetime
+func (a *Accesstoken) insert(p preparer, deviceId string, scopes []string) (int, error) {
+	u, err := uuid.NewUUID()
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("uuid error")
+	}
 	id := u.String()
-	a.Id = &id
 
-	// Generate new random accesstoken
+	// Generate new random accesstoken and refresh token
 	token, err := util.RandomHex(64)
 	if err != nil {
 		util.Log.Error(err)
-		return nil, http.StatusInternalServerError, fmt.Errorf("token error")
+		return http.StatusInternalServerError, fmt.Errorf("token error")
+	}
+	refreshToken, err := util.RandomHex(64)
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("token error")
 	}
 
 	tNow := time.Now()
 	now := tNow.UTC().Format(db.SqliteDateLayout)
+	expires := tNow.Add(config.AccesstokenTTL)
+	refreshExpires := tNow.Add(config.RefreshTokenTTL)
 
-	stmt, err := a.Database.Prepare(fmt.Sprintf("INSERT INTO %s (id, device_id, token, date_created, date_updated) VALUES (?, ?, ?, ? ,?)", Table))
+	// Only hashes are stored, the clear text token column is kept empty
+	stmt, err := p.Prepare(fmt.Sprintf(`INSERT INTO %s (id, device_id, token, token_prefix, token_hash, refresh_prefix, refresh_hash,
+		scopes, date_expires, date_refresh_expires, date_created, date_updated)
+		VALUES (?, ?, '', ?, ?, ?, ?, ?, ?, ?, ?, ?)`, Table))
 	if err != nil {
 		util.Log.Error(err)
-		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		return http.StatusInternalServerError, fmt.Errorf("database error")
 	}
 
-	_, err = stmt.Exec(a.Id, create.DeviceId, token, now, now)
+	_, err = stmt.Exec(id, deviceId, tokenPrefix(token), hashToken(token), tokenPrefix(refreshToken), hashToken(refreshToken),
+		encodeScopes(scopes), expires.UTC().Format(db.SqliteDateLayout), refreshExpires.UTC().Format(db.SqliteDateLayout), now, now)
 	if err != nil {
 		util.Log.Error(err)
-		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		return http.StatusInternalServerError, fmt.Errorf("database error")
 	}
 
-	a.DeviceId = create.DeviceId
+	a.Id = &id
+	a.DeviceId = deviceId
 	a.Token = &token
+	a.RefreshToken = &refreshToken
+	a.ExpiresAt = &expires
+	a.RefreshExpiresAt = &refreshExpires
+	a.Scopes = scopes
 	a.CreatedAt = tNow
 	a.UpdatedAt = tNow
+	return http.StatusCreated, nil
+}
 
-	return a, http.StatusCreated, nil
+// Refresh replaces the accesstoken of a refresh token with a new pair, the old pair stops working
+func (a *Accesstoken) Refresh(deviceId string, refresh *AccesstokenRefresh) (*Accesstoken, int, error) {
+	if len(refresh.RefreshToken) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("no refresh token given")
+	}
+
+	tx, err := a.Database.Begin()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	match, err := matchToken(tx, Table, "refresh", refresh.RefreshToken, "AND device_id = ?", deviceId)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if match == nil {
+		return nil, http.StatusUnauthorized, fmt.Errorf("refresh token does not exist")
+	}
+	id := *match
+
+	// The refreshed token keeps the scopes of the old one
+	var date_refresh_expires, scopes sql.NullString
+	err = tx.QueryRow(fmt.Sprintf("SELECT date_refresh_expires, scopes FROM %s WHERE id = ?", Table), id).Scan(&date_refresh_expires, &scopes)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if date_refresh_expires.Valid {
+		refreshExpires, err := time.Parse(db.SqliteDateLayout, date_refresh_expires.String)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+		}
+		if !time.Now().Before(refreshExpires) {
+			return nil, http.StatusUnauthorized, fmt.Errorf("refresh token has expired")
+		}
+	}
+
+	rows, err := execCount(tx, fmt.Sprintf("DELETE FROM %s WHERE id = ?", Table), id)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if rows != 1 {
+		return nil, http.StatusUnauthorized, fmt.Errorf("refresh token does not exist")
+	}
+
+	refreshed := NewAccesstoken(nil, a.Database)
+	refreshed.Auditor = a.Auditor
+	status, err := refreshed.insert(tx, deviceId, storedScopes(scopes))
+	if err != nil {
+		return nil, status, err
+	}
+	err = a.Auditor.record(tx, AuditUpdate, AuditResourceAccesstoken, *refreshed.Id, deviceId,
+		map[string]interface{}{"id": id}, auditAccesstoken(refreshed))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if err := tx.Commit(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return refreshed, http.StatusCreated, nil
 }
 
 // Authenticate accesstoken
@@ -99,22 +310,23 @@ func (a *Accesstoken) Authenticate(token string) (*Accesstoken, int, error) {
 	a = NewAccesstoken(nil, a.Database)
 	a.Token = &token
 
-	exists, err := a.exists()
+	match, err := matchToken(a.Database, Table, "token", token, "")
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
-	if !exists {
-		return a, http.StatusNotFound, fmt.Errorf("accesstoken with id '%s' does not exist", *a.Id)
+	if match == nil {
+		return a, http.StatusNotFound, fmt.Errorf("accesstoken does not exist")
 	}
 
-	stmt, err := a.Database.Prepare(fmt.Sprintf("SELECT id, device_id FROM %s WHERE token = ?", Table))
+	stmt, err := a.Database.Prepare(fmt.Sprintf("SELECT id, device_id, scopes, date_expires FROM %s WHERE id = ?", Table))
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
 	var id, deviceId string
-	err = stmt.QueryRow(*a.Token).Scan(&id, &deviceId)
+	var scopes, date_expires sql.NullString
+	err = stmt.QueryRow(*match).Scan(&id, &deviceId, &scopes, &date_expires)
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
@@ -122,31 +334,47 @@ func (a *Accesstoken) Authenticate(token string) (*Accesstoken, int, error) {
 
 	a.Id = &id
 	a.DeviceId = deviceId
+	a.Scopes = storedScopes(scopes)
+
+	// Tokens from before expiry was introduced have none until the next sweep
+	if date_expires.Valid {
+		expires, err := time.Parse(db.SqliteDateLayout, date_expires.String)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+		}
+		a.ExpiresAt = &expires
+		if !time.Now().Before(expires) {
+			return nil, http.StatusUnauthorized, ErrAccesstokenExpired
+		}
+	}
 
 	return a, http.StatusOK, nil
 }
 
-// Read accesstoken
+// Read accesstoken, the token itself is only known on creation
 func (a *Accesstoken) Read() (*Accesstoken, int, error) {
 	if a.Id == nil {
 		return nil, http.StatusBadRequest, fmt.Errorf("no accesstoken id given to read")
 	}
 
-	stmt, err := a.Database.Prepare(fmt.Sprintf("SELECT token, device_id FROM %s WHERE id = ?", Table))
+	stmt, err := a.Database.Prepare(fmt.Sprintf("SELECT device_id FROM %s WHERE id = ?", Table))
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
 
 	a = NewAccesstoken(a.Id, a.Database)
-	var token, deviceId string
-	err = stmt.QueryRow(*a.Id).Scan(&token, &deviceId)
-	if err != nil {
+	var deviceId string
+	err = stmt.QueryRow(*a.Id).Scan(&deviceId)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, http.StatusNotFound, fmt.Errorf("accesstoken with id '%s' does not exist", *a.Id)
+	case err != nil:
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
 
-	a.Token = &token
 	a.DeviceId = deviceId
 
 	return a, http.StatusOK, nil
@@ -167,23 +395,217 @@ func (a *Accesstoken) Delete() (*Accesstoken, int, error) {
 		return a, http.StatusNotFound, fmt.Errorf("accesstoken with id '%s' does not exist", *a.Id)
 	}
 
-	stmt, err := a.Database.Prepare(fmt.Sprintf("DELETE FROM %s WHERE id = ?", Table))
+	tx, err := a.Database.Begin()
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
-	result, err := stmt.Exec(*a.Id)
+	defer tx.Rollback()
+
+	rows, err := execCount(tx, fmt.Sprintf("DELETE FROM %s WHERE id = ?", Table), *a.Id)
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
-	rows, err := result.RowsAffected()
+	if rows != 1 {
+		return a, http.StatusNotFound, fmt.Errorf("accesstoken with id '%s' does not exist", *a.Id)
+	}
+	err = a.Auditor.record(tx, AuditLogout, AuditResourceAccesstoken, *a.Id, a.DeviceId, auditAccesstoken(a), nil)
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
-	if rows != 1 {
-		util.Log.Panicf("delete affected %d rows, only one expected", rows)
+	revocation, status, err := revokeAccesstokenJwts(tx, *a.Id, a.DeviceId, a.Auditor)
+	if err != nil {
+		return nil, status, err
+	}
+	if err := tx.Commit(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
+	JwtRevocations.apply(revocation)
 	return a, http.StatusOK, nil
 }
+
+// ListAccesstokens of a device, newest first and never the tokens themselves
+func ListAccesstokens(database *db.Sqlite, deviceId string) ([]*Accesstoken, int, error) {
+	device := NewDevice(&deviceId, database)
+	if _, status, err := device.Read(); err != nil {
+		return nil, status, err
+	}
+
+	stmt, err := database.Prepare(fmt.Sprintf(`SELECT id, scopes, date_expires, date_refresh_expires, last_used_at, last_ip, user_agent,
+		date_created, date_updated FROM %s WHERE device_id = ? ORDER BY date_created DESC`, Table))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	rows, err := stmt.Query(deviceId)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer rows.Close()
+
+	accesstokens := []*Accesstoken{}
+	for rows.Next() {
+		var id, date_created, date_updated string
+		var scopes, date_expires, date_refresh_expires, last_used_at, last_ip, user_agent sql.NullString
+		err = rows.Scan(&id, &scopes, &date_expires, &date_refresh_expires, &last_used_at, &last_ip, &user_agent, &date_created, &date_updated)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+
+		accesstoken := NewAccesstoken(&id, database)
+		accesstoken.DeviceId = deviceId
+		accesstoken.Scopes = storedScopes(scopes)
+		if last_ip.Valid {
+			accesstoken.LastIp = &last_ip.String
+		}
+		if user_agent.Valid {
+			accesstoken.UserAgent = &user_agent.String
+		}
+		for _, date := range []struct {
+			value  sql.NullString
+			target **time.Time
+		}{
+			{date_expires, &accesstoken.ExpiresAt},
+			{date_refresh_expires, &accesstoken.RefreshExpiresAt},
+			{last_used_at, &accesstoken.LastUsedAt},
+		} {
+			if !date.value.Valid {
+				continue
+			}
+			t, err := time.Parse(db.SqliteDateLayout, date.value.String)
+			if err != nil {
+				util.Log.Error(err)
+				return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+			}
+			*date.target = &t
+		}
+		accesstoken.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+		}
+		accesstoken.UpdatedAt, err = time.Parse(db.SqliteDateLayout, date_updated)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+		}
+
+		// Prefer the buffered usage which is not yet flushed
+		if used, ok := TokenUsage.get(id); ok {
+			usedAt := used.UsedAt
+			accesstoken.LastUsedAt = &usedAt
+			accesstoken.LastIp = &used.Ip
+			accesstoken.UserAgent = &used.UserAgent
+		}
+		accesstokens = append(accesstokens, accesstoken)
+	}
+	if err := rows.Err(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return accesstokens, http.StatusOK, nil
+}
+
+// RevokeOtherAccesstokens of a device except the one kept, returns the ids of the revoked ones
+func RevokeOtherAccesstokens(database *db.Sqlite, deviceId string, keepId string, auditor *Auditor) ([]string, int, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s WHERE id = ? AND device_id = ?", Table), keepId, deviceId).Scan(&count)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if count == 0 {
+		return nil, http.StatusNotFound, fmt.Errorf("accesstoken with id '%s' does not exist", keepId)
+	}
+
+	rows, err := tx.Query(fmt.Sprintf("SELECT id FROM %s WHERE device_id = ? AND id != ?", Table), deviceId, keepId)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	revoked := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		revoked = append(revoked, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	revocations := []*JwtRevocation{}
+	for _, id := range revoked {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ?", Table), id); err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		err = auditor.record(tx, AuditLogout, AuditResourceAccesstoken, id, deviceId, map[string]interface{}{"id": id, "device_id": deviceId}, nil)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		revocation, status, err := revokeAccesstokenJwts(tx, id, deviceId, auditor)
+		if err != nil {
+			return nil, status, err
+		}
+		revocations = append(revocations, revocation)
+	}
+	if err := tx.Commit(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	for _, revocation := range revocations {
+		JwtRevocations.apply(revocation)
+	}
+	return revoked, http.StatusOK, nil
+}
+
+// SweepExpiredAccesstokens removes accesstokens that can no longer be refreshed
+func SweepExpiredAccesstokens(database *db.Sqlite) {
+	tNow := time.Now()
+	now := tNow.UTC().Format(db.SqliteDateLayout)
+
+	// Tokens from before expiry was introduced get a full lifetime from now on
+	stmt, err := database.Prepare(fmt.Sprintf("UPDATE %s SET date_expires = ?, date_refresh_expires = ? WHERE date_expires IS NULL", Table))
+	if err != nil {
+		util.Log.Error(err)
+		return
+	}
+	_, err = stmt.Exec(tNow.Add(config.AccesstokenTTL).UTC().Format(db.SqliteDateLayout), tNow.Add(config.RefreshTokenTTL).UTC().Format(db.SqliteDateLayout))
+	if err != nil {
+		util.Log.Error(err)
+		return
+	}
+
+	stmt, err = database.Prepare(fmt.Sprintf("DELETE FROM %s WHERE date_refresh_expires <= ?", Table))
+	if err != nil {
+		util.Log.Error(err)
+		return
+	}
+	result, err := stmt.Exec(now)
+	if err != nil {
+		util.Log.Error(err)
+		return
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows > 0 {
+		util.Log.Infof("removed %d expired accesstokens", rows)
+	}
+}
@@ -0,0 +1,70 @@
+package business
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+func TestAccesstokenRefresh(t *testing.T) {
+	testPepper(t, "pepper")
+	database := testDatabase(t)
+	testDevice(t, database, "device", "")
+	testDevice(t, database, "other", "")
+
+	accesstoken, status, err := NewAccesstoken(nil, database).Create(&AccesstokenCreate{DeviceId: "device", Scopes: []string{ScopeDataWrite}})
+	if status != http.StatusCreated {
+		t.Fatalf("Create() = %d (%v), want %d", status, err, http.StatusCreated)
+	}
+	refresh := func(deviceId string, refreshToken string) (*Accesstoken, int, error) {
+		return NewAccesstoken(nil, database).Refresh(deviceId, &AccesstokenRefresh{RefreshToken: refreshToken})
+	}
+
+	if _, status, _ := refresh("other", *accesstoken.RefreshToken); status != http.StatusUnauthorized {
+		t.Errorf("Refresh() for another device = %d, want %d", status, http.StatusUnauthorized)
+	}
+	if _, status, _ := refresh("device", ""); status != http.StatusBadRequest {
+		t.Errorf("Refresh() without a refresh token = %d, want %d", status, http.StatusBadRequest)
+	}
+
+	refreshed, status, err := refresh("device", *accesstoken.RefreshToken)
+	if status != http.StatusCreated {
+		t.Fatalf("Refresh() = %d (%v), want %d", status, err, http.StatusCreated)
+	}
+	if *refreshed.Id == *accesstoken.Id || *refreshed.Token == *accesstoken.Token || *refreshed.RefreshToken == *accesstoken.RefreshToken {
+		t.Errorf("Refresh() = %+v, want a new accesstoken and refresh token", refreshed)
+	}
+	if !reflect.DeepEqual(refreshed.Scopes, accesstoken.Scopes) {
+		t.Errorf("Refresh() scopes = %v, want the ones of the old token %v", refreshed.Scopes, accesstoken.Scopes)
+	}
+
+	// The old token and refresh token are used up by the rotation
+	if _, status, _ := refresh("device", *accesstoken.RefreshToken); status != http.StatusUnauthorized {
+		t.Errorf("Refresh() with a rotated refresh token = %d, want %d", status, http.StatusUnauthorized)
+	}
+	if _, status, _ := NewAccesstoken(nil, database).Authenticate(*accesstoken.Token); status != http.StatusNotFound {
+		t.Errorf("Authenticate() with a rotated token = %d, want %d", status, http.StatusNotFound)
+	}
+	if _, status, err := NewAccesstoken(nil, database).Authenticate(*refreshed.Token); status != http.StatusOK {
+		t.Errorf("Authenticate() with the refreshed token = %d (%v), want %d", status, err, http.StatusOK)
+	}
+
+	past := time.Now().Add(-time.Minute).UTC().Format(db.SqliteDateLayout)
+	testExec(t, database, "UPDATE accesstokens SET date_expires = ? WHERE id = ?", past, *refreshed.Id)
+	if _, status, err := NewAccesstoken(nil, database).Authenticate(*refreshed.Token); err != ErrAccesstokenExpired {
+		t.Errorf("Authenticate() with an expired token = %d (%v), want %v", status, err, ErrAccesstokenExpired)
+	}
+	// An expired accesstoken can still be refreshed until its refresh token expires
+	again, status, err := refresh("device", *refreshed.RefreshToken)
+	if status != http.StatusCreated {
+		t.Fatalf("Refresh() of an expired accesstoken = %d (%v), want %d", status, err, http.StatusCreated)
+	}
+
+	testExec(t, database, "UPDATE accesstokens SET date_refresh_expires = ? WHERE id = ?", past, *again.Id)
+	if _, status, _ := refresh("device", *again.RefreshToken); status != http.StatusUnauthorized {
+		t.Errorf("Refresh() with an expired refresh token = %d, want %d", status, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,212 @@
+package business
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// Audited actions
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditLogin   = "login"
+	AuditLogout  = "logout"
+)
+
+// Audited resources
+const (
+	AuditResourceDevice      = "device"
+	AuditResourceAccesstoken = "accesstoken"
+	AuditResourceUser        = "user"
+	AuditResourceSession     = "session"
+	AuditResourceSigningKey  = "signing_key"
+	AuditResourceJwt         = "jwt"
+	AuditResourceJwtKey      = "jwt_key"
+	AuditResourceCertificate = "certificate"
+	AuditResourceGrant       = "grant"
+	AuditResourceSensorType  = "sensor_type"
+)
+
+// AuditActorSystem is recorded for changes without an auditor, e.g. by background jobs
+const AuditActorSystem = "system"
+
+// Auditor identifies who caused a change, it is attached to the entities of a request. A nil Auditor records
+// the change as AuditActorSystem, entities created without one act as the system.
+type Auditor struct {
+	Actor     string
+	RequestId string
+}
+
+// AuditEntry is a single, never changed record of a change
+type AuditEntry struct {
+	Id         int64           `json:"id"`
+	Actor      string          `json:"actor"`
+	RequestId  *string         `json:"request_id"`
+	Action     string          `json:"action"`
+	Resource   string          `json:"resource"`
+	ResourceId string          `json:"resource_id"`
+	DeviceId   string          `json:"device_id"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	CreatedAt  time.Time       `json:"date_created"`
+}
+
+type AuditList struct {
+	DeviceId string
+	Since    *time.Time
+	Limit    int
+}
+
+// AuditListDefaultLimit is used when no limit is given, AuditListMaxLimit caps any given limit
+const AuditListDefaultLimit = 100
+const AuditListMaxLimit = 1000
+
+// preparer is either the database or a transaction
+type preparer interface {
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// record appends an entry to the audit trail, inside a transaction it is written with the change
+func (a *Auditor) record(p preparer, action, resource, resourceId, deviceId string, before, after interface{}) error {
+	actor := AuditActorSystem
+	var requestId *string
+	if a != nil {
+		if len(a.Actor) > 0 {
+			actor = a.Actor
+		}
+		if len(a.RequestId) > 0 {
+			requestId = &a.RequestId
+		}
+	}
+
+	var beforeJson, afterJson *string
+	for _, v := range []struct {
+		value  interface{}
+		target **string
+	}{
+		{before, &beforeJson},
+		{after, &afterJson},
+	} {
+		if v.value == nil {
+			continue
+		}
+		b, err := json.Marshal(v.value)
+		if err != nil {
+			return err
+		}
+		s := string(b)
+		*v.target = &s
+	}
+
+	stmt, err := p.Prepare(`INSERT INTO audit (actor, request_id, action, resource, resource_id, device_id, before, after, date_created)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(actor, requestId, action, resource, resourceId, deviceId, beforeJson, afterJson,
+		time.Now().UTC().Format(db.SqliteDateLayout))
+	return err
+}
+
+// recordAfter audits a change that is already done, a failure is only logged
+func (a *Auditor) recordAfter(database *db.Sqlite, action, resource, resourceId, deviceId string, before, after interface{}) {
+	if err := a.record(database, action, resource, resourceId, deviceId, before, after); err != nil {
+		util.Log.Errorf("audit %s of %s %s failed: %s", action, resource, resourceId, err)
+	}
+}
+
+// auditDevice is the audited view of a device, without presence which changes all the time
+func auditDevice(d *Device) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        d.Name,
+		"mac_address": d.MacAddr,
+		"state":       d.State,
+		"labels":      d.Labels,
+	}
+}
+
+// auditAccesstoken is the audited view of an accesstoken, never the token itself
+func auditAccesstoken(a *Accesstoken) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        a.Id,
+		"device_id": a.DeviceId,
+		"scopes":    a.Scopes,
+	}
+}
+
+// ListAudit entries, oldest first
+func ListAudit(database *db.Sqlite, list *AuditList) ([]*AuditEntry, int, error) {
+	limit := list.Limit
+	if limit <= 0 {
+		limit = AuditListDefaultLimit
+	}
+	if limit > AuditListMaxLimit {
+		limit = AuditListMaxLimit
+	}
+
+	query := "SELECT id, actor, request_id, action, resource, resource_id, device_id, before, after, date_created FROM audit WHERE 1 = 1"
+	args := []interface{}{}
+	if len(list.DeviceId) > 0 {
+		query += " AND device_id = ?"
+		args = append(args, list.DeviceId)
+	}
+	if list.Since != nil {
+		query += " AND date_created >= ?"
+		args = append(args, list.Since.UTC().Format(db.SqliteDateLayout))
+	}
+	query += " ORDER BY id LIMIT ?"
+	args = append(args, limit)
+
+	stmt, err := database.Prepare(query)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		entry := &AuditEntry{}
+		var request_id, before, after sql.NullString
+		var date_created string
+		err = rows.Scan(&entry.Id, &entry.Actor, &request_id, &entry.Action, &entry.Resource, &entry.ResourceId,
+			&entry.DeviceId, &before, &after, &date_created)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		if request_id.Valid {
+			entry.RequestId = &request_id.String
+		}
+		if before.Valid {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			entry.After = json.RawMessage(after.String)
+		}
+		entry.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return entries, http.StatusOK, nil
+}
@@ -0,0 +1,210 @@
+package business
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// deviceCaTTL is the lifetime of the internal ca, devices have to trust a new one afterwards
+const deviceCaTTL = 10 * 365 * 24 * time.Hour
+
+// serverCertTTL is the lifetime of the tls server certificate, it is issued anew on every start
+const serverCertTTL = 365 * 24 * time.Hour
+
+// DeviceCertificateAuthority issues the client certificates of devices and the tls server certificate.
+// Like the jwt keys its private key is kept sealed in the database.
+type DeviceCertificateAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// CertPEM is handed out for devices to trust the tls server
+	CertPEM []byte
+}
+
+// DeviceCA of the api, loaded on startup
+var DeviceCA *DeviceCertificateAuthority
+
+// deviceCaKeyName the private key of the ca is sealed under
+const deviceCaKeyName = "device_ca"
+
+// LoadDeviceCA from the database, a new ca is created on first start.
+// A key stored in clear text by an older version is sealed on the way.
+func LoadDeviceCA(database *db.Sqlite) (*DeviceCertificateAuthority, error) {
+	stmt, err := database.Prepare("SELECT certificate, private_key FROM device_ca WHERE id = 1")
+	if err != nil {
+		return nil, err
+	}
+	var certPEM, storedKey string
+	err = stmt.QueryRow().Scan(&certPEM, &storedKey)
+	if err == sql.ErrNoRows {
+		return createDeviceCA(database)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !isSealed(storedKey) {
+		return sealDeviceCA(database, storedKey)
+	}
+	keyPEM, err := openPrivateKey(deviceCaKeyName, storedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := &DeviceCertificateAuthority{CertPEM: []byte(certPEM)}
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, fmt.Errorf("invalid device ca certificate")
+	}
+	ca.cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("invalid device ca key")
+	}
+	ca.key, err = x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(ca.cert.NotAfter) {
+		util.Log.Warningf("device ca expired on %s", ca.cert.NotAfter)
+	}
+	return ca, nil
+}
+
+func createDeviceCA(database *db.Sqlite) (*DeviceCertificateAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	tNow := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "schism device ca"},
+		NotBefore:             tNow.Add(-time.Minute),
+		NotAfter:              tNow.Add(deviceCaTTL),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	sealed, err := sealPrivateKey(deviceCaKeyName, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := database.Prepare("INSERT INTO device_ca (id, certificate, private_key, date_created) VALUES (1, ?, ?, ?)")
+	if err != nil {
+		return nil, err
+	}
+	_, err = stmt.Exec(string(certPEM), sealed, tNow.UTC().Format(db.SqliteDateLayout))
+	if err != nil {
+		return nil, err
+	}
+	util.Log.Infof("created device ca")
+	return LoadDeviceCA(database)
+}
+
+// sealDeviceCA replaces the clear text private key of the ca with the sealed one
+func sealDeviceCA(database *db.Sqlite, keyPEM string) (*DeviceCertificateAuthority, error) {
+	sealed, err := sealPrivateKey(deviceCaKeyName, []byte(keyPEM))
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := database.Prepare("UPDATE device_ca SET private_key = ? WHERE id = 1")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stmt.Exec(sealed); err != nil {
+		return nil, err
+	}
+	util.Log.Infof("sealed the clear text device ca key")
+	return LoadDeviceCA(database)
+}
+
+// randomSerial of 128 bits for certificates
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// issue a certificate signed by the ca
+func (ca *DeviceCertificateAuthority) issue(template *x509.Certificate, public crypto.PublicKey) (*x509.Certificate, []byte, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, public, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// CertPool trusting only the ca, used to verify client certificates
+func (ca *DeviceCertificateAuthority) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// ServerCertificate for the tls server, valid for the given host names and ips
+func (ca *DeviceCertificateAuthority) ServerCertificate(hosts []string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	tNow := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "schism"},
+		NotBefore:    tNow.Add(-time.Minute),
+		NotAfter:     tNow.Add(serverCertTTL),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	cert, _, err := ca.issue(template, &key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{cert.Raw, ca.cert.Raw}, PrivateKey: key, Leaf: cert}, nil
+}
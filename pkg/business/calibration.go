@@ -0,0 +1,264 @@
+package business
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// Calibration kinds, none ends the calibration of a field without losing its history
+const (
+	CalibrationNone      = "none"
+	CalibrationOffset    = "offset"
+	CalibrationLinear    = "linear"
+	CalibrationPiecewise = "piecewise"
+)
+
+// CalibrationPoint maps a raw reading to its true value in a piecewise-linear lookup table
+type CalibrationPoint struct {
+	Raw   float64 `json:"raw"`
+	Value float64 `json:"value"`
+}
+
+// Calibration corrects the readings of a single field of a device sensor, every change is a new version
+type Calibration struct {
+	Database  *db.Sqlite         `json:"-"`
+	Id        *string            `json:"id"`
+	DeviceId  string             `json:"device_id"`
+	Sensor    string             `json:"sensor"`
+	Field     string             `json:"field"`
+	Kind      string             `json:"kind"`
+	Offset    float64            `json:"offset"`
+	Gain      float64            `json:"gain"`
+	Points    []CalibrationPoint `json:"points"`
+	Version   int64              `json:"version"`
+	CreatedAt time.Time          `json:"date_created"`
+}
+
+type CalibrationCreate struct {
+	// Sensor is the sensor name of the payload, empty for payloads without one
+	Sensor string  `json:"sensor"`
+	Field  string  `json:"field"`
+	Kind   string  `json:"kind"`
+	Offset float64 `json:"offset"`
+	// Gain defaults to 1
+	Gain   *float64           `json:"gain"`
+	Points []CalibrationPoint `json:"points"`
+}
+
+func NewCalibration(id *string, deviceId string, database *db.Sqlite) *Calibration {
+	return &Calibration{Id: id, DeviceId: deviceId, Database: database}
+}
+
+const calibrationColumns = "id, device_id, sensor, field, kind, value_offset, gain, points, version, date_created"
+
+// Create a new version of the calibration of a sensor field
+func (c *Calibration) Create(create *CalibrationCreate) (*Calibration, int, error) {
+	if c.Id != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("the calibration was already created with id '%s'", *c.Id)
+	}
+	device := NewDevice(&c.DeviceId, c.Database)
+	if _, status, err := device.Read(); err != nil {
+		return nil, status, err
+	}
+
+	if len(create.Field) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("no field given to calibrate")
+	}
+	c.Sensor = create.Sensor
+	c.Field = create.Field
+	c.Kind = create.Kind
+	c.Gain = 1
+	c.Points = []CalibrationPoint{}
+	switch create.Kind {
+	case CalibrationNone:
+	case CalibrationOffset:
+		c.Offset = create.Offset
+	case CalibrationLinear:
+		c.Offset = create.Offset
+		if create.Gain != nil {
+			c.Gain = *create.Gain
+		}
+	case CalibrationPiecewise:
+		if len(create.Points) < 2 {
+			return nil, http.StatusBadRequest, fmt.Errorf("a piecewise calibration needs at least two points")
+		}
+		c.Points = append(c.Points, create.Points...)
+		sort.Slice(c.Points, func(i, j int) bool { return c.Points[i].Raw < c.Points[j].Raw })
+		for i := 1; i < len(c.Points); i++ {
+			if c.Points[i].Raw == c.Points[i-1].Raw {
+				return nil, http.StatusBadRequest, fmt.Errorf("duplicate raw value %v in calibration points", c.Points[i].Raw)
+			}
+		}
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid calibration kind '%s'", create.Kind)
+	}
+	points, err := json.Marshal(c.Points)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("marshal error")
+	}
+
+	u, err := uuid.NewUUID()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("uuid error")
+	}
+	id := u.String()
+
+	tx, err := c.Database.Begin()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	var version int64
+	err = tx.QueryRow("SELECT coalesce(max(version), 0) + 1 FROM calibrations WHERE device_id = ? AND sensor = ? AND field = ?",
+		c.DeviceId, c.Sensor, c.Field).Scan(&version)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	tNow := time.Now()
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO calibrations (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", calibrationColumns),
+		id, c.DeviceId, c.Sensor, c.Field, c.Kind, c.Offset, c.Gain, string(points), version, tNow.UTC().Format(db.SqliteDateLayout))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if err := tx.Commit(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	c.Id = &id
+	c.Version = version
+	c.CreatedAt = tNow
+	return c, http.StatusCreated, nil
+}
+
+// List the calibrations of a device, only the current version of each field unless history is requested
+func (c *Calibration) List(history bool) ([]*Calibration, int, error) {
+	device := NewDevice(&c.DeviceId, c.Database)
+	if _, status, err := device.Read(); err != nil {
+		return nil, status, err
+	}
+
+	var calibrations []*Calibration
+	var err error
+	if history {
+		calibrations, err = queryCalibrations(c.Database,
+			fmt.Sprintf("SELECT %s FROM calibrations WHERE device_id = ? ORDER BY sensor, field, version DESC", calibrationColumns), c.DeviceId)
+	} else {
+		calibrations, err = currentCalibrations(c.Database, c.DeviceId)
+	}
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return calibrations, http.StatusOK, nil
+}
+
+// Apply the calibration to a raw reading
+func (c *Calibration) Apply(raw float64) float64 {
+	switch c.Kind {
+	case CalibrationOffset:
+		return raw + c.Offset
+	case CalibrationLinear:
+		return raw*c.Gain + c.Offset
+	case CalibrationPiecewise:
+		// Interpolate within the table, extrapolate along the first or last segment outside of it
+		i := sort.Search(len(c.Points), func(i int) bool { return c.Points[i].Raw >= raw })
+		switch {
+		case i == 0:
+			i = 1
+		case i == len(c.Points):
+			i = len(c.Points) - 1
+		}
+		a, b := c.Points[i-1], c.Points[i]
+		return a.Value + (raw-a.Raw)*(b.Value-a.Value)/(b.Raw-a.Raw)
+	}
+	return raw
+}
+
+// currentCalibrations are the latest versions of every calibrated field of a device
+func currentCalibrations(database *db.Sqlite, deviceId string) ([]*Calibration, error) {
+	return queryCalibrations(database, fmt.Sprintf(`SELECT %s FROM calibrations c
+		WHERE device_id = ? AND version = (
+			SELECT max(version) FROM calibrations WHERE device_id = c.device_id AND sensor = c.sensor AND field = c.field
+		)
+		ORDER BY sensor, field`, calibrationColumns), deviceId)
+}
+
+// deviceCalibrations maps the active calibrations of a device by sensor and field
+func deviceCalibrations(database *db.Sqlite, deviceId string) (map[[2]string]*Calibration, error) {
+	calibrations, err := currentCalibrations(database, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	active := map[[2]string]*Calibration{}
+	for _, calibration := range calibrations {
+		if calibration.Kind != CalibrationNone {
+			active[[2]string{calibration.Sensor, calibration.Field}] = calibration
+		}
+	}
+	return active, nil
+}
+
+func queryCalibrations(database *db.Sqlite, query string, args ...interface{}) ([]*Calibration, error) {
+	stmt, err := database.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	calibrations := []*Calibration{}
+	for rows.Next() {
+		var id, points, date_created string
+		calibration := NewCalibration(&id, "", database)
+		err = rows.Scan(&id, &calibration.DeviceId, &calibration.Sensor, &calibration.Field, &calibration.Kind,
+			&calibration.Offset, &calibration.Gain, &points, &calibration.Version, &date_created)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(points), &calibration.Points); err != nil {
+			return nil, err
+		}
+		calibration.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
+		if err != nil {
+			return nil, err
+		}
+		calibrations = append(calibrations, calibration)
+	}
+	return calibrations, rows.Err()
+}
+
+// toFloat converts numeric sensor values, anything else can not be calibrated
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
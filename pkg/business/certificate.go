@@ -0,0 +1,337 @@
+package business
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// DeviceCertificate is a client certificate of a device, its subject common name is the device id
+type DeviceCertificate struct {
+	Database    *db.Sqlite `json:"-"`
+	Serial      *string    `json:"serial"`
+	DeviceId    string     `json:"device_id"`
+	Fingerprint string     `json:"fingerprint"`
+	// Certificate in PEM, only handed out on creation
+	Certificate *string `json:"certificate,omitempty"`
+	// Scopes of the credential the certificate was issued with, it never authenticates with more
+	Scopes    []string   `json:"scopes"`
+	NotAfter  time.Time  `json:"date_not_after"`
+	RevokedAt *time.Time `json:"date_revoked"`
+	CreatedAt time.Time  `json:"date_created"`
+	Auditor   *Auditor   `json:"-"`
+}
+
+// DeviceCertificateCreate carries the PEM encoded certificate signing request of the device
+type DeviceCertificateCreate struct {
+	Csr string `json:"csr"`
+}
+
+func NewDeviceCertificate(serial *string, deviceId string, database *db.Sqlite) *DeviceCertificate {
+	return &DeviceCertificate{Serial: serial, DeviceId: deviceId, Database: database}
+}
+
+// ParseCsr checks a certificate signing request, its subject is ignored as the device id is set by the ca
+func ParseCsr(create *DeviceCertificateCreate) (*x509.CertificateRequest, int, error) {
+	block, _ := pem.Decode([]byte(create.Csr))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, http.StatusBadRequest, fmt.Errorf("no PEM encoded certificate request given")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid certificate request: %s", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid certificate request signature")
+	}
+	return csr, http.StatusOK, nil
+}
+
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Create a certificate for the device from its signing request
+func (c *DeviceCertificate) Create(csr *x509.CertificateRequest) (*DeviceCertificate, int, error) {
+	if c.Serial != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("the certificate was already created with serial '%s'", *c.Serial)
+	}
+	device := NewDevice(&c.DeviceId, c.Database)
+	device, status, err := device.Read()
+	if err != nil {
+		return nil, status, err
+	}
+	if device.State != DeviceStateActive {
+		return nil, http.StatusForbidden, fmt.Errorf("device is %s", device.State)
+	}
+
+	tx, err := c.Database.Begin()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	status, err = c.create(tx, csr)
+	if err != nil {
+		return nil, status, err
+	}
+	if err := tx.Commit(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return c, http.StatusCreated, nil
+}
+
+// create issues and audits a certificate within a transaction, the device has to be checked before
+func (c *DeviceCertificate) create(tx *sql.Tx, csr *x509.CertificateRequest) (int, error) {
+	if DeviceCA == nil {
+		return http.StatusServiceUnavailable, fmt.Errorf("no device ca loaded")
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("certificate error")
+	}
+	tNow := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: c.DeviceId},
+		NotBefore:    tNow.Add(-time.Minute),
+		NotAfter:     tNow.Add(config.DeviceCertTTL),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, certPEM, err := DeviceCA.issue(template, csr.PublicKey)
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("certificate error")
+	}
+
+	if len(c.Scopes) == 0 {
+		c.Scopes = Scopes
+	}
+	serialHex := hex.EncodeToString(cert.SerialNumber.Bytes())
+	fingerprint := certificateFingerprint(cert)
+	stmt, err := tx.Prepare(`INSERT INTO device_certificates (serial, device_id, fingerprint, scopes, date_not_after, date_created)
+		VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	_, err = stmt.Exec(serialHex, c.DeviceId, fingerprint, encodeScopes(c.Scopes), cert.NotAfter.UTC().Format(db.SqliteDateLayout), tNow.UTC().Format(db.SqliteDateLayout))
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	pemString := string(certPEM)
+	c.Serial = &serialHex
+	c.Fingerprint = fingerprint
+	c.Certificate = &pemString
+	c.NotAfter = cert.NotAfter
+	c.CreatedAt = tNow
+	err = c.Auditor.record(tx, AuditCreate, AuditResourceCertificate, serialHex, c.DeviceId, nil, auditCertificate(c))
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return http.StatusCreated, nil
+}
+
+// auditCertificate is the audited view of a certificate
+func auditCertificate(c *DeviceCertificate) map[string]interface{} {
+	return map[string]interface{}{
+		"serial":         c.Serial,
+		"fingerprint":    c.Fingerprint,
+		"scopes":         c.Scopes,
+		"date_not_after": c.NotAfter,
+	}
+}
+
+const certificateColumns = "serial, device_id, fingerprint, scopes, date_not_after, date_revoked, date_created"
+
+func scanCertificate(row rowScanner, database *db.Sqlite) (*DeviceCertificate, error) {
+	var serial, date_not_after, date_created string
+	var scopes, date_revoked sql.NullString
+	c := NewDeviceCertificate(&serial, "", database)
+	err := row.Scan(&serial, &c.DeviceId, &c.Fingerprint, &scopes, &date_not_after, &date_revoked, &date_created)
+	if err != nil {
+		return nil, err
+	}
+	c.Scopes = storedScopes(scopes)
+	c.NotAfter, err = time.Parse(db.SqliteDateLayout, date_not_after)
+	if err != nil {
+		return nil, err
+	}
+	if date_revoked.Valid {
+		revokedAt, err := time.Parse(db.SqliteDateLayout, date_revoked.String)
+		if err != nil {
+			return nil, err
+		}
+		c.RevokedAt = &revokedAt
+	}
+	c.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Read a certificate of the device
+func (c *DeviceCertificate) Read() (*DeviceCertificate, int, error) {
+	if c.Serial == nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("no certificate serial given to read")
+	}
+	stmt, err := c.Database.Prepare(fmt.Sprintf("SELECT %s FROM device_certificates WHERE serial = ? AND device_id = ?", certificateColumns))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	cert, err := scanCertificate(stmt.QueryRow(*c.Serial, c.DeviceId), c.Database)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, http.StatusNotFound, fmt.Errorf("certificate with serial '%s' does not exist", *c.Serial)
+	case err != nil:
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	cert.Auditor = c.Auditor
+	return cert, http.StatusOK, nil
+}
+
+// List the certificates of the device, newest first
+func (c *DeviceCertificate) List() ([]*DeviceCertificate, int, error) {
+	device := NewDevice(&c.DeviceId, c.Database)
+	if _, status, err := device.Read(); err != nil {
+		return nil, status, err
+	}
+	stmt, err := c.Database.Prepare(fmt.Sprintf("SELECT %s FROM device_certificates WHERE device_id = ? ORDER BY date_created DESC", certificateColumns))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	rows, err := stmt.Query(c.DeviceId)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer rows.Close()
+
+	certificates := []*DeviceCertificate{}
+	for rows.Next() {
+		cert, err := scanCertificate(rows, c.Database)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		certificates = append(certificates, cert)
+	}
+	if err := rows.Err(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return certificates, http.StatusOK, nil
+}
+
+// Revoke a certificate, it is rejected from then on even though it is still signed by the ca
+func (c *DeviceCertificate) Revoke() (*DeviceCertificate, int, error) {
+	cert, status, err := c.Read()
+	if err != nil {
+		return nil, status, err
+	}
+	if cert.RevokedAt != nil {
+		return nil, http.StatusConflict, fmt.Errorf("certificate with serial '%s' is already revoked", *c.Serial)
+	}
+	stmt, err := c.Database.Prepare("UPDATE device_certificates SET date_revoked = ? WHERE serial = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	tNow := time.Now()
+	_, err = stmt.Exec(tNow.UTC().Format(db.SqliteDateLayout), *cert.Serial)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	cert.RevokedAt = &tNow
+	c.Auditor.recordAfter(c.Database, AuditDelete, AuditResourceCertificate, *cert.Serial, cert.DeviceId, auditCertificate(cert), nil)
+	return cert, http.StatusOK, nil
+}
+
+// Renew a certificate with a new signing request, the old certificate is revoked once the new one is issued.
+// The new one keeps the scopes of the old one, narrowed to the scopes of the credential renewing it.
+func (c *DeviceCertificate) Renew(csr *x509.CertificateRequest) (*DeviceCertificate, int, error) {
+	old, status, err := c.Read()
+	if err != nil {
+		return nil, status, err
+	}
+	if old.RevokedAt != nil {
+		return nil, http.StatusConflict, fmt.Errorf("certificate with serial '%s' is revoked", *c.Serial)
+	}
+	renewed := NewDeviceCertificate(nil, c.DeviceId, c.Database)
+	renewed.Auditor = c.Auditor
+	renewed.Scopes = []string{}
+	for _, scope := range old.Scopes {
+		if len(c.Scopes) == 0 || containsScope(c.Scopes, scope) {
+			renewed.Scopes = append(renewed.Scopes, scope)
+		}
+	}
+	if len(renewed.Scopes) == 0 {
+		return nil, http.StatusForbidden, fmt.Errorf("certificate can not be renewed without any of its scopes")
+	}
+	renewed, status, err = renewed.Create(csr)
+	if err != nil {
+		return nil, status, err
+	}
+	if _, status, err := c.Revoke(); err != nil {
+		return nil, status, err
+	}
+	return renewed, http.StatusCreated, nil
+}
+
+// AuthenticateCertificate maps a client certificate verified against the ca to its device
+func AuthenticateCertificate(database *db.Sqlite, cert *x509.Certificate) (*Accesstoken, int, error) {
+	serial := hex.EncodeToString(cert.SerialNumber.Bytes())
+	stmt, err := database.Prepare("SELECT device_id, fingerprint, scopes, date_revoked FROM device_certificates WHERE serial = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	var deviceId, fingerprint string
+	var scopes, date_revoked sql.NullString
+	err = stmt.QueryRow(serial).Scan(&deviceId, &fingerprint, &scopes, &date_revoked)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, http.StatusUnauthorized, fmt.Errorf("certificate does not exist")
+	case err != nil:
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if date_revoked.Valid {
+		return nil, http.StatusUnauthorized, fmt.Errorf("certificate has been revoked")
+	}
+	if fingerprint != certificateFingerprint(cert) || cert.Subject.CommonName != deviceId {
+		return nil, http.StatusUnauthorized, fmt.Errorf("certificate does not match")
+	}
+
+	// Certificates carry the scopes they were issued with, the device proves itself with its key
+	accesstoken := NewAccesstoken(&serial, database)
+	accesstoken.DeviceId = deviceId
+	accesstoken.Scopes = storedScopes(scopes)
+	notAfter := cert.NotAfter
+	accesstoken.ExpiresAt = &notAfter
+	accesstoken.Certificate = true
+	return accesstoken, http.StatusOK, nil
+}
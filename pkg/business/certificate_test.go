@@ -0,0 +1,105 @@
+package business
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// testCsr creates a signing request with a new key
+func testCsr(t *testing.T) *x509.CertificateRequest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+// testCertificate parses the certificate handed out on creation
+func testCertificate(t *testing.T, c *DeviceCertificate) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode([]byte(*c.Certificate))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestDeviceCertificateScopes(t *testing.T) {
+	testPepper(t, "pepper")
+	database := testDatabase(t)
+	previous := DeviceCA
+	t.Cleanup(func() { DeviceCA = previous })
+	var err error
+	DeviceCA, err = LoadDeviceCA(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDevice(t, database, "device", "")
+
+	tests := []struct {
+		name   string
+		scopes []string
+		want   []string
+	}{
+		{"issued by a user", nil, Scopes},
+		{"issued with a narrowed token", []string{ScopeDeviceWrite}, []string{ScopeDeviceWrite}},
+		{"issued with all scopes", Scopes, Scopes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certificate := NewDeviceCertificate(nil, "device", database)
+			certificate.Scopes = tt.scopes
+			certificate, status, err := certificate.Create(testCsr(t))
+			if status != http.StatusCreated {
+				t.Fatalf("Create() = %d (%v), want %d", status, err, http.StatusCreated)
+			}
+			accesstoken, status, err := AuthenticateCertificate(database, testCertificate(t, certificate))
+			if status != http.StatusOK {
+				t.Fatalf("AuthenticateCertificate() = %d (%v), want %d", status, err, http.StatusOK)
+			}
+			if !reflect.DeepEqual(accesstoken.Scopes, tt.want) {
+				t.Errorf("AuthenticateCertificate() scopes = %v, want %v", accesstoken.Scopes, tt.want)
+			}
+		})
+	}
+
+	t.Run("renewed with fewer scopes", func(t *testing.T) {
+		certificate := NewDeviceCertificate(nil, "device", database)
+		certificate.Scopes = []string{ScopeDataWrite, ScopeDeviceWrite}
+		certificate, status, err := certificate.Create(testCsr(t))
+		if status != http.StatusCreated {
+			t.Fatalf("Create() = %d (%v), want %d", status, err, http.StatusCreated)
+		}
+
+		renew := NewDeviceCertificate(certificate.Serial, "device", database)
+		renew.Scopes = []string{ScopeDeviceRead}
+		if _, status, _ := renew.Renew(testCsr(t)); status != http.StatusForbidden {
+			t.Errorf("Renew() without any of the scopes = %d, want %d", status, http.StatusForbidden)
+		}
+
+		renew.Scopes = []string{ScopeDeviceWrite, ScopeDeviceDelete}
+		renewed, status, err := renew.Renew(testCsr(t))
+		if status != http.StatusCreated {
+			t.Fatalf("Renew() = %d (%v), want %d", status, err, http.StatusCreated)
+		}
+		if want := []string{ScopeDeviceWrite}; !reflect.DeepEqual(renewed.Scopes, want) {
+			t.Errorf("Renew() scopes = %v, want %v", renewed.Scopes, want)
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package business
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// ClaimCode is a single use code minted by an admin that lets a new device enroll without approval
+type ClaimCode struct {
+	Database  *db.Sqlite `json:"-"`
+	Id        *string    `json:"id"`
+	Code      string     `json:"code"`
+	DeviceId  *string    `json:"device_id"`
+	ExpiresAt time.Time  `json:"date_expires"`
+	UsedAt    *time.Time `json:"date_used"`
+	CreatedAt time.Time  `json:"date_created"`
+}
+
+type ClaimCodeCreate struct {
+	// ExpiresIn is a duration like 24h, defaults to config.ClaimCodeTTL
+	ExpiresIn string `json:"expires_in"`
+}
+
+func NewClaimCode(id *string, database *db.Sqlite) *ClaimCode {
+	return &ClaimCode{Id: id, Database: database}
+}
+
+// Create claim code
+func (c *ClaimCode) Create(create *ClaimCodeCreate) (*ClaimCode, int, error) {
+	if c.Id != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("the claim code was already created with id '%s'", *c.Id)
+	}
+	ttl := config.ClaimCodeTTL
+	if len(create.ExpiresIn) > 0 {
+		d, err := time.ParseDuration(create.ExpiresIn)
+		if err != nil || d <= 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid expires_in '%s'", create.ExpiresIn)
+		}
+		ttl = d
+	}
+
+	u, err := uuid.NewUUID()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("uuid error")
+	}
+	id := u.String()
+	c.Id = &id
+
+	code, err := util.RandomHex(8)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("code error")
+	}
+
+	stmt, err := c.Database.Prepare("INSERT INTO claim_codes (id, code, date_expires, date_created) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	tNow := time.Now()
+	expires := tNow.Add(ttl)
+	_, err = stmt.Exec(c.Id, code, expires.UTC().Format(db.SqliteDateLayout), tNow.UTC().Format(db.SqliteDateLayout))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	c.Code = code
+	c.ExpiresAt = expires
+	c.CreatedAt = tNow
+
+	return c, http.StatusCreated, nil
+}
+
+// List claim codes, newest first
+func (c *ClaimCode) List() ([]*ClaimCode, int, error) {
+	stmt, err := c.Database.Prepare("SELECT id, code, device_id, date_expires, date_used, date_created FROM claim_codes ORDER BY date_created DESC")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer rows.Close()
+
+	codes := []*ClaimCode{}
+	for rows.Next() {
+		var id, code, date_expires, date_created string
+		var device_id, date_used sql.NullString
+		err = rows.Scan(&id, &code, &device_id, &date_expires, &date_used, &date_created)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+
+		claimCode := NewClaimCode(&id, c.Database)
+		claimCode.Code = code
+		if device_id.Valid {
+			claimCode.DeviceId = &device_id.String
+		}
+		claimCode.ExpiresAt, err = time.Parse(db.SqliteDateLayout, date_expires)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+		}
+		claimCode.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+		}
+		if date_used.Valid {
+			usedAt, err := time.Parse(db.SqliteDateLayout, date_used.String)
+			if err != nil {
+				util.Log.Error(err)
+				return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+			}
+			claimCode.UsedAt = &usedAt
+		}
+		codes = append(codes, claimCode)
+	}
+	if err := rows.Err(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return codes, http.StatusOK, nil
+}
+
+// redeemClaimCode marks an unused and unexpired code as used by a device
+func redeemClaimCode(tx *sql.Tx, code string, deviceId string) (int, error) {
+	stmt, err := tx.Prepare(`UPDATE claim_codes SET date_used = ?, device_id = ?
+		WHERE code = ? AND date_used IS NULL AND date_expires > ?`)
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	now := time.Now().UTC().Format(db.SqliteDateLayout)
+	result, err := stmt.Exec(now, deviceId, code, now)
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if rows != 1 {
+		return http.StatusForbidden, fmt.Errorf("claim code is invalid, expired or already used")
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,292 @@
+package business
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// Command states, a command moves from queued to delivered and ends as succeeded, failed or expired
+const (
+	CommandStateQueued    = "queued"
+	CommandStateDelivered = "delivered"
+	CommandStateSucceeded = "succeeded"
+	CommandStateFailed    = "failed"
+	CommandStateExpired   = "expired"
+)
+
+// Command sent from schism to a device, e.g. capture or servo.move
+type Command struct {
+	Database    *db.Sqlite      `json:"-"`
+	Id          *string         `json:"id"`
+	DeviceId    string          `json:"device_id"`
+	Name        string          `json:"name"`
+	Payload     json.RawMessage `json:"payload"`
+	State       string          `json:"state"`
+	Result      json.RawMessage `json:"result"`
+	ExpiresAt   time.Time       `json:"date_expires"`
+	CreatedAt   time.Time       `json:"date_created"`
+	DeliveredAt *time.Time      `json:"date_delivered"`
+	CompletedAt *time.Time      `json:"date_completed"`
+}
+
+type CommandCreate struct {
+	Name    string          `json:"name"`
+	Payload json.RawMessage `json:"payload"`
+	// ExpiresIn is a duration like 10m, defaults to config.CommandTTL
+	ExpiresIn string `json:"expires_in"`
+}
+
+type CommandAck struct {
+	State  string          `json:"state"`
+	Result json.RawMessage `json:"result"`
+}
+
+func NewCommand(id *string, deviceId string, database *db.Sqlite) *Command {
+	return &Command{Id: id, DeviceId: deviceId, Database: database}
+}
+
+// Create command, it is queued until the device fetches it
+func (c *Command) Create(create *CommandCreate) (*Command, int, error) {
+	if c.Id != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("the command was already created with id '%s'", *c.Id)
+	}
+	if len(create.Name) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("no command name given")
+	}
+	ttl := config.CommandTTL
+	if len(create.ExpiresIn) > 0 {
+		d, err := time.ParseDuration(create.ExpiresIn)
+		if err != nil || d <= 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid expires_in '%s'", create.ExpiresIn)
+		}
+		ttl = d
+	}
+	payload := create.Payload
+	if len(payload) == 0 {
+		payload = json.RawMessage("null")
+	}
+
+	device := NewDevice(&c.DeviceId, c.Database)
+	if _, status, err := device.Read(); err != nil {
+		return nil, status, err
+	}
+
+	u, err := uuid.NewUUID()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("uuid error")
+	}
+	id := u.String()
+	c.Id = &id
+
+	stmt, err := c.Database.Prepare(`INSERT INTO device_commands (id, device_id, name, payload, state, date_expires, date_created)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	tNow := time.Now()
+	expires := tNow.Add(ttl)
+	_, err = stmt.Exec(c.Id, c.DeviceId, create.Name, string(payload), CommandStateQueued,
+		expires.UTC().Format(db.SqliteDateLayout), tNow.UTC().Format(db.SqliteDateLayout))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	c.Name = create.Name
+	c.Payload = payload
+	c.State = CommandStateQueued
+	c.ExpiresAt = expires
+	c.CreatedAt = tNow
+
+	return c, http.StatusCreated, nil
+}
+
+// List the command history of the device, optionally only commands in a state
+func (c *Command) List(state string) ([]*Command, int, error) {
+	if status, err := c.expire(); err != nil {
+		return nil, status, err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM device_commands WHERE device_id = ?", commandColumns)
+	args := []interface{}{c.DeviceId}
+	if len(state) > 0 {
+		query += " AND state = ?"
+		args = append(args, state)
+	}
+	return c.query(query+" ORDER BY date_created DESC", args...)
+}
+
+// Pending commands are handed to the device and marked as delivered, unacknowledged ones are delivered again
+func (c *Command) Pending() ([]*Command, int, error) {
+	if status, err := c.expire(); err != nil {
+		return nil, status, err
+	}
+
+	commands, status, err := c.query(fmt.Sprintf("SELECT %s FROM device_commands WHERE device_id = ? AND state IN (?, ?) ORDER BY date_created",
+		commandColumns), c.DeviceId, CommandStateQueued, CommandStateDelivered)
+	if err != nil {
+		return nil, status, err
+	}
+
+	stmt, err := c.Database.Prepare("UPDATE device_commands SET state = ?, date_delivered = ? WHERE id = ? AND state = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	tNow := time.Now()
+	now := tNow.UTC().Format(db.SqliteDateLayout)
+	for _, command := range commands {
+		if command.State != CommandStateQueued {
+			continue
+		}
+		_, err = stmt.Exec(CommandStateDelivered, now, *command.Id, CommandStateQueued)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		command.State = CommandStateDelivered
+		command.DeliveredAt = &tNow
+	}
+	return commands, http.StatusOK, nil
+}
+
+// Ack completes a delivered command with the result of the device
+func (c *Command) Ack(ack *CommandAck) (*Command, int, error) {
+	if c.Id == nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("no command id given to acknowledge")
+	}
+	switch ack.State {
+	case CommandStateSucceeded, CommandStateFailed:
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("commands can only be acknowledged as %s or %s", CommandStateSucceeded, CommandStateFailed)
+	}
+	result := ack.Result
+	if len(result) == 0 {
+		result = json.RawMessage("null")
+	}
+	if status, err := c.expire(); err != nil {
+		return nil, status, err
+	}
+
+	stmt, err := c.Database.Prepare(`UPDATE device_commands SET state = ?, result = ?, date_completed = ?
+		WHERE id = ? AND device_id = ? AND state IN (?, ?)`)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	now := time.Now().UTC().Format(db.SqliteDateLayout)
+	res, err := stmt.Exec(ack.State, string(result), now, *c.Id, c.DeviceId, CommandStateQueued, CommandStateDelivered)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if rows != 1 {
+		return nil, http.StatusConflict, fmt.Errorf("command with id '%s' is unknown, expired or already acknowledged", *c.Id)
+	}
+
+	commands, status, err := c.query(fmt.Sprintf("SELECT %s FROM device_commands WHERE id = ?", commandColumns), *c.Id)
+	if err != nil {
+		return nil, status, err
+	}
+	return commands[0], http.StatusOK, nil
+}
+
+// expire all open commands of the device past their expiry
+func (c *Command) expire() (int, error) {
+	stmt, err := c.Database.Prepare("UPDATE device_commands SET state = ? WHERE device_id = ? AND state IN (?, ?) AND date_expires <= ?")
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	now := time.Now().UTC().Format(db.SqliteDateLayout)
+	_, err = stmt.Exec(CommandStateExpired, c.DeviceId, CommandStateQueued, CommandStateDelivered, now)
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return http.StatusOK, nil
+}
+
+const commandColumns = "id, device_id, name, payload, state, result, date_expires, date_created, date_delivered, date_completed"
+
+func (c *Command) query(query string, args ...interface{}) ([]*Command, int, error) {
+	stmt, err := c.Database.Prepare(query)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer rows.Close()
+
+	commands := []*Command{}
+	for rows.Next() {
+		var id, device_id, name, payload, state, date_expires, date_created string
+		var result, date_delivered, date_completed sql.NullString
+		err = rows.Scan(&id, &device_id, &name, &payload, &state, &result, &date_expires, &date_created, &date_delivered, &date_completed)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+
+		command := NewCommand(&id, device_id, c.Database)
+		command.Name = name
+		command.Payload = json.RawMessage(payload)
+		command.State = state
+		if result.Valid {
+			command.Result = json.RawMessage(result.String)
+		}
+		command.ExpiresAt, err = time.Parse(db.SqliteDateLayout, date_expires)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+		}
+		command.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+		}
+		for _, date := range []struct {
+			value  sql.NullString
+			target **time.Time
+		}{
+			{date_delivered, &command.DeliveredAt},
+			{date_completed, &command.CompletedAt},
+		} {
+			if !date.value.Valid {
+				continue
+			}
+			t, err := time.Parse(db.SqliteDateLayout, date.value.String)
+			if err != nil {
+				util.Log.Error(err)
+				return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+			}
+			*date.target = &t
+		}
+		commands = append(commands, command)
+	}
+	if err := rows.Err(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return commands, http.StatusOK, nil
+}
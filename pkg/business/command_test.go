@@ -0,0 +1,107 @@
+package business
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+func TestCommandStates(t *testing.T) {
+	database := testDatabase(t)
+	testDevice(t, database, "device", "")
+	testDevice(t, database, "other", "")
+
+	t.Run("invalid commands", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			deviceId string
+			create   *CommandCreate
+			want     int
+		}{
+			{"no name", "device", &CommandCreate{}, http.StatusBadRequest},
+			{"invalid expiry", "device", &CommandCreate{Name: "capture", ExpiresIn: "soon"}, http.StatusBadRequest},
+			{"negative expiry", "device", &CommandCreate{Name: "capture", ExpiresIn: "-1m"}, http.StatusBadRequest},
+			{"unknown device", "unknown", &CommandCreate{Name: "capture"}, http.StatusNotFound},
+		}
+		for _, tt := range tests {
+			if _, status, _ := NewCommand(nil, tt.deviceId, database).Create(tt.create); status != tt.want {
+				t.Errorf("Create() %s = %d, want %d", tt.name, status, tt.want)
+			}
+		}
+	})
+
+	create := func(t *testing.T, name string) *Command {
+		t.Helper()
+		command, status, err := NewCommand(nil, "device", database).Create(&CommandCreate{Name: name})
+		if status != http.StatusCreated || command.State != CommandStateQueued {
+			t.Fatalf("Create() = %d (%v), want a queued command", status, err)
+		}
+		return command
+	}
+	pending := func(t *testing.T, want int) []*Command {
+		t.Helper()
+		commands, status, err := NewCommand(nil, "device", database).Pending()
+		if status != http.StatusOK {
+			t.Fatalf("Pending() = %d (%v), want %d", status, err, http.StatusOK)
+		}
+		if len(commands) != want {
+			t.Fatalf("Pending() returned %d commands, want %d", len(commands), want)
+		}
+		for _, command := range commands {
+			if command.State != CommandStateDelivered || command.DeliveredAt == nil {
+				t.Errorf("Pending() returned %s in state %s, want it delivered", *command.Id, command.State)
+			}
+		}
+		return commands
+	}
+	ack := func(id *string, deviceId string, state string) (*Command, int) {
+		command, status, _ := NewCommand(id, deviceId, database).Ack(&CommandAck{State: state, Result: json.RawMessage(`{"ok":true}`)})
+		return command, status
+	}
+
+	capture := create(t, "capture")
+	move := create(t, "servo.move")
+	pending(t, 2)
+	// Unacknowledged commands are delivered again
+	pending(t, 2)
+
+	t.Run("acknowledged", func(t *testing.T) {
+		if _, status := ack(capture.Id, "device", CommandStateQueued); status != http.StatusBadRequest {
+			t.Errorf("Ack() as queued = %d, want %d", status, http.StatusBadRequest)
+		}
+		if _, status := ack(capture.Id, "other", CommandStateSucceeded); status != http.StatusConflict {
+			t.Errorf("Ack() by another device = %d, want %d", status, http.StatusConflict)
+		}
+		command, status := ack(capture.Id, "device", CommandStateSucceeded)
+		if status != http.StatusOK {
+			t.Fatalf("Ack() = %d, want %d", status, http.StatusOK)
+		}
+		if command.State != CommandStateSucceeded || command.CompletedAt == nil || string(command.Result) != `{"ok":true}` {
+			t.Errorf("Ack() = %+v, want it succeeded with the result", command)
+		}
+		if _, status := ack(capture.Id, "device", CommandStateFailed); status != http.StatusConflict {
+			t.Errorf("Ack() of an acknowledged command = %d, want %d", status, http.StatusConflict)
+		}
+		pending(t, 1)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		past := time.Now().Add(-time.Minute).UTC().Format(db.SqliteDateLayout)
+		testExec(t, database, "UPDATE device_commands SET date_expires = ? WHERE id = ?", past, *move.Id)
+		if _, status := ack(move.Id, "device", CommandStateSucceeded); status != http.StatusConflict {
+			t.Errorf("Ack() of an expired command = %d, want %d", status, http.StatusConflict)
+		}
+		pending(t, 0)
+
+		expired, status, err := NewCommand(nil, "device", database).List(CommandStateExpired)
+		if status != http.StatusOK {
+			t.Fatalf("List() = %d (%v), want %d", status, err, http.StatusOK)
+		}
+		if len(expired) != 1 || *expired[0].Id != *move.Id {
+			t.Errorf("List() of expired commands = %+v, want only %s", expired, *move.Id)
+		}
+	})
+}
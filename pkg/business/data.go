@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go"
@@ -22,10 +23,17 @@ type DataSupport struct {
 
 type Data struct {
 	Database *db.Influx `json:"-"`
+	Sqlite   *db.Sqlite `json:"-"`
 }
 
-func NewData(database *db.Influx) *Data {
-	return &Data{Database: database}
+// DataSelector reads the data of all devices in a site or zone instead of a single device
+type DataSelector struct {
+	SiteId *string
+	ZoneId *string
+}
+
+func NewData(database *db.Influx, sqlite *db.Sqlite) *Data {
+	return &Data{Database: database, Sqlite: sqlite}
 }
 
 func (d *Data) newSensorValuePoint(
@@ -33,17 +41,21 @@ func (d *Data) newSensorValuePoint(
 	sensorName *string,
 	sensorType *sensors.SensorType,
 	sensorValue sensors.SensorValue,
+	deviceTags map[string]string,
+	calibration *Calibration,
 	t time.Time,
 ) *write.Point {
-	// Influxdb tags
-	tags := map[string]string{
-		"deviceId": deviceId,
-		"source":   source,
-		"type":     _business.SensorValueType,
-		"name":     name,
-		"unit":     sensorValue.Unit,
-		"unitName": sensorValue.UnitName,
+	// Influxdb tags, device tags never override the builtin ones
+	tags := map[string]string{}
+	for k, v := range deviceTags {
+		tags[k] = v
 	}
+	tags["deviceId"] = deviceId
+	tags["source"] = source
+	tags["type"] = _business.SensorValueType
+	tags["name"] = name
+	tags["unit"] = sensorValue.Unit
+	tags["unitName"] = sensorValue.UnitName
 	if sensorType != nil {
 		tags["sensorType"] = fmt.Sprintf("%d", sensorType)
 	}
@@ -52,115 +64,138 @@ func (d *Data) newSensorValuePoint(
 	}
 	// Influxdb fields
 	fields := map[string]interface{}{"value": sensorValue.Value}
+	// Calibrated values keep the raw reading and the calibration version, so history can be recomputed
+	if calibration != nil {
+		if raw, ok := toFloat(sensorValue.Value); ok {
+			fields["value"] = calibration.Apply(raw)
+			fields["raw"] = raw
+			fields["calibrationVersion"] = calibration.Version
+		}
+	}
 	util.Log.Debugf("NewPoint@%s %s/%s - %s - %s", t.Local().Format("23:05:00.000"), deviceId+"/"+source, tags, fields)
 	return influxdb2.NewPoint(deviceId+"/"+source, tags, fields, t)
 }
 
-func (d *Data) parseSensorPayload(n *_business.Data, points []*write.Point) ([]*write.Point, int, error) {
-	switch *n.SensorType {
-	case sensors.SensorType_BMP:
-		var payload sensors.BMPSensorData
-		err := json.Unmarshal([]byte(n.Payload), &payload)
-		if err != nil {
-			util.Log.Error(err)
-			return nil, http.StatusInternalServerError, fmt.Errorf("unmarshal error")
-		}
-		for name, t := range map[string]sensors.SensorValue{
-			"temprature": *payload.Temprature,
-			"humidity":   *payload.Humidity,
-			"pressure":   *payload.Pressure,
-		} {
-			points = append(points, d.newSensorValuePoint(n.DeviceId, n.Source, name, &payload.Sensor.Name, n.SensorType, t, n.CreatedAt))
-		}
-	case sensors.SensorType_SI1145:
-		var payload sensors.SI1145SensorData
-		err := json.Unmarshal([]byte(n.Payload), &payload)
-		if err != nil {
-			util.Log.Error(err)
-			return nil, http.StatusInternalServerError, fmt.Errorf("unmarshal error")
-		}
-		for name, t := range map[string]sensors.SensorValue{
-			"infraRed":     *payload.InfraRed,
-			"ultraViolett": *payload.UltraViolett,
-			"visible":      *payload.Visible,
-		} {
-			points = append(points, d.newSensorValuePoint(n.DeviceId, n.Source, name, &payload.Sensor.Name, n.SensorType, t, n.CreatedAt))
-		}
-	case sensors.SensorType_NU40C16:
-		var payload sensors.NU40C16SensorData
-		err := json.Unmarshal([]byte(n.Payload), &payload)
-		if err != nil {
-			util.Log.Error(err)
-			return nil, http.StatusInternalServerError, fmt.Errorf("unmarshal error")
-		}
-		for name, t := range map[string]sensors.SensorValue{
-			"distance": *payload.Distance,
-		} {
-			points = append(points, d.newSensorValuePoint(n.DeviceId, n.Source, name, &payload.Sensor.Name, n.SensorType, t, n.CreatedAt))
-		}
-	case sensors.SensorType_SoilMoisture:
-		var payload sensors.SoilMoistureSensorData
-		err := json.Unmarshal([]byte(n.Payload), &payload)
-		if err != nil {
-			util.Log.Error(err)
-			return nil, http.StatusInternalServerError, fmt.Errorf("unmarshal error")
-		}
-		for name, t := range map[string]sensors.SensorValue{
-			"soilMoisture": *payload.SoilMoisture,
-		} {
-			points = append(points, d.newSensorValuePoint(n.DeviceId, n.Source, name, &payload.Sensor.Name, n.SensorType, t, n.CreatedAt))
-		}
-	case sensors.SensorType_AirQuality:
-		var payload sensors.AirQualitySensorData
-		err := json.Unmarshal([]byte(n.Payload), &payload)
-		if err != nil {
-			util.Log.Error(err)
-			return nil, http.StatusInternalServerError, fmt.Errorf("unmarshal error")
-		}
-		for name, t := range map[string]sensors.SensorValue{
-			"airQuality": *payload.AirQuality,
-		} {
-			points = append(points, d.newSensorValuePoint(n.DeviceId, n.Source, name, &payload.Sensor.Name, n.SensorType, t, n.CreatedAt))
-		}
-	case sensors.SensorType_Loudness:
-		var payload sensors.LoudnessSensorData
-		err := json.Unmarshal([]byte(n.Payload), &payload)
-		if err != nil {
-			util.Log.Error(err)
-			return nil, http.StatusInternalServerError, fmt.Errorf("unmarshal error")
-		}
-		for name, t := range map[string]sensors.SensorValue{
-			"loudness": *payload.Loudness,
-		} {
-			points = append(points, d.newSensorValuePoint(n.DeviceId, n.Source, name, &payload.Sensor.Name, n.SensorType, t, n.CreatedAt))
-		}
+// deviceTags are written with every point of a device: its zone, site and allowed labels
+func (d *Data) deviceTags(deviceId string) (map[string]string, error) {
+	tags, err := deviceLabelTags(d.Sqlite, deviceId)
+	if err != nil {
+		return nil, err
 	}
-	return points, http.StatusCreated, nil
+	groupTags, err := deviceGroupTags(d.Sqlite, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range groupTags {
+		tags[k] = v
+	}
+	return tags, nil
 }
 
-func (d *Data) parseGenericPayload(n *_business.Data, points []*write.Point) ([]*write.Point, int, error) {
-	var payload map[string]sensors.SensorValue
+// sensorTypeOf a payload, builtin types by their number and custom ones by the type named in sensor.type
+func (d *Data) sensorTypeOf(n *_business.Data, registry *sensorTypeRegistry) *SensorTypeDefinition {
+	if n.SensorType != nil {
+		return registry.byType[*n.SensorType]
+	}
+	var payload struct {
+		Sensor struct {
+			Type string `json:"type"`
+		} `json:"sensor"`
+	}
+	// Payloads that are no objects fail in the generic decoding
+	if json.Unmarshal([]byte(n.Payload), &payload) != nil || len(payload.Sensor.Type) == 0 {
+		return nil
+	}
+	return registry.byName[payload.Sensor.Type]
+}
+
+// decodeGenericPayload decodes a payload without sensor type, every key but the sensor is a value
+func (d *Data) decodeGenericPayload(n *_business.Data) (*string, map[string]sensors.SensorValue, int, error) {
+	var payload map[string]json.RawMessage
 	err := json.Unmarshal([]byte(n.Payload), &payload)
 	if err != nil {
 		util.Log.Error(err)
-		return nil, http.StatusInternalServerError, fmt.Errorf("unmarshal error")
+		return nil, nil, http.StatusInternalServerError, fmt.Errorf("unmarshal error")
 	}
-	for name, val := range payload {
+	var sensorName *string
+	values := map[string]sensors.SensorValue{}
+	for name, raw := range payload {
 		if name == "sensor" {
+			var sensor sensors.Sensor
+			if json.Unmarshal(raw, &sensor) == nil && sensor.Name != "" {
+				sensorName = &sensor.Name
+			}
 			continue
 		}
-		points = append(points, d.newSensorValuePoint(n.DeviceId, n.Source, name, nil, nil, val, n.CreatedAt))
+		var val sensors.SensorValue
+		err = json.Unmarshal(raw, &val)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, nil, http.StatusInternalServerError, fmt.Errorf("unmarshal error")
+		}
+		values[name] = val
 	}
-	return points, http.StatusCreated, nil
+	return sensorName, values, http.StatusCreated, nil
+}
+
+// DataCreateResponse additionally reports payloads of sensors missing in the device inventory
+type DataCreateResponse struct {
+	*_business.DataCreateResponse
+	Undeclared []*UndeclaredSensor `json:"undeclared,omitempty"`
+}
+
+// UndeclaredSensor is a sensor a device sent data for without declaring it
+type UndeclaredSensor struct {
+	DeviceId   string              `json:"device_id"`
+	Source     string              `json:"source"`
+	Name       *string             `json:"name"`
+	SensorType *sensors.SensorType `json:"sensor_type"`
 }
 
-func (d *Data) Create(createData _business.DataCreate) (*_business.DataCreateResponse, int, error) {
+// Create writes the data sent by a device, only the sending device is marked as seen
+func (d *Data) Create(deviceId string, createData _business.DataCreate) (*DataCreateResponse, int, error) {
 	var status = http.StatusInternalServerError
 	var points []*write.Point
 	var err error
-	response := &_business.DataCreateResponse{}
+	response := &DataCreateResponse{DataCreateResponse: &_business.DataCreateResponse{}}
+	tagsByDevice := map[string]map[string]string{}
+	declaredByDevice := map[string]map[string]*sensors.SensorType{}
+	calibrationsByDevice := map[string]map[[2]string]*Calibration{}
+	registry, err := sensorTypes.get(d.Sqlite)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
 
 	for _, create := range createData.Data {
+		deviceTags, ok := tagsByDevice[create.DeviceId]
+		if !ok {
+			deviceTags, err = d.deviceTags(create.DeviceId)
+			if err != nil {
+				util.Log.Error(err)
+				return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+			}
+			tagsByDevice[create.DeviceId] = deviceTags
+		}
+		declared, ok := declaredByDevice[create.DeviceId]
+		if !ok {
+			declared, err = declaredSensors(d.Sqlite, create.DeviceId)
+			if err != nil {
+				util.Log.Error(err)
+				return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+			}
+			declaredByDevice[create.DeviceId] = declared
+		}
+		calibrations, ok := calibrationsByDevice[create.DeviceId]
+		if !ok {
+			calibrations, err = deviceCalibrations(d.Sqlite, create.DeviceId)
+			if err != nil {
+				util.Log.Error(err)
+				return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+			}
+			calibrationsByDevice[create.DeviceId] = calibrations
+		}
+
 		n := _business.NewData()
 		n.DeviceId = create.DeviceId
 		n.Source = create.Source
@@ -171,24 +206,64 @@ func (d *Data) Create(createData _business.DataCreate) (*_business.DataCreateRes
 		n.UpdatedAt = time.Now()
 		response.Data = append(response.Data, n)
 
+		var sensorName *string
+		var values map[string]sensors.SensorValue
+		var definition *SensorTypeDefinition
 		switch create.DataType {
 		case _business.SensorValue:
-			if n.SensorType != nil {
-				points, status, err = d.parseSensorPayload(n, points)
-				if err != nil {
-					util.Log.Error(err)
-					return nil, status, err
-				}
-			} else {
-				points, status, err = d.parseGenericPayload(n, points)
-				if err != nil {
-					util.Log.Error(err)
-					return nil, status, err
-				}
+			definition = d.sensorTypeOf(n, registry)
+			switch {
+			case definition != nil:
+				sensorName, values, status, err = definition.Decode(n.Payload)
+			case n.SensorType != nil:
+				// Unknown sensor types of newer devices are accepted without values
+				util.Log.Warningf("device '%s' sent data of unknown sensor type %d", n.DeviceId, *n.SensorType)
+				status = http.StatusCreated
+			default:
+				sensorName, values, status, err = d.decodeGenericPayload(n)
+			}
+			if err != nil {
+				util.Log.Error(err)
+				return nil, status, err
 			}
 		default:
 			return nil, http.StatusBadRequest, fmt.Errorf("unsupported data_type provided")
 		}
+
+		// Undeclared sensors are still written, but tagged so they can be told apart
+		tags := deviceTags
+		if !isDeclared(declared, sensorName, n.SensorType) {
+			name := "<unnamed>"
+			if sensorName != nil {
+				name = *sensorName
+			}
+			util.Log.Warningf("device '%s' sent data of undeclared sensor '%s' on source '%s'", n.DeviceId, name, n.Source)
+			response.Undeclared = append(response.Undeclared, &UndeclaredSensor{
+				DeviceId: n.DeviceId, Source: n.Source, Name: sensorName, SensorType: n.SensorType,
+			})
+			tags = map[string]string{}
+			for k, v := range deviceTags {
+				tags[k] = v
+			}
+			tags["undeclared"] = "true"
+		}
+		// Builtin types keep the series of older versions, only custom types are tagged with their name
+		if definition != nil && !definition.Builtin {
+			typed := map[string]string{}
+			for k, v := range tags {
+				typed[k] = v
+			}
+			typed["sensorTypeName"] = definition.Name
+			tags = typed
+		}
+		calibrationSensor := ""
+		if sensorName != nil {
+			calibrationSensor = *sensorName
+		}
+		for name, value := range values {
+			calibration := calibrations[[2]string{calibrationSensor, name}]
+			points = append(points, d.newSensorValuePoint(n.DeviceId, n.Source, name, sensorName, n.SensorType, value, tags, calibration, n.CreatedAt))
+		}
 	}
 
 	health, err := d.Database.Client.Health(context.TODO())
@@ -202,11 +277,40 @@ func (d *Data) Create(createData _business.DataCreate) (*_business.DataCreateRes
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
+	for _, create := range createData.Data {
+		Presence.Seen(deviceId, create.Source)
+	}
 
 	return response, status, nil
 }
 
-func (d *Data) Read(read *_business.DataRead) (*_business.DataReadResponse, int, error) {
+// selectDevices resolves the devices of a data selector, without one the device of the read is used
+func (d *Data) selectDevices(read *_business.DataRead, selector *DataSelector) ([]string, int, error) {
+	switch {
+	case selector == nil:
+		return []string{read.DeviceId}, http.StatusOK, nil
+	case selector.ZoneId != nil:
+		zone, status, err := NewZone(selector.ZoneId, d.Sqlite).Read()
+		if err != nil {
+			return nil, status, err
+		}
+		return zone.DeviceIds()
+	case selector.SiteId != nil:
+		site, status, err := NewSite(selector.SiteId, d.Sqlite).Read()
+		if err != nil {
+			return nil, status, err
+		}
+		return site.DeviceIds()
+	}
+	return nil, http.StatusBadRequest, fmt.Errorf("no site or zone given to read")
+}
+
+// fluxString quotes a value for use in a flux query
+func fluxString(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+func (d *Data) Read(read *_business.DataRead, selector *DataSelector) (*_business.DataReadResponse, int, error) {
 	queryRange := "range(start: -1h)"
 	if len(read.Start) > 0 {
 		queryRange = fmt.Sprintf("range(start: %s)", read.Start)
@@ -214,8 +318,18 @@ func (d *Data) Read(read *_business.DataRead) (*_business.DataReadResponse, int,
 	if len(read.Start) > 0 && len(read.Stop) > 0 {
 		queryRange = fmt.Sprintf("range(start: %s, stop: %s)", read.Start, read.Stop)
 	}
-	measurement := read.DeviceId + "/" + read.Source
-	filter := fmt.Sprintf(`filter(fn: (r) => r._measurement == "%s")`, measurement)
+	deviceIds, status, err := d.selectDevices(read, selector)
+	if err != nil {
+		return nil, status, err
+	}
+	if len(deviceIds) == 0 {
+		return &_business.DataReadResponse{}, http.StatusOK, nil
+	}
+	measurements := []string{}
+	for _, deviceId := range deviceIds {
+		measurements = append(measurements, "r._measurement == "+fluxString(deviceId+"/"+read.Source))
+	}
+	filter := fmt.Sprintf(`filter(fn: (r) => %s)`, strings.Join(measurements, " or "))
 	// Get parser flux query result
 	result, err := d.Database.Query.Query(
 		context.Background(),
@@ -266,3 +380,46 @@ func (d *Data) Read(read *_business.DataRead) (*_business.DataReadResponse, int,
 	}
 	return &res, http.StatusOK, nil
 }
+
+// Purge deletes all measurements of a device and returns their names
+func (d *Data) Purge(deviceId string) ([]string, int, error) {
+	result, err := d.Database.Query.Query(
+		context.Background(),
+		fmt.Sprintf(`import "influxdata/influxdb/schema"
+			import "strings"
+			schema.measurements(bucket: %s, start: 0)
+			|> filter(fn: (r) => strings.hasPrefix(v: r._value, prefix: %s))`,
+			fluxString(d.Database.Bucket),
+			fluxString(deviceId+"/")),
+	)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	measurements := []string{}
+	for result.Next() {
+		if measurement, ok := result.Record().Value().(string); ok {
+			measurements = append(measurements, measurement)
+		}
+	}
+	if result.Err() != nil {
+		util.Log.Error(result.Err())
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	for _, measurement := range measurements {
+		err = d.Database.Delete.DeleteWithName(
+			context.Background(),
+			d.Database.Org,
+			d.Database.Bucket,
+			time.Unix(0, 0),
+			time.Now(),
+			"_measurement="+fluxString(measurement),
+		)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+	}
+	return measurements, http.StatusOK, nil
+}
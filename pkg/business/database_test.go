@@ -0,0 +1,40 @@
+package business
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+// testDatabase creates a database with the full schema in a temporary directory
+func testDatabase(t *testing.T) *db.Sqlite {
+	t.Helper()
+	database := db.NewSqliteAt(filepath.Join(t.TempDir(), "schism.sqlite"))
+	if err := database.Create(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.Close)
+	return database
+}
+
+// testExec runs a statement on the test database
+func testExec(t *testing.T, database *db.Sqlite, query string, args ...interface{}) {
+	t.Helper()
+	stmt, err := database.Prepare(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stmt.Exec(args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testDevice inserts an active device without going through registration
+func testDevice(t *testing.T, database *db.Sqlite, id string, macAddress string) {
+	t.Helper()
+	now := time.Now().UTC().Format(db.SqliteDateLayout)
+	testExec(t, database, "INSERT INTO devices (id, name, mac_address, date_created, date_updated) VALUES (?, ?, ?, ?, ?)",
+		id, "device "+id, macAddress, now, now)
+}
@@ -0,0 +1,340 @@
+package business
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+type DeviceDelete struct {
+	// Purge all influx measurements of the device
+	Purge bool
+	// Soft deletes keep the device restorable for config.DeviceDeleteGrace
+	Soft bool
+}
+
+// DeviceDeleteSummary lists what was removed along with the device
+type DeviceDeleteSummary struct {
+	Device             *Device    `json:"device"`
+	Soft               bool       `json:"soft"`
+	RestorableUntil    *time.Time `json:"restorable_until,omitempty"`
+	TokensRevoked      int64      `json:"tokens_revoked"`
+	PurgeScheduled     bool       `json:"purge_scheduled"`
+	MeasurementsPurged []string   `json:"measurements_purged"`
+	// PurgeFailed is set if the device was deleted but its measurements could not be purged
+	PurgeFailed bool `json:"purge_failed"`
+}
+
+// errDeviceGone is returned if a device was deleted by a concurrent request
+var errDeviceGone = errors.New("device was already deleted")
+
+// execCount runs a statement in a transaction and returns the affected rows
+func execCount(tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return 0, err
+	}
+	result, err := stmt.Exec(args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Delete device, its accesstokens and jwts are revoked in the same transaction
+func (d *Device) Delete(del *DeviceDelete, influx *db.Influx) (*DeviceDeleteSummary, int, error) {
+	device, status, err := d.Read()
+	if err != nil {
+		return nil, status, err
+	}
+	id := *device.Id
+	summary := &DeviceDeleteSummary{Device: device, Soft: del.Soft, MeasurementsPurged: []string{}}
+
+	tx, err := d.Database.Begin()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	summary.TokensRevoked, err = execCount(tx, fmt.Sprintf("DELETE FROM %s WHERE device_id = ?", Table), id)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	if del.Soft {
+		tNow := time.Now()
+		rows, err := execCount(tx, "UPDATE devices SET date_deleted = ?, purge_data = ? WHERE id = ? AND date_deleted IS NULL",
+			tNow.UTC().Format(db.SqliteDateLayout), del.Purge, id)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		if rows != 1 {
+			return nil, http.StatusConflict, fmt.Errorf("device with id '%s' was already deleted", id)
+		}
+		restorableUntil := tNow.Add(config.DeviceDeleteGrace)
+		summary.RestorableUntil = &restorableUntil
+		summary.PurgeScheduled = del.Purge
+	} else {
+		err = deleteDeviceRows(tx, id)
+		if err == errDeviceGone {
+			return nil, http.StatusConflict, fmt.Errorf("device with id '%s' was already deleted", id)
+		}
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+	}
+
+	err = d.Auditor.record(tx, AuditDelete, AuditResourceDevice, id, id, auditDevice(device), map[string]interface{}{
+		"soft":           del.Soft,
+		"purge":          del.Purge,
+		"tokens_revoked": summary.TokensRevoked,
+	})
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	revocation, status, err := revokeDeviceJwts(tx, id, d.Auditor)
+	if err != nil {
+		return nil, status, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	JwtRevocations.apply(revocation)
+
+	// The device is gone either way, a failed purge is only reported
+	if del.Purge && !del.Soft {
+		measurements, _, err := NewData(influx, d.Database).Purge(id)
+		if err != nil {
+			util.Log.Errorf("purging the measurements of deleted device %s failed: %s", id, err)
+			summary.PurgeFailed = true
+		} else {
+			summary.MeasurementsPurged = measurements
+		}
+	}
+	return summary, http.StatusOK, nil
+}
+
+// deleteDeviceRows removes a device and everything referencing it
+func deleteDeviceRows(tx *sql.Tx, deviceId string) error {
+	for _, query := range []string{
+		fmt.Sprintf("DELETE FROM %s WHERE device_id = ?", Table),
+		"DELETE FROM zone_devices WHERE device_id = ?",
+		"DELETE FROM device_labels WHERE device_id = ?",
+		"DELETE FROM device_shadows WHERE device_id = ?",
+		"DELETE FROM device_commands WHERE device_id = ?",
+		"DELETE FROM device_sensors WHERE device_id = ?",
+		"DELETE FROM calibrations WHERE device_id = ?",
+		"DELETE FROM device_signing_keys WHERE device_id = ?",
+		"DELETE FROM device_certificates WHERE device_id = ?",
+		"DELETE FROM grants WHERE (resource_kind = 'device' AND resource_id = ?1) OR (principal_kind = 'device' AND principal_id = ?1)",
+	} {
+		if _, err := execCount(tx, query, deviceId); err != nil {
+			return err
+		}
+	}
+	rows, err := execCount(tx, "DELETE FROM devices WHERE id = ?", deviceId)
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return errDeviceGone
+	}
+	return nil
+}
+
+// Restore a soft deleted device within its grace period, it has to login again
+func (d *Device) Restore() (*Device, int, error) {
+	return d.restore(time.Now().Add(-config.DeviceDeleteGrace).UTC().Format(db.SqliteDateLayout))
+}
+
+// restore a device deleted after the deadline, an empty one restores any soft deleted device
+func (d *Device) restore(deadline string) (*Device, int, error) {
+	if d.Id == nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("no device id given to restore")
+	}
+	id := *d.Id
+
+	tx, err := d.Database.Begin()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	rows, err := execCount(tx, "UPDATE devices SET date_deleted = NULL, purge_data = 0 WHERE id = ? AND date_deleted > ?", id, deadline)
+	if err != nil && isUniqueViolation(err) {
+		return nil, http.StatusConflict, fmt.Errorf("another device with the mac address of device '%s' exists", id)
+	}
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if rows != 1 {
+		return nil, http.StatusNotFound, fmt.Errorf("no restorable device with id '%s'", id)
+	}
+
+	// The audited view is read within the transaction, the restored device only once it is committed
+	restored := NewDevice(&id, d.Database)
+	err = tx.QueryRow("SELECT name, mac_address, state FROM devices WHERE id = ?", id).Scan(&restored.Name, &restored.MacAddr, &restored.State)
+	if err == nil {
+		restored.Labels, err = readLabels(tx, id)
+	}
+	if err == nil {
+		err = d.Auditor.record(tx, AuditRestore, AuditResourceDevice, id, id, nil, auditDevice(restored))
+	}
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	err = tx.Commit()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return d.Read()
+}
+
+// SweepDeletedDevices removes soft deleted devices whose grace period is over
+func SweepDeletedDevices(database *db.Sqlite, influx *db.Influx) {
+	stmt, err := database.Prepare("SELECT id, purge_data FROM devices WHERE date_deleted <= ?")
+	if err != nil {
+		util.Log.Error(err)
+		return
+	}
+	deadline := time.Now().Add(-config.DeviceDeleteGrace).UTC().Format(db.SqliteDateLayout)
+	rows, err := stmt.Query(deadline)
+	if err != nil {
+		util.Log.Error(err)
+		return
+	}
+	expired := map[string]bool{}
+	for rows.Next() {
+		var id string
+		var purge bool
+		if err := rows.Scan(&id, &purge); err != nil {
+			util.Log.Error(err)
+			rows.Close()
+			return
+		}
+		expired[id] = purge
+	}
+	rows.Close()
+
+	for id, purge := range expired {
+		tx, err := database.Begin()
+		if err != nil {
+			util.Log.Error(err)
+			return
+		}
+		// Nobody but the system removes expired devices
+		var auditor *Auditor
+		err = deleteDeviceRows(tx, id)
+		if err == nil {
+			err = auditor.record(tx, AuditDelete, AuditResourceDevice, id, id, nil, map[string]interface{}{"expired": true, "purge": purge})
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			util.Log.Error(err)
+			continue
+		}
+		util.Log.Infof("removed soft deleted device %s", id)
+
+		if purge {
+			measurements, _, err := NewData(influx, database).Purge(id)
+			if err != nil {
+				util.Log.Error(err)
+				continue
+			}
+			util.Log.Infof("purged %d measurements of device %s", len(measurements), id)
+		}
+	}
+}
+
+// DeduplicateDevices soft deletes all but the newest device of each mac address, then makes mac addresses unique.
+// Older versions allowed duplicates, upserts rely on the unique index.
+func DeduplicateDevices(database *db.Sqlite) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, lower(mac_address) FROM devices WHERE date_deleted IS NULL AND mac_address != ''
+		ORDER BY lower(mac_address), date_created DESC, id`)
+	if err != nil {
+		return err
+	}
+	kept := map[string]string{}
+	duplicates := map[string]string{}
+	for rows.Next() {
+		var id, macAddress string
+		if err := rows.Scan(&id, &macAddress); err != nil {
+			rows.Close()
+			return err
+		}
+		if newest, ok := kept[macAddress]; ok {
+			duplicates[id] = newest
+		} else {
+			kept[macAddress] = id
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Format(db.SqliteDateLayout)
+	for id, newest := range duplicates {
+		tokensRevoked, err := execCount(tx, fmt.Sprintf("DELETE FROM %s WHERE device_id = ?", Table), id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE devices SET date_deleted = ? WHERE id = ?", now, id); err != nil {
+			return err
+		}
+		// Nobody but the system resolves duplicates
+		var auditor *Auditor
+		err = auditor.record(tx, AuditDelete, AuditResourceDevice, id, id, nil, map[string]interface{}{
+			"soft":           true,
+			"duplicate_of":   newest,
+			"tokens_revoked": tokensRevoked,
+		})
+		if err != nil {
+			return err
+		}
+		// Revocations are loaded after this on startup, they only have to be written
+		if _, _, err := revokeDeviceJwts(tx, id, auditor); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS Uq_devices_mac_address ON devices ( mac_address COLLATE NOCASE )
+		WHERE date_deleted IS NULL AND mac_address != ''`)
+	if err != nil {
+		return fmt.Errorf("mac addresses of devices are not unique: %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		util.Log.Warningf("soft deleted %d devices with the mac address of a newer one", len(duplicates))
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package business
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+)
+
+// testDeviceRows counts the rows of a device in the tables cleared by a delete
+func testDeviceRows(t *testing.T, database *db.Sqlite, deviceId string) (int, int) {
+	t.Helper()
+	stmt, err := database.Prepare(`SELECT (SELECT count(*) FROM accesstokens WHERE device_id = ?1),
+		(SELECT count(*) FROM device_labels WHERE device_id = ?1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens, labels int
+	if err := stmt.QueryRow(deviceId).Scan(&tokens, &labels); err != nil {
+		t.Fatal(err)
+	}
+	return tokens, labels
+}
+
+func TestDeviceDelete(t *testing.T) {
+	database := testDatabase(t)
+	for _, id := range []string{"soft", "hard", "other"} {
+		testDevice(t, database, id, "")
+		testExec(t, database, `INSERT INTO accesstokens (id, device_id, token, date_created, date_updated) VALUES (?, ?, '', '', '')`, "token-"+id, id)
+		testExec(t, database, `INSERT INTO device_labels (device_id, key, value, date_updated) VALUES (?, 'room', 'kitchen', '')`, id)
+	}
+	exists := func(t *testing.T, id string) bool {
+		t.Helper()
+		exists, err := NewDevice(&id, database).Exists()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+	id := func(id string) *string { return &id }
+
+	t.Run("soft delete and restore", func(t *testing.T) {
+		summary, status, err := NewDevice(id("soft"), database).Delete(&DeviceDelete{Soft: true}, nil)
+		if status != http.StatusOK {
+			t.Fatalf("Delete() = %d (%v), want %d", status, err, http.StatusOK)
+		}
+		if summary.TokensRevoked != 1 || summary.RestorableUntil == nil {
+			t.Errorf("Delete() = %+v, want one token revoked and restorable", summary)
+		}
+		if exists(t, "soft") {
+			t.Errorf("soft deleted device exists, want it hidden")
+		}
+		if tokens, labels := testDeviceRows(t, database, "soft"); tokens != 0 || labels != 1 {
+			t.Errorf("soft deleted device has %d tokens and %d labels, want 0 and 1", tokens, labels)
+		}
+		if _, status, _ := NewDevice(id("soft"), database).Delete(&DeviceDelete{Soft: true}, nil); status != http.StatusNotFound {
+			t.Errorf("Delete() of a deleted device = %d, want %d", status, http.StatusNotFound)
+		}
+
+		restored, status, err := NewDevice(id("soft"), database).Restore()
+		if status != http.StatusOK {
+			t.Fatalf("Restore() = %d (%v), want %d", status, err, http.StatusOK)
+		}
+		if len(restored.Labels) != 1 || !exists(t, "soft") {
+			t.Errorf("Restore() = %+v, want the device back with its labels", restored)
+		}
+		if _, status, _ := NewDevice(id("soft"), database).Restore(); status != http.StatusNotFound {
+			t.Errorf("Restore() of a device not deleted = %d, want %d", status, http.StatusNotFound)
+		}
+	})
+
+	t.Run("restore after the grace period", func(t *testing.T) {
+		if _, status, err := NewDevice(id("soft"), database).Delete(&DeviceDelete{Soft: true}, nil); status != http.StatusOK {
+			t.Fatalf("Delete() = %d (%v), want %d", status, err, http.StatusOK)
+		}
+		expired := time.Now().Add(-config.DeviceDeleteGrace - time.Hour).UTC().Format(db.SqliteDateLayout)
+		testExec(t, database, "UPDATE devices SET date_deleted = ? WHERE id = 'soft'", expired)
+		if _, status, _ := NewDevice(id("soft"), database).Restore(); status != http.StatusNotFound {
+			t.Errorf("Restore() after the grace period = %d, want %d", status, http.StatusNotFound)
+		}
+	})
+
+	t.Run("hard delete cascades", func(t *testing.T) {
+		if _, status, err := NewDevice(id("hard"), database).Delete(&DeviceDelete{}, nil); status != http.StatusOK {
+			t.Fatalf("Delete() = %d (%v), want %d", status, err, http.StatusOK)
+		}
+		if exists(t, "hard") {
+			t.Errorf("deleted device exists")
+		}
+		if tokens, labels := testDeviceRows(t, database, "hard"); tokens != 0 || labels != 0 {
+			t.Errorf("deleted device left %d tokens and %d labels, want none", tokens, labels)
+		}
+		if tokens, labels := testDeviceRows(t, database, "other"); tokens != 1 || labels != 1 {
+			t.Errorf("other device has %d tokens and %d labels, want 1 and 1", tokens, labels)
+		}
+		if _, status, _ := NewDevice(id("hard"), database).Restore(); status != http.StatusNotFound {
+			t.Errorf("Restore() of a hard deleted device = %d, want %d", status, http.StatusNotFound)
+		}
+	})
+}
@@ -1,12 +1,17 @@
 package business
 
 import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	_business "gitlab.void-ptr.org/go/reflection/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/config"
 	"gitlab.void-ptr.org/go/schism/pkg/db"
 	"gitlab.void-ptr.org/go/schism/pkg/util"
 )
@@ -17,7 +22,44 @@ type DeviceSupport struct {
 
 type Device struct {
 	*_business.Device
-	Database *db.Sqlite `json:"-"`
+	Database   *db.Sqlite        `json:"-"`
+	Labels     map[string]string `json:"labels"`
+	LastSeenAt *time.Time        `json:"last_seen_at"`
+	LastSource *string           `json:"last_source"`
+	Status     string            `json:"status"`
+	State      string            `json:"state"`
+	// EnrollmentToken lets a pending device poll for its approval, it is only handed out once
+	EnrollmentToken *string  `json:"-"`
+	Auditor         *Auditor `json:"-"`
+}
+
+// Device states, only active devices may login and authenticate
+const (
+	DeviceStatePending  = "pending"
+	DeviceStateActive   = "active"
+	DeviceStateDisabled = "disabled"
+)
+
+// DeviceCreate extends the shared create with an optional claim code
+type DeviceCreate struct {
+	_business.DeviceCreate
+	ClaimCode *string `json:"claim_code"`
+	// Upsert returns the existing device if the mac address is already known
+	Upsert bool `json:"-"`
+}
+
+// deviceNamespace for uuid v5 device ids derived from the mac address
+var deviceNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://gitlab.void-ptr.org/go/schism/devices"))
+
+// isUniqueViolation checks for sqlite unique and primary key constraint errors
+func isUniqueViolation(err error) bool {
+	return strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// DeviceUpdate extends the shared update with labels, a null label value removes the label
+type DeviceUpdate struct {
+	_business.DeviceUpdate
+	Labels map[string]*string `json:"labels"`
 }
 
 func NewDevice(id *string, database *db.Sqlite) *Device {
@@ -28,33 +70,87 @@ func (d *Device) Exists() (bool, error) {
 	if d.Id == nil {
 		return false, fmt.Errorf("no device id given to read")
 	}
-	stmt, err := d.Database.Prepare("SELECT id from devices where id = ?")
+	stmt, err := d.Database.Prepare("SELECT count(*) from devices where id = ? AND date_deleted IS NULL")
 	if err != nil {
 		return false, err
 	}
-	id := *d.Id
-	row := stmt.QueryRow(id)
-	if err := row.Err(); err != nil {
-		return false, nil
+	var count int
+	err = stmt.QueryRow(*d.Id).Scan(&count)
+	if err != nil {
+		return false, err
 	}
-	return true, nil
+	return count > 0, nil
 }
 
-// Create device
-func (d *Device) Create(create *_business.DeviceCreate) (*Device, int, error) {
+// Create device, with a valid claim code it is active right away otherwise it is pending approval
+func (d *Device) Create(create *DeviceCreate) (*Device, int, error) {
 	if d.Id != nil {
 		return nil, http.StatusBadRequest, fmt.Errorf("the device was already created with id '%s'", *d.Id)
 	}
 
-	// Create new unique id for device
-	u, err := uuid.NewUUID()
+	// Devices are unique by their mac address
+	if len(create.MacAddr) > 0 {
+		existing, status, err := d.ReadByMac(create.MacAddr)
+		switch {
+		case err == nil && create.Upsert:
+			return existing, http.StatusOK, nil
+		case err == nil:
+			return nil, http.StatusConflict, fmt.Errorf("device with mac address '%s' already exists", create.MacAddr)
+		case status != http.StatusNotFound:
+			return nil, status, err
+		}
+	}
+
+	// Create new unique id for device, optionally derived from its mac address
+	var id string
+	if config.DeviceIdFromMac && len(create.MacAddr) > 0 {
+		id = uuid.NewSHA1(deviceNamespace, []byte(strings.ToLower(create.MacAddr))).String()
+	} else {
+		u, err := uuid.NewUUID()
+		if err != nil {
+			panic(err)
+		}
+		id = u.String()
+	}
+
+	// A reflashed device registering again brings back its soft deleted self instead of colliding with it
+	if create.Upsert && config.DeviceIdFromMac && len(create.MacAddr) > 0 {
+		deleted := NewDevice(&id, d.Database)
+		deleted.Auditor = d.Auditor
+		restored, status, err := deleted.restore("")
+		switch {
+		case err == nil:
+			return restored, http.StatusOK, nil
+		case status != http.StatusNotFound:
+			return nil, status, err
+		}
+	}
+
+	tx, err := d.Database.Begin()
 	if err != nil {
-		panic(err)
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	state := DeviceStatePending
+	var enrollmentToken *string
+	if create.ClaimCode != nil {
+		status, err := redeemClaimCode(tx, *create.ClaimCode, id)
+		if err != nil {
+			return nil, status, err
+		}
+		state = DeviceStateActive
+	} else {
+		token, err := util.RandomHex(32)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("token error")
+		}
+		enrollmentToken = &token
 	}
-	id := u.String()
-	d.Id = &id
 
-	stmt, err := d.Database.Prepare("INSERT INTO devices (id, name, mac_address, date_created, date_updated) VALUES (?, ?, ?, ?, ?)")
+	stmt, err := tx.Prepare("INSERT INTO devices (id, name, mac_address, state, enrollment_token, date_created, date_updated) VALUES (?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
@@ -62,17 +158,36 @@ func (d *Device) Create(create *_business.DeviceCreate) (*Device, int, error) {
 
 	tNow := time.Now()
 	now := tNow.UTC().Format(db.SqliteDateLayout)
-	_, err = stmt.Exec(d.Id, create.Name, create.MacAddr, now, now)
+	_, err = stmt.Exec(id, create.Name, create.MacAddr, state, enrollmentToken, now, now)
+	if err != nil && isUniqueViolation(err) {
+		return nil, http.StatusConflict, fmt.Errorf("device with mac address '%s' or id '%s' already exists", create.MacAddr, id)
+	}
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
 
+	d.Id = &id
 	d.Name = create.Name
 	d.MacAddr = create.MacAddr
+	d.State = state
+	d.EnrollmentToken = enrollmentToken
+	d.Status = deviceStatus(nil)
+	d.Labels = map[string]string{}
 	d.CreatedAt = tNow
 	d.UpdatedAt = tNow
 
+	err = d.Auditor.record(tx, AuditCreate, AuditResourceDevice, id, id, nil, auditDevice(d))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	err = tx.Commit()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
 	return d, http.StatusCreated, nil
 }
 
@@ -93,23 +208,75 @@ func (d *Device) Read() (*Device, int, error) {
 		return d, http.StatusNotFound, fmt.Errorf("device with id '%s' does not exist", id)
 	}
 
-	stmt, err := d.Database.Prepare("SELECT name, mac_address, date_created, date_updated FROM devices WHERE id = ?")
+	stmt, err := d.Database.Prepare(fmt.Sprintf("SELECT %s FROM devices WHERE id = ?", deviceColumns))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	device, status, err := scanDevice(stmt.QueryRow(id), d.Database)
+	if err != nil {
+		return nil, status, err
+	}
+	device.Labels, err = readLabels(d.Database, id)
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
 
-	device := NewDevice(&id, d.Database)
+	return device, http.StatusOK, nil
+}
 
-	var name, mac_addr, date_created, date_updated string
-	err = stmt.QueryRow(*device.Id).Scan(&name, &mac_addr, &date_created, &date_updated)
+// ReadByMac finds the device with a mac address, pending devices keep their enrollment token
+func (d *Device) ReadByMac(macAddr string) (*Device, int, error) {
+	stmt, err := d.Database.Prepare("SELECT id, enrollment_token FROM devices WHERE mac_address = ? COLLATE NOCASE AND date_deleted IS NULL")
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
+	var id string
+	var enrollmentToken sql.NullString
+	err = stmt.QueryRow(macAddr).Scan(&id, &enrollmentToken)
+	if err == sql.ErrNoRows {
+		return nil, http.StatusNotFound, fmt.Errorf("device with mac address '%s' does not exist", macAddr)
+	}
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	device, status, err := NewDevice(&id, d.Database).Read()
+	if err != nil {
+		return nil, status, err
+	}
+	if enrollmentToken.Valid {
+		device.EnrollmentToken = &enrollmentToken.String
+	}
+	return device, http.StatusOK, nil
+}
+
+// deviceColumns selected for every device read, keep in sync with scanDevice
+const deviceColumns = "id, name, mac_address, state, date_created, date_updated, last_seen_at, last_source"
 
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanDevice reads the deviceColumns of a row into a new device
+func scanDevice(row rowScanner, database *db.Sqlite) (*Device, int, error) {
+	var id, name, mac_addr, state, date_created, date_updated string
+	var last_seen_at, last_source sql.NullString
+	err := row.Scan(&id, &name, &mac_addr, &state, &date_created, &date_updated, &last_seen_at, &last_source)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	device := NewDevice(&id, database)
 	device.Name = name
 	device.MacAddr = mac_addr
+	device.State = state
 	device.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
 	if err != nil {
 		util.Log.Error(err)
@@ -120,25 +287,46 @@ func (d *Device) Read() (*Device, int, error) {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
 	}
-
+	if last_seen_at.Valid {
+		lastSeenAt, err := time.Parse(db.SqliteDateLayout, last_seen_at.String)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+		}
+		device.LastSeenAt = &lastSeenAt
+	}
+	if last_source.Valid {
+		device.LastSource = &last_source.String
+	}
+	// Prefer the presence that is not flushed yet
+	if seen, ok := Presence.get(id); ok && (device.LastSeenAt == nil || seen.SeenAt.After(*device.LastSeenAt)) {
+		device.LastSeenAt = &seen.SeenAt
+		if len(seen.Source) > 0 {
+			device.LastSource = &seen.Source
+		}
+	}
+	device.Status = deviceStatus(device.LastSeenAt)
 	return device, http.StatusOK, nil
 }
 
 // Update device
-func (d *Device) Update(update *_business.DeviceUpdate) (*Device, int, error) {
+func (d *Device) Update(update *DeviceUpdate) (*Device, int, error) {
 	if d.Id == nil {
 		return nil, http.StatusBadRequest, fmt.Errorf("no device id given to update")
 	}
 	id := *d.Id
 
-	// Check if resource exists
-	exists, err := d.Exists()
+	// Properties not given keep their current value, which is also what the audit records as before
+	current, status, err := NewDevice(&id, d.Database).Read()
 	if err != nil {
-		util.Log.Error(err)
-		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		return nil, status, err
 	}
-	if !exists {
-		return d, http.StatusNotFound, fmt.Errorf("device with id '%s' does not exist", id)
+	before := auditDevice(current)
+	current.Auditor = d.Auditor
+	d = current
+
+	if err := validateLabels(update.Labels); err != nil {
+		return nil, http.StatusBadRequest, err
 	}
 
 	// Update resource properties
@@ -152,12 +340,22 @@ func (d *Device) Update(update *_business.DeviceUpdate) (*Device, int, error) {
 	d.UpdatedAt = tNow
 	now := tNow.UTC().Format(db.SqliteDateLayout)
 
-	stmt, err := d.Database.Prepare("UPDATE devices SET name = ?, mac_address = ?, date_updated = ? where id = ?")
+	tx, err := d.Database.Begin()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("UPDATE devices SET name = ?, mac_address = ?, date_updated = ? where id = ?")
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
 	result, err := stmt.Exec(d.Name, d.MacAddr, now, id)
+	if err != nil && isUniqueViolation(err) {
+		return nil, http.StatusConflict, fmt.Errorf("device with mac address '%s' already exists", d.MacAddr)
+	}
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
@@ -171,42 +369,217 @@ func (d *Device) Update(update *_business.DeviceUpdate) (*Device, int, error) {
 		util.Log.Panicf("update affected %d rows, only one expected", rows)
 	}
 
+	status, err = updateLabels(tx, id, update.Labels)
+	if err != nil {
+		return nil, status, err
+	}
+	d.Labels, err = readLabels(tx, id)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	err = d.Auditor.record(tx, AuditUpdate, AuditResourceDevice, id, id, before, auditDevice(d))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	err = tx.Commit()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
 	return d, http.StatusOK, nil
 }
 
-// Delete device
-func (d *Device) Delete() (*Device, int, error) {
-	if d.Id == nil {
-		return nil, http.StatusBadRequest, fmt.Errorf("no device id given to update")
+// DeviceListSort columns devices can be ordered by
+var DeviceListSort = map[string]string{
+	"date_created": "date_created",
+	"date_updated": "date_updated",
+	"name":         "name",
+}
+
+// DeviceListDefaultLimit is used when no limit is given, DeviceListMaxLimit caps any given limit
+const DeviceListDefaultLimit = 50
+const DeviceListMaxLimit = 500
+
+type DeviceList struct {
+	Cursor       string
+	Limit        int
+	Sort         string
+	Descending   bool
+	Name         string
+	MacAddr      string
+	State        string
+	CreatedAfter *time.Time
+}
+
+type DeviceListResponse struct {
+	Devices []*Device `json:"devices"`
+	Next    *string   `json:"next"`
+}
+
+// deviceCursor marks the last device of a page, it is handed out base64 encoded
+type deviceCursor struct {
+	Value string `json:"v"`
+	Id    string `json:"id"`
+}
+
+func (c *deviceCursor) encode() (string, error) {
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		return "", err
 	}
-	id := *d.Id
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
 
-	exists, err := d.Exists()
+func decodeDeviceCursor(cursor string) (*deviceCursor, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(cursor)
 	if err != nil {
-		util.Log.Error(err)
-		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		return nil, err
 	}
-	if !exists {
-		return d, http.StatusNotFound, fmt.Errorf("device with id '%s' does not exist", id)
+	var c deviceCursor
+	err = json.Unmarshal(bytes, &c)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// List devices
+func (d *Device) List(list *DeviceList) (*DeviceListResponse, int, error) {
+	sort := "date_created"
+	if len(list.Sort) > 0 {
+		column, ok := DeviceListSort[list.Sort]
+		if !ok {
+			return nil, http.StatusBadRequest, fmt.Errorf("devices can not be sorted by '%s'", list.Sort)
+		}
+		sort = column
+	}
+	direction, compare := "ASC", ">"
+	if list.Descending {
+		direction, compare = "DESC", "<"
+	}
+	limit := DeviceListDefaultLimit
+	if list.Limit > 0 {
+		limit = list.Limit
+	}
+	if limit > DeviceListMaxLimit {
+		limit = DeviceListMaxLimit
 	}
 
-	stmt, err := d.Database.Prepare("DELETE FROM devices WHERE id = ?")
+	// Build filters
+	where := []string{"date_deleted IS NULL"}
+	args := []interface{}{}
+	if len(list.Name) > 0 {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(list.Name)
+		where = append(where, `name LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escaped+"%")
+	}
+	if len(list.MacAddr) > 0 {
+		where = append(where, "mac_address = ? COLLATE NOCASE")
+		args = append(args, list.MacAddr)
+	}
+	if len(list.State) > 0 {
+		where = append(where, "state = ?")
+		args = append(args, list.State)
+	}
+	if list.CreatedAfter != nil {
+		where = append(where, "date_created > ?")
+		args = append(args, list.CreatedAfter.UTC().Format(db.SqliteDateLayout))
+	}
+	if len(list.Cursor) > 0 {
+		cursor, err := decodeDeviceCursor(list.Cursor)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid cursor given")
+		}
+		where = append(where, fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", sort, compare, sort, compare))
+		args = append(args, cursor.Value, cursor.Value, cursor.Id)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM devices WHERE %s", deviceColumns, strings.Join(where, " AND "))
+	// Fetch one more device than requested to know if there is a next page
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT ?", sort, direction, direction)
+	args = append(args, limit+1)
+
+	stmt, err := d.Database.Prepare(query)
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
-	result, err := stmt.Exec(id)
+	rows, err := stmt.Query(args...)
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
-	rows, err := result.RowsAffected()
+	defer rows.Close()
+
+	response := &DeviceListResponse{Devices: []*Device{}}
+	for rows.Next() {
+		device, status, err := scanDevice(rows, d.Database)
+		if err != nil {
+			return nil, status, err
+		}
+		response.Devices = append(response.Devices, device)
+	}
+	if err := rows.Err(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	rows.Close()
+
+	for _, device := range response.Devices {
+		device.Labels, err = readLabels(d.Database, *device.Id)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+	}
+
+	if len(response.Devices) > limit {
+		response.Devices = response.Devices[:limit]
+		last := response.Devices[limit-1]
+		cursor := &deviceCursor{Id: *last.Id}
+		switch sort {
+		case "name":
+			cursor.Value = last.Name
+		case "date_updated":
+			cursor.Value = last.UpdatedAt.UTC().Format(db.SqliteDateLayout)
+		default:
+			cursor.Value = last.CreatedAt.UTC().Format(db.SqliteDateLayout)
+		}
+		next, err := cursor.encode()
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("cursor error")
+		}
+		response.Next = &next
+	}
+
+	return response, http.StatusOK, nil
+}
+
+// queryIds runs a statement selecting a single id column
+func queryIds(stmt *sql.Stmt, args ...interface{}) ([]string, int, error) {
+	rows, err := stmt.Query(args...)
 	if err != nil {
 		util.Log.Error(err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
 	}
-	if rows != 1 {
-		util.Log.Panicf("delete affected %d rows, only one expected", rows)
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		ids = append(ids, id)
 	}
-	return d, http.StatusOK, nil
+	if err := rows.Err(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return ids, http.StatusOK, nil
 }
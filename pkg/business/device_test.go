@@ -0,0 +1,151 @@
+package business
+
+import (
+	"net/http"
+	"testing"
+
+	_business "gitlab.void-ptr.org/go/reflection/pkg/business"
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+)
+
+func TestDeviceCreateUniqueMac(t *testing.T) {
+	database := testDatabase(t)
+	if err := DeduplicateDevices(database); err != nil {
+		t.Fatal(err)
+	}
+	claim := func(name string, macAddress string, upsert bool) *DeviceCreate {
+		return &DeviceCreate{DeviceCreate: _business.DeviceCreate{Name: name, MacAddr: macAddress}, Upsert: upsert}
+	}
+
+	first, status, err := NewDevice(nil, database).Create(claim("first", "b8:27:eb:00:00:01", false))
+	if status != http.StatusCreated {
+		t.Fatalf("Create() = %d (%v), want %d", status, err, http.StatusCreated)
+	}
+
+	tests := []struct {
+		name   string
+		create *DeviceCreate
+		status int
+		same   bool
+	}{
+		{"same mac", claim("second", "b8:27:eb:00:00:01", false), http.StatusConflict, false},
+		{"same mac in upper case", claim("second", "B8:27:EB:00:00:01", false), http.StatusConflict, false},
+		{"upsert of the same mac", claim("second", "B8:27:EB:00:00:01", true), http.StatusOK, true},
+		{"other mac", claim("other", "b8:27:eb:00:00:02", false), http.StatusCreated, false},
+		{"without mac", claim("none", "", false), http.StatusCreated, false},
+		{"without mac again", claim("none", "", false), http.StatusCreated, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device, status, err := NewDevice(nil, database).Create(tt.create)
+			if status != tt.status {
+				t.Fatalf("Create() = %d (%v), want %d", status, err, tt.status)
+			}
+			if device != nil && (*device.Id == *first.Id) != tt.same {
+				t.Errorf("Create() returned device %s, same as the first is %v, want %v", *device.Id, *device.Id == *first.Id, tt.same)
+			}
+		})
+	}
+}
+
+func TestDeviceUpsertRestoresDeleted(t *testing.T) {
+	previous := config.DeviceIdFromMac
+	config.DeviceIdFromMac = true
+	t.Cleanup(func() { config.DeviceIdFromMac = previous })
+	database := testDatabase(t)
+	if err := DeduplicateDevices(database); err != nil {
+		t.Fatal(err)
+	}
+	create := &DeviceCreate{DeviceCreate: _business.DeviceCreate{Name: "pi", MacAddr: "b8:27:eb:00:00:01"}}
+
+	device, status, err := NewDevice(nil, database).Create(create)
+	if status != http.StatusCreated {
+		t.Fatalf("Create() = %d (%v), want %d", status, err, http.StatusCreated)
+	}
+	if _, status, err := NewDevice(device.Id, database).Delete(&DeviceDelete{Soft: true}, nil); status != http.StatusOK {
+		t.Fatalf("Delete() = %d (%v), want %d", status, err, http.StatusOK)
+	}
+
+	// The id derived from the mac address is still taken by the deleted device
+	if _, status, _ := NewDevice(nil, database).Create(create); status != http.StatusConflict {
+		t.Errorf("Create() = %d, want %d", status, http.StatusConflict)
+	}
+
+	create.Upsert = true
+	restored, status, err := NewDevice(nil, database).Create(create)
+	if status != http.StatusOK {
+		t.Fatalf("Create() with upsert = %d (%v), want %d", status, err, http.StatusOK)
+	}
+	if *restored.Id != *device.Id {
+		t.Errorf("Create() with upsert = device %s, want the restored %s", *restored.Id, *device.Id)
+	}
+}
+
+func TestDeduplicateDevices(t *testing.T) {
+	database := testDatabase(t)
+	for _, device := range []struct {
+		id, macAddress, created string
+	}{
+		{"old", "b8:27:eb:00:00:01", "2021-01-01T00:00:00+0000"},
+		{"new", "B8:27:EB:00:00:01", "2022-01-01T00:00:00+0000"},
+		{"older", "b8:27:eb:00:00:01", "2020-01-01T00:00:00+0000"},
+		{"single", "b8:27:eb:00:00:02", "2020-01-01T00:00:00+0000"},
+		{"no-mac", "", "2020-01-01T00:00:00+0000"},
+		{"no-mac-either", "", "2020-01-01T00:00:00+0000"},
+	} {
+		testExec(t, database, "INSERT INTO devices (id, name, mac_address, date_created, date_updated) VALUES (?, ?, ?, ?, ?)",
+			device.id, device.id, device.macAddress, device.created, device.created)
+	}
+	testExec(t, database, `INSERT INTO accesstokens (id, device_id, token, date_created, date_updated) VALUES ('token', 'old', '', '', '')`)
+
+	if err := DeduplicateDevices(database); err != nil {
+		t.Fatal(err)
+	}
+	// Running it again finds nothing to resolve
+	if err := DeduplicateDevices(database); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id      string
+		deleted bool
+	}{
+		{"new", false},
+		{"old", true},
+		{"older", true},
+		{"single", false},
+		{"no-mac", false},
+		{"no-mac-either", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			exists, err := NewDevice(&tt.id, database).Exists()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists == tt.deleted {
+				t.Errorf("device %s exists %v, want deleted %v", tt.id, exists, tt.deleted)
+			}
+		})
+	}
+
+	stmt, err := database.Prepare("SELECT (SELECT count(*) FROM accesstokens), (SELECT count(*) FROM audit WHERE action = ? AND resource = ? AND resource_id IN ('old', 'older'))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens, audited int
+	if err := stmt.QueryRow(AuditDelete, AuditResourceDevice).Scan(&tokens, &audited); err != nil {
+		t.Fatal(err)
+	}
+	if tokens != 0 || audited != 2 {
+		t.Errorf("%d accesstokens are left and %d deletes audited, want 0 and 2", tokens, audited)
+	}
+
+	stmt, err = database.Prepare("INSERT INTO devices (id, name, mac_address, date_created, date_updated) VALUES ('again', '', 'b8:27:eb:00:00:01', '', '')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stmt.Exec(); err == nil || !isUniqueViolation(err) {
+		t.Errorf("insert of a duplicate mac address = %v, want a unique violation", err)
+	}
+}
@@ -0,0 +1,148 @@
+package business
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// DeviceEnrollment is the answer to a device registering itself, the device and its first
+// accesstoken are only part of it once the device is active
+type DeviceEnrollment struct {
+	State       string       `json:"state"`
+	Enrollment  *string      `json:"enrollment,omitempty"`
+	Device      *Device      `json:"device,omitempty"`
+	Accesstoken *Accesstoken `json:"accesstoken,omitempty"`
+	// Certificate issued if the device enrolled with a signing request
+	Certificate *DeviceCertificate `json:"certificate,omitempty"`
+}
+
+// ReadEnrollment finds the device of an enrollment token
+func (d *Device) ReadEnrollment(token string) (*Device, int, error) {
+	stmt, err := d.Database.Prepare("SELECT id FROM devices WHERE enrollment_token = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	ids, status, err := queryIds(stmt, token)
+	if err != nil {
+		return nil, status, err
+	}
+	if len(ids) != 1 {
+		return nil, http.StatusNotFound, fmt.Errorf("enrollment does not exist")
+	}
+	device := NewDevice(&ids[0], d.Database)
+	return device.Read()
+}
+
+// CompleteEnrollment invalidates the enrollment token of an active device and creates its first accesstoken,
+// along with a certificate if the device sent a signing request. It succeeds only once and leaves the
+// enrollment untouched if anything of it can not be created.
+func (d *Device) CompleteEnrollment(token string, csr *x509.CertificateRequest) (*DeviceEnrollment, int, error) {
+	if d.Id == nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("no device id given to update")
+	}
+
+	tx, err := d.Database.Begin()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	rows, err := execCount(tx, "UPDATE devices SET enrollment_token = NULL WHERE id = ? AND enrollment_token = ? AND state = ?",
+		*d.Id, token, DeviceStateActive)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if rows != 1 {
+		return nil, http.StatusConflict, fmt.Errorf("enrollment was already completed")
+	}
+
+	accesstoken := NewAccesstoken(nil, d.Database)
+	accesstoken.Auditor = d.Auditor
+	status, err := accesstoken.create(tx, *d.Id, Scopes)
+	if err != nil {
+		return nil, status, err
+	}
+	var certificate *DeviceCertificate
+	if csr != nil {
+		certificate = NewDeviceCertificate(nil, *d.Id, d.Database)
+		certificate.Auditor = d.Auditor
+		certificate.Scopes = accesstoken.Scopes
+		status, err = certificate.create(tx, csr)
+		if err != nil {
+			return nil, status, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	accesstoken.applyRevocations()
+	d.EnrollmentToken = nil
+	return &DeviceEnrollment{
+		State:       d.State,
+		Device:      d,
+		Accesstoken: accesstoken,
+		Certificate: certificate,
+	}, http.StatusOK, nil
+}
+
+// SetState of a device, used by admins to approve, disable or re-enable devices
+func (d *Device) SetState(state string) (*Device, int, error) {
+	switch state {
+	case DeviceStateActive, DeviceStateDisabled:
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("devices can not be set to state '%s'", state)
+	}
+	device, status, err := d.Read()
+	if err != nil {
+		return device, status, err
+	}
+
+	tx, err := d.Database.Begin()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	tNow := time.Now()
+	_, err = execCount(tx, "UPDATE devices SET state = ?, date_updated = ? WHERE id = ?", state, tNow.UTC().Format(db.SqliteDateLayout), *device.Id)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	before := auditDevice(device)
+	device.State = state
+	device.UpdatedAt = tNow
+	err = d.Auditor.record(tx, AuditUpdate, AuditResourceDevice, *device.Id, *device.Id, before, auditDevice(device))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	// Jwts are not checked against the device state, they have to be revoked with it
+	var revocation *JwtRevocation
+	if state != DeviceStateActive {
+		revocation, status, err = revokeDeviceJwts(tx, *device.Id, d.Auditor)
+		if err != nil {
+			return nil, status, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if revocation != nil {
+		JwtRevocations.apply(revocation)
+	}
+	return device, http.StatusOK, nil
+}
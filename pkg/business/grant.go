@@ -0,0 +1,302 @@
+package business
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// Resources of grants, a group covers all its devices at the time of the check
+const (
+	GrantResourceDevice = "device"
+	GrantResourceZone   = "zone"
+	GrantResourceSite   = "site"
+)
+
+// Principals grants are given to, api keys are named by their name
+const (
+	GrantPrincipalDevice = "device"
+	GrantPrincipalUser   = "user"
+	GrantPrincipalApiKey = "apikey"
+)
+
+// Grantable actions, everything else stays limited to a device itself and the roles of users
+const (
+	GrantReadDevice = "read-device"
+	GrantReadData   = "read-data"
+)
+
+var grantResources = map[string]bool{GrantResourceDevice: true, GrantResourceZone: true, GrantResourceSite: true}
+var grantPrincipals = map[string]bool{GrantPrincipalDevice: true, GrantPrincipalUser: true, GrantPrincipalApiKey: true}
+var grantActions = map[string]bool{GrantReadDevice: true, GrantReadData: true}
+
+// Grant allows a principal an action on a device, or on all devices of a zone or site
+type Grant struct {
+	Database      *db.Sqlite `json:"-"`
+	Id            *string    `json:"id"`
+	ResourceKind  string     `json:"resource_kind"`
+	ResourceId    string     `json:"resource_id"`
+	PrincipalKind string     `json:"principal_kind"`
+	PrincipalId   string     `json:"principal_id"`
+	Action        string     `json:"action"`
+	CreatedAt     time.Time  `json:"date_created"`
+	Auditor       *Auditor   `json:"-"`
+}
+
+type GrantCreate struct {
+	ResourceKind  string `json:"resource_kind"`
+	ResourceId    string `json:"resource_id"`
+	PrincipalKind string `json:"principal_kind"`
+	PrincipalId   string `json:"principal_id"`
+	Action        string `json:"action"`
+}
+
+type GrantList struct {
+	ResourceKind  string
+	ResourceId    string
+	PrincipalKind string
+	PrincipalId   string
+}
+
+func NewGrant(id *string, database *db.Sqlite) *Grant {
+	return &Grant{Id: id, Database: database}
+}
+
+// auditGrant is the audited view of a grant
+func auditGrant(g *Grant) map[string]interface{} {
+	return map[string]interface{}{
+		"resource_kind":  g.ResourceKind,
+		"resource_id":    g.ResourceId,
+		"principal_kind": g.PrincipalKind,
+		"principal_id":   g.PrincipalId,
+		"action":         g.Action,
+	}
+}
+
+// grantDeviceId is the device a grant is audited for, none for groups
+func grantDeviceId(g *Grant) string {
+	if g.ResourceKind == GrantResourceDevice {
+		return g.ResourceId
+	}
+	return ""
+}
+
+// checkExists makes sure a resource or principal of a grant exists, api keys live in secret files and are not checked
+func (g *Grant) checkExists(kind string, id string) (int, error) {
+	switch kind {
+	case GrantResourceDevice:
+		if _, status, err := NewDevice(&id, g.Database).Read(); err != nil {
+			return status, err
+		}
+	case GrantResourceZone, GrantResourceSite:
+		var exists bool
+		var err error
+		if kind == GrantResourceZone {
+			exists, err = NewZone(&id, g.Database).Exists()
+		} else {
+			exists, err = NewSite(&id, g.Database).Exists()
+		}
+		if err != nil {
+			util.Log.Error(err)
+			return http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		if !exists {
+			return http.StatusNotFound, fmt.Errorf("%s with id '%s' does not exist", kind, id)
+		}
+	case GrantPrincipalUser:
+		if _, status, err := NewUser(&id, g.Database).Read(); err != nil {
+			return status, err
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// Create grant
+func (g *Grant) Create(create *GrantCreate) (*Grant, int, error) {
+	if g.Id != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("the grant was already created with id '%s'", *g.Id)
+	}
+	if !grantResources[create.ResourceKind] {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid resource kind '%s'", create.ResourceKind)
+	}
+	if !grantPrincipals[create.PrincipalKind] {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid principal kind '%s'", create.PrincipalKind)
+	}
+	if !grantActions[create.Action] {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid action '%s'", create.Action)
+	}
+	if len(create.ResourceId) == 0 || len(create.PrincipalId) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("no resource or principal id given")
+	}
+	if status, err := g.checkExists(create.ResourceKind, create.ResourceId); err != nil {
+		return nil, status, err
+	}
+	if status, err := g.checkExists(create.PrincipalKind, create.PrincipalId); err != nil {
+		return nil, status, err
+	}
+
+	u, err := uuid.NewUUID()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("uuid error")
+	}
+	id := u.String()
+
+	stmt, err := g.Database.Prepare(fmt.Sprintf("INSERT INTO grants (%s) VALUES (?, ?, ?, ?, ?, ?, ?)", grantColumns))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	tNow := time.Now()
+	_, err = stmt.Exec(id, create.ResourceKind, create.ResourceId, create.PrincipalKind, create.PrincipalId, create.Action,
+		tNow.UTC().Format(db.SqliteDateLayout))
+	if err != nil && isUniqueViolation(err) {
+		return nil, http.StatusConflict, fmt.Errorf("the grant already exists")
+	}
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	g.Id = &id
+	g.ResourceKind = create.ResourceKind
+	g.ResourceId = create.ResourceId
+	g.PrincipalKind = create.PrincipalKind
+	g.PrincipalId = create.PrincipalId
+	g.Action = create.Action
+	g.CreatedAt = tNow
+	g.Auditor.recordAfter(g.Database, AuditCreate, AuditResourceGrant, id, grantDeviceId(g), nil, auditGrant(g))
+	return g, http.StatusCreated, nil
+}
+
+const grantColumns = "id, resource_kind, resource_id, principal_kind, principal_id, action, date_created"
+
+func scanGrant(row rowScanner, database *db.Sqlite) (*Grant, error) {
+	var id, date_created string
+	grant := NewGrant(&id, database)
+	err := row.Scan(&id, &grant.ResourceKind, &grant.ResourceId, &grant.PrincipalKind, &grant.PrincipalId, &grant.Action, &date_created)
+	if err != nil {
+		return nil, err
+	}
+	grant.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
+	if err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
+
+// Read grant
+func (g *Grant) Read() (*Grant, int, error) {
+	if g.Id == nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("no grant id given to read")
+	}
+	stmt, err := g.Database.Prepare(fmt.Sprintf("SELECT %s FROM grants WHERE id = ?", grantColumns))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	grant, err := scanGrant(stmt.QueryRow(*g.Id), g.Database)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, http.StatusNotFound, fmt.Errorf("grant with id '%s' does not exist", *g.Id)
+	case err != nil:
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	grant.Auditor = g.Auditor
+	return grant, http.StatusOK, nil
+}
+
+// List grants, optionally only of a resource or principal
+func (g *Grant) List(list *GrantList) ([]*Grant, int, error) {
+	query := fmt.Sprintf("SELECT %s FROM grants WHERE 1 = 1", grantColumns)
+	args := []interface{}{}
+	for _, filter := range []struct {
+		column string
+		value  string
+	}{
+		{"resource_kind", list.ResourceKind},
+		{"resource_id", list.ResourceId},
+		{"principal_kind", list.PrincipalKind},
+		{"principal_id", list.PrincipalId},
+	} {
+		if len(filter.value) > 0 {
+			query += fmt.Sprintf(" AND %s = ?", filter.column)
+			args = append(args, filter.value)
+		}
+	}
+	query += " ORDER BY date_created, id"
+
+	stmt, err := g.Database.Prepare(query)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer rows.Close()
+
+	grants := []*Grant{}
+	for rows.Next() {
+		grant, err := scanGrant(rows, g.Database)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		grants = append(grants, grant)
+	}
+	if err := rows.Err(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return grants, http.StatusOK, nil
+}
+
+// Delete grant
+func (g *Grant) Delete() (*Grant, int, error) {
+	grant, status, err := g.Read()
+	if err != nil {
+		return nil, status, err
+	}
+	stmt, err := g.Database.Prepare("DELETE FROM grants WHERE id = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	_, err = stmt.Exec(*grant.Id)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	g.Auditor.recordAfter(g.Database, AuditDelete, AuditResourceGrant, *grant.Id, grantDeviceId(grant), auditGrant(grant), nil)
+	return grant, http.StatusOK, nil
+}
+
+// HasGrant checks if a principal was granted an action on a device, directly or through its zone or site
+func HasGrant(database *db.Sqlite, principalKind, principalId, deviceId, action string) (bool, error) {
+	stmt, err := database.Prepare(`SELECT count(*) FROM grants
+		WHERE principal_kind = ?1 AND principal_id = ?2 AND action = ?3 AND (
+			(resource_kind = 'device' AND resource_id = ?4)
+			OR (resource_kind = 'zone' AND resource_id IN (SELECT zone_id FROM zone_devices WHERE device_id = ?4))
+			OR (resource_kind = 'site' AND resource_id IN (
+				SELECT z.site_id FROM zones z JOIN zone_devices zd ON zd.zone_id = z.id WHERE zd.device_id = ?4
+			))
+		)`)
+	if err != nil {
+		return false, err
+	}
+	var count int
+	err = stmt.QueryRow(principalKind, principalId, action, deviceId).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,97 @@
+package business
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHasGrant(t *testing.T) {
+	database := testDatabase(t)
+	testExec(t, database, "INSERT INTO sites (id, name, date_created, date_updated) VALUES ('site', 'home', '', '')")
+	for _, zone := range []string{"kitchen", "cellar"} {
+		testExec(t, database, "INSERT INTO zones (id, site_id, name, date_created, date_updated) VALUES (?, 'site', ?, '', '')", zone, zone)
+	}
+	for device, zone := range map[string]string{"in-kitchen": "kitchen", "in-cellar": "cellar", "alone": ""} {
+		testDevice(t, database, device, "")
+		if len(zone) > 0 {
+			testExec(t, database, "INSERT INTO zone_devices (device_id, zone_id, date_created) VALUES (?, ?, '')", device, zone)
+		}
+	}
+	testDevice(t, database, "reader", "")
+
+	grant := func(resourceKind, resourceId, principalKind, principalId, action string) (int, error) {
+		_, status, err := NewGrant(nil, database).Create(&GrantCreate{
+			ResourceKind: resourceKind, ResourceId: resourceId, PrincipalKind: principalKind, PrincipalId: principalId, Action: action,
+		})
+		return status, err
+	}
+	for _, g := range [][5]string{
+		{GrantResourceDevice, "alone", GrantPrincipalDevice, "reader", GrantReadData},
+		{GrantResourceZone, "kitchen", GrantPrincipalDevice, "reader", GrantReadDevice},
+		{GrantResourceSite, "site", GrantPrincipalApiKey, "dashboard", GrantReadData},
+	} {
+		if status, err := grant(g[0], g[1], g[2], g[3], g[4]); status != http.StatusCreated {
+			t.Fatalf("Create() of %v = %d (%v), want %d", g, status, err, http.StatusCreated)
+		}
+	}
+
+	t.Run("invalid grants", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			grant [5]string
+			want  int
+		}{
+			{"already granted", [5]string{GrantResourceDevice, "alone", GrantPrincipalDevice, "reader", GrantReadData}, http.StatusConflict},
+			{"ungrantable action", [5]string{GrantResourceDevice, "alone", GrantPrincipalDevice, "reader", "write"}, http.StatusBadRequest},
+			{"unknown resource kind", [5]string{"building", "site", GrantPrincipalDevice, "reader", GrantReadData}, http.StatusBadRequest},
+			{"unknown zone", [5]string{GrantResourceZone, "attic", GrantPrincipalDevice, "reader", GrantReadData}, http.StatusNotFound},
+			{"unknown device principal", [5]string{GrantResourceDevice, "alone", GrantPrincipalDevice, "unknown", GrantReadData}, http.StatusNotFound},
+		}
+		for _, tt := range tests {
+			if status, _ := grant(tt.grant[0], tt.grant[1], tt.grant[2], tt.grant[3], tt.grant[4]); status != tt.want {
+				t.Errorf("Create() %s = %d, want %d", tt.name, status, tt.want)
+			}
+		}
+	})
+
+	tests := []struct {
+		name          string
+		principalKind string
+		principalId   string
+		deviceId      string
+		action        string
+		want          bool
+	}{
+		{"device grant", GrantPrincipalDevice, "reader", "alone", GrantReadData, true},
+		{"device grant of another action", GrantPrincipalDevice, "reader", "alone", GrantReadDevice, false},
+		{"device grant of another device", GrantPrincipalDevice, "reader", "in-kitchen", GrantReadData, false},
+		{"zone grant", GrantPrincipalDevice, "reader", "in-kitchen", GrantReadDevice, true},
+		{"zone grant outside the zone", GrantPrincipalDevice, "reader", "in-cellar", GrantReadDevice, false},
+		{"site grant", GrantPrincipalApiKey, "dashboard", "in-cellar", GrantReadData, true},
+		{"site grant to a device without zone", GrantPrincipalApiKey, "dashboard", "alone", GrantReadData, false},
+		{"other principal kind of the same id", GrantPrincipalUser, "reader", "alone", GrantReadData, false},
+		{"other api key", GrantPrincipalApiKey, "other", "in-cellar", GrantReadData, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := HasGrant(database, tt.principalKind, tt.principalId, tt.deviceId, tt.action)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("HasGrant() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("moved out of the zone", func(t *testing.T) {
+		testExec(t, database, "UPDATE zone_devices SET zone_id = 'cellar' WHERE device_id = 'in-kitchen'")
+		got, err := HasGrant(database, GrantPrincipalDevice, "reader", "in-kitchen", GrantReadDevice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got {
+			t.Errorf("HasGrant() after the device left the zone = true, want false")
+		}
+	})
+}
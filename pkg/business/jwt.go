@@ -0,0 +1,171 @@
+package business
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// jwtAlgorithm signs all jwts, Ed25519 allows publishing the keys to verify them
+const jwtAlgorithm = "EdDSA"
+
+// JwtIssuer of all jwts
+const JwtIssuer = "schism"
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// JwtClaims of a device jwt, scope is space separated
+type JwtClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Scope     string `json:"scope"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Id        string `json:"jti"`
+	// TokenId of the accesstoken the jwt was exchanged from, revoking the accesstoken revokes the jwt
+	TokenId string `json:"tid,omitempty"`
+}
+
+// Jwt is a short lived, stateless accesstoken of a device
+type Jwt struct {
+	Token     string    `json:"token"`
+	Id        string    `json:"id"`
+	DeviceId  string    `json:"device_id"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"date_expires"`
+}
+
+type JwtCreate struct {
+	// Scopes narrow the ones of the accesstoken exchanged, all of them if empty
+	Scopes []string `json:"scopes"`
+}
+
+// IsJwt tells jwts from opaque accesstokens, which never contain dots
+func IsJwt(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// IssueJwt exchanges an authenticated accesstoken for a jwt with the same or fewer scopes
+func IssueJwt(accesstoken *Accesstoken, create *JwtCreate) (*Jwt, int, error) {
+	if accesstoken.Jwt {
+		return nil, http.StatusBadRequest, fmt.Errorf("a jwt can not be exchanged for another one")
+	}
+	scopes := accesstoken.Scopes
+	if len(create.Scopes) > 0 {
+		if err := validateScopes(create.Scopes); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		for _, scope := range create.Scopes {
+			if !accesstoken.HasScope(scope) {
+				return nil, http.StatusForbidden, fmt.Errorf("accesstoken lacks scope '%s'", scope)
+			}
+		}
+		scopes = create.Scopes
+	}
+
+	key := JwtKeys.signer()
+	if key == nil {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("no jwt signing key loaded")
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("token error")
+	}
+
+	tNow := time.Now()
+	expires := tNow.Add(config.JwtTTL)
+	claims := &JwtClaims{
+		Issuer:    JwtIssuer,
+		Subject:   accesstoken.DeviceId,
+		Scope:     strings.Join(scopes, " "),
+		IssuedAt:  tNow.Unix(),
+		ExpiresAt: expires.Unix(),
+		Id:        hex.EncodeToString(jti),
+	}
+	if !accesstoken.Certificate && accesstoken.Id != nil {
+		claims.TokenId = *accesstoken.Id
+	}
+	header, err := json.Marshal(&jwtHeader{Alg: jwtAlgorithm, Typ: "JWT", Kid: key.Kid})
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("marshal error")
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("marshal error")
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(key.private, []byte(signingInput))
+
+	return &Jwt{
+		Token:     signingInput + "." + base64.RawURLEncoding.EncodeToString(signature),
+		Id:        claims.Id,
+		DeviceId:  accesstoken.DeviceId,
+		Scopes:    scopes,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}, http.StatusCreated, nil
+}
+
+// VerifyJwt checks signature, expiry and revocation of a jwt without touching the database
+func VerifyJwt(token string) (*Accesstoken, int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, http.StatusUnauthorized, fmt.Errorf("malformed jwt")
+	}
+
+	var header jwtHeader
+	if err := decodeJwtPart(parts[0], &header); err != nil || header.Alg != jwtAlgorithm {
+		return nil, http.StatusUnauthorized, fmt.Errorf("malformed jwt")
+	}
+	public, ok := JwtKeys.verifier(header.Kid)
+	if !ok {
+		return nil, http.StatusUnauthorized, fmt.Errorf("jwt signed by an unknown key")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(public, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, http.StatusUnauthorized, fmt.Errorf("invalid jwt signature")
+	}
+
+	var claims JwtClaims
+	if err := decodeJwtPart(parts[1], &claims); err != nil || claims.Issuer != JwtIssuer || len(claims.Subject) == 0 {
+		return nil, http.StatusUnauthorized, fmt.Errorf("malformed jwt")
+	}
+	expires := time.Unix(claims.ExpiresAt, 0)
+	if !time.Now().Before(expires) {
+		return nil, http.StatusUnauthorized, ErrAccesstokenExpired
+	}
+	if JwtRevocations.revoked(&claims) {
+		return nil, http.StatusUnauthorized, fmt.Errorf("jwt has been revoked")
+	}
+
+	accesstoken := NewAccesstoken(&claims.Id, nil)
+	accesstoken.Token = &token
+	accesstoken.DeviceId = claims.Subject
+	accesstoken.Scopes = strings.Fields(claims.Scope)
+	accesstoken.ExpiresAt = &expires
+	accesstoken.Jwt = true
+	return accesstoken, http.StatusOK, nil
+}
+
+func decodeJwtPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,176 @@
+package business
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+)
+
+// testJwtKey creates a key in memory only
+func testJwtKey(t *testing.T, kid string) *JwtKey {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &JwtKey{Kid: kid, CreatedAt: time.Now(), public: public, private: private}
+}
+
+// testSignJwt signs any header and claims, valid or not
+func testSignJwt(t *testing.T, key *JwtKey, header jwtHeader, claims JwtClaims) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key.private, []byte(signingInput)))
+}
+
+func TestVerifyJwt(t *testing.T) {
+	key := testJwtKey(t, "current")
+	unknown := testJwtKey(t, "unknown")
+	keys, revocations := JwtKeys, JwtRevocations
+	t.Cleanup(func() { JwtKeys, JwtRevocations = keys, revocations })
+	JwtKeys = &JwtKeyring{current: key, keys: map[string]*JwtKey{key.Kid: key}}
+	JwtRevocations = NewJwtRevocationList()
+
+	now := time.Now()
+	header := jwtHeader{Alg: jwtAlgorithm, Typ: "JWT", Kid: key.Kid}
+	claims := func(deviceId string, jti string, issuedAt time.Time, expiresAt time.Time) JwtClaims {
+		return JwtClaims{Issuer: JwtIssuer, Subject: deviceId, Scope: "device:read data:write",
+			IssuedAt: issuedAt.Unix(), ExpiresAt: expiresAt.Unix(), Id: jti}
+	}
+	valid := claims("device", "valid", now, now.Add(time.Hour))
+
+	JwtRevocations.apply(&JwtRevocation{Kind: JwtRevocationToken, Subject: "revoked", RevokedAt: now})
+	JwtRevocations.apply(&JwtRevocation{Kind: JwtRevocationDevice, Subject: "revoked-device", RevokedAt: now})
+
+	// Without a signature but the dot before it
+	unsigned := testSignJwt(t, key, jwtHeader{Alg: "none", Typ: "JWT", Kid: key.Kid}, valid)
+	unsigned = unsigned[:strings.LastIndex(unsigned, ".")+1]
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"valid", testSignJwt(t, key, header, valid), http.StatusOK},
+		{"wrong kid", testSignJwt(t, key, jwtHeader{Alg: jwtAlgorithm, Typ: "JWT", Kid: "unknown"}, valid), http.StatusUnauthorized},
+		{"signed by unknown key", testSignJwt(t, unknown, header, valid), http.StatusUnauthorized},
+		{"wrong alg", testSignJwt(t, key, jwtHeader{Alg: "HS256", Typ: "JWT", Kid: key.Kid}, valid), http.StatusUnauthorized},
+		{"alg none", unsigned, http.StatusUnauthorized},
+		{"expired", testSignJwt(t, key, header, claims("device", "expired", now.Add(-2*time.Hour), now.Add(-time.Hour))), http.StatusUnauthorized},
+		{"expires now", testSignJwt(t, key, header, claims("device", "now", now.Add(-time.Hour), now)), http.StatusUnauthorized},
+		{"revoked", testSignJwt(t, key, header, claims("device", "revoked", now, now.Add(time.Hour))), http.StatusUnauthorized},
+		{"device revoked", testSignJwt(t, key, header, claims("revoked-device", "before", now.Add(-time.Minute), now.Add(time.Hour))), http.StatusUnauthorized},
+		{"issued after device revocation", testSignJwt(t, key, header, claims("revoked-device", "after", now.Add(time.Minute), now.Add(time.Hour))), http.StatusOK},
+		{"wrong issuer", testSignJwt(t, key, header, JwtClaims{Issuer: "other", Subject: "device", ExpiresAt: now.Add(time.Hour).Unix()}), http.StatusUnauthorized},
+		{"malformed", "header.payload", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accesstoken, status, err := VerifyJwt(tt.token)
+			if status != tt.want {
+				t.Fatalf("VerifyJwt() = %d (%v), want %d", status, err, tt.want)
+			}
+			if tt.want == http.StatusOK && (!accesstoken.Jwt || len(accesstoken.DeviceId) == 0) {
+				t.Errorf("VerifyJwt() = %+v, want the jwt of a device", accesstoken)
+			}
+		})
+	}
+
+	t.Run("payload tampered", func(t *testing.T) {
+		parts := strings.Split(testSignJwt(t, key, header, valid), ".")
+		other, _ := json.Marshal(claims("other", "valid", now, now.Add(time.Hour)))
+		parts[1] = base64.RawURLEncoding.EncodeToString(other)
+		if _, status, _ := VerifyJwt(strings.Join(parts, ".")); status != http.StatusUnauthorized {
+			t.Errorf("VerifyJwt() = %d, want %d", status, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestAccesstokenRevokesJwts(t *testing.T) {
+	testPepper(t, "pepper")
+	database := testDatabase(t)
+	testDevice(t, database, "device", "")
+	key := testJwtKey(t, "current")
+	keys, revocations, maxAccesstokens := JwtKeys, JwtRevocations, config.MaxAccesstokensPerDevice
+	t.Cleanup(func() { JwtKeys, JwtRevocations, config.MaxAccesstokensPerDevice = keys, revocations, maxAccesstokens })
+	JwtKeys = &JwtKeyring{current: key, keys: map[string]*JwtKey{key.Kid: key}}
+	JwtRevocations = NewJwtRevocationList()
+	config.MaxAccesstokensPerDevice = 3
+
+	// login creates an accesstoken and exchanges it for a jwt
+	login := func(t *testing.T) (*Accesstoken, string) {
+		t.Helper()
+		accesstoken, status, err := NewAccesstoken(nil, database).Create(&AccesstokenCreate{DeviceId: "device"})
+		if status != http.StatusCreated {
+			t.Fatalf("Create() = %d (%v), want %d", status, err, http.StatusCreated)
+		}
+		jwt, status, err := IssueJwt(accesstoken, &JwtCreate{})
+		if status != http.StatusCreated {
+			t.Fatalf("IssueJwt() = %d (%v), want %d", status, err, http.StatusCreated)
+		}
+		return accesstoken, jwt.Token
+	}
+	// verify checks a jwt in memory and again with the revocations loaded from the database
+	verify := func(t *testing.T, token string, want int) {
+		t.Helper()
+		if _, status, err := VerifyJwt(token); status != want {
+			t.Errorf("VerifyJwt() = %d (%v), want %d", status, err, want)
+		}
+		loaded := NewJwtRevocationList()
+		if err := loaded.Load(database); err != nil {
+			t.Fatal(err)
+		}
+		current := JwtRevocations
+		JwtRevocations = loaded
+		defer func() { JwtRevocations = current }()
+		if _, status, err := VerifyJwt(token); status != want {
+			t.Errorf("VerifyJwt() with the loaded revocations = %d (%v), want %d", status, err, want)
+		}
+	}
+
+	t.Run("deleted", func(t *testing.T) {
+		accesstoken, token := login(t)
+		_, other := login(t)
+		if _, status, err := accesstoken.Delete(); status != http.StatusOK {
+			t.Fatalf("Delete() = %d (%v), want %d", status, err, http.StatusOK)
+		}
+		verify(t, token, http.StatusUnauthorized)
+		verify(t, other, http.StatusOK)
+	})
+
+	t.Run("others revoked", func(t *testing.T) {
+		_, token := login(t)
+		kept, keptToken := login(t)
+		if _, status, err := RevokeOtherAccesstokens(database, "device", *kept.Id, nil); status != http.StatusOK {
+			t.Fatalf("RevokeOtherAccesstokens() = %d (%v), want %d", status, err, http.StatusOK)
+		}
+		verify(t, token, http.StatusUnauthorized)
+		verify(t, keptToken, http.StatusOK)
+	})
+
+	t.Run("evicted", func(t *testing.T) {
+		_, token := login(t)
+		for i := 0; i < config.MaxAccesstokensPerDevice-1; i++ {
+			login(t)
+		}
+		verify(t, token, http.StatusOK)
+		_, newest := login(t)
+		verify(t, token, http.StatusUnauthorized)
+		verify(t, newest, http.StatusOK)
+	})
+}
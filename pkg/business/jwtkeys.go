@@ -0,0 +1,262 @@
+package business
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// JwtKey signs jwts while it is current, retired keys only verify until the last jwt they signed expired
+type JwtKey struct {
+	Kid       string     `json:"kid"`
+	CreatedAt time.Time  `json:"date_created"`
+	RetiredAt *time.Time `json:"date_retired"`
+	public    ed25519.PublicKey
+	private   ed25519.PrivateKey
+}
+
+// Jwk is the public part of a key as published in the jwks
+type Jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+type Jwks struct {
+	Keys []Jwk `json:"keys"`
+}
+
+// JwtKeyring holds the keys of the database in memory, verifying a jwt does not touch the database
+type JwtKeyring struct {
+	mutex   sync.RWMutex
+	current *JwtKey
+	keys    map[string]*JwtKey
+}
+
+// JwtKeys used by the api, loaded on startup
+var JwtKeys = NewJwtKeyring()
+
+func NewJwtKeyring() *JwtKeyring {
+	return &JwtKeyring{keys: map[string]*JwtKey{}}
+}
+
+// jwtKeyName a signing key is sealed under
+func jwtKeyName(kid string) string {
+	return "jwt_key:" + kid
+}
+
+// Load the keys from the database, a first key is created if there is no current one.
+// Keys stored in clear text by older versions are sealed on the way.
+func (k *JwtKeyring) Load(database *db.Sqlite) error {
+	stmt, err := database.Prepare("SELECT kid, private_key, date_created, date_retired FROM jwt_keys ORDER BY date_created")
+	if err != nil {
+		return err
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var current *JwtKey
+	keys := map[string]*JwtKey{}
+	unsealed := []string{}
+	for rows.Next() {
+		var kid, privateKey, date_created string
+		var date_retired sql.NullString
+		if err := rows.Scan(&kid, &privateKey, &date_created, &date_retired); err != nil {
+			return err
+		}
+		var seed []byte
+		if isSealed(privateKey) {
+			seed, err = openPrivateKey(jwtKeyName(kid), privateKey)
+			if err != nil {
+				return err
+			}
+		} else {
+			seed, err = base64.StdEncoding.DecodeString(privateKey)
+			unsealed = append(unsealed, kid)
+		}
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return fmt.Errorf("invalid private key of jwt key '%s'", kid)
+		}
+		key := &JwtKey{Kid: kid, private: ed25519.NewKeyFromSeed(seed)}
+		key.public = key.private.Public().(ed25519.PublicKey)
+		key.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
+		if err != nil {
+			return err
+		}
+		if date_retired.Valid {
+			retiredAt, err := time.Parse(db.SqliteDateLayout, date_retired.String)
+			if err != nil {
+				return err
+			}
+			key.RetiredAt = &retiredAt
+		} else {
+			current = key
+		}
+		keys[kid] = key
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, kid := range unsealed {
+		sealed, err := sealPrivateKey(jwtKeyName(kid), keys[kid].private.Seed())
+		if err != nil {
+			return err
+		}
+		stmt, err := database.Prepare("UPDATE jwt_keys SET private_key = ? WHERE kid = ?")
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(sealed, kid); err != nil {
+			return err
+		}
+	}
+	if len(unsealed) > 0 {
+		util.Log.Infof("sealed %d clear text jwt keys", len(unsealed))
+	}
+
+	if current == nil {
+		_, err := k.rotate(database, nil)
+		return err
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.current = current
+	k.keys = keys
+	return nil
+}
+
+// Rotate to a new signing key, the current one is retired but keeps verifying the jwts it signed
+func (k *JwtKeyring) Rotate(database *db.Sqlite, auditor *Auditor) (*JwtKey, int, error) {
+	key, err := k.rotate(database, auditor)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return key, http.StatusCreated, nil
+}
+
+func (k *JwtKeyring) rotate(database *db.Sqlite, auditor *Auditor) (*JwtKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := util.RandomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealPrivateKey(jwtKeyName(kid), private.Seed())
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	tNow := time.Now()
+	now := tNow.UTC().Format(db.SqliteDateLayout)
+	if _, err := tx.Exec("UPDATE jwt_keys SET date_retired = ? WHERE date_retired IS NULL", now); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("INSERT INTO jwt_keys (kid, private_key, date_created) VALUES (?, ?, ?)", kid, sealed, now)
+	if err != nil {
+		return nil, err
+	}
+	err = auditor.record(tx, AuditCreate, AuditResourceJwtKey, kid, "", nil, map[string]interface{}{"kid": kid, "date_created": tNow})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	util.Log.Infof("rotated jwt signing key to '%s'", kid)
+
+	if err := k.Load(database); err != nil {
+		return nil, err
+	}
+	return k.signer(), nil
+}
+
+// Prune retired keys whose jwts have all expired
+func (k *JwtKeyring) Prune(database *db.Sqlite) error {
+	stmt, err := database.Prepare("DELETE FROM jwt_keys WHERE date_retired IS NOT NULL AND date_retired <= ?")
+	if err != nil {
+		return err
+	}
+	result, err := stmt.Exec(time.Now().Add(-config.JwtTTL).UTC().Format(db.SqliteDateLayout))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return err
+	}
+	return k.Load(database)
+}
+
+// List the keys, current and retired, oldest first
+func (k *JwtKeyring) List() []*JwtKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	keys := []*JwtKey{}
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+// Jwks publishes the public keys of the keyring
+func (k *JwtKeyring) Jwks() *Jwks {
+	jwks := &Jwks{Keys: []Jwk{}}
+	for _, key := range k.List() {
+		jwks.Keys = append(jwks.Keys, Jwk{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key.public),
+			Kid: key.Kid,
+			Alg: jwtAlgorithm,
+			Use: "sig",
+		})
+	}
+	return jwks
+}
+
+// signer is the current key
+func (k *JwtKeyring) signer() *JwtKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.current
+}
+
+// verifier is the public key of a kid
+func (k *JwtKeyring) verifier(kid string) (ed25519.PublicKey, bool) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, false
+	}
+	return key.public, true
+}
@@ -0,0 +1,243 @@
+package business
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// Kinds of jwt revocations, a single jwt by its id, all jwts exchanged from an accesstoken
+// or all jwts a device was issued until then
+const (
+	JwtRevocationToken       = "token"
+	JwtRevocationAccesstoken = "accesstoken"
+	JwtRevocationDevice      = "device"
+)
+
+// JwtRevocation is kept until every jwt it covers has expired anyway
+type JwtRevocation struct {
+	Kind      string    `json:"kind"`
+	Subject   string    `json:"subject"`
+	RevokedAt time.Time `json:"date_revoked"`
+	ExpiresAt time.Time `json:"date_expires"`
+}
+
+type JwtRevocationCreate struct {
+	// JwtId revokes a single jwt
+	JwtId string `json:"jwt_id"`
+	// DeviceId revokes all jwts issued to a device until now
+	DeviceId string `json:"device_id"`
+}
+
+// JwtRevocationList holds the revocations of the database in memory
+type JwtRevocationList struct {
+	mutex        sync.RWMutex
+	tokens       map[string]time.Time
+	accesstokens map[string]time.Time
+	devices      map[string]time.Time
+}
+
+// JwtRevocations checked by every jwt authentication, loaded on startup
+var JwtRevocations = NewJwtRevocationList()
+
+func NewJwtRevocationList() *JwtRevocationList {
+	return &JwtRevocationList{tokens: map[string]time.Time{}, accesstokens: map[string]time.Time{}, devices: map[string]time.Time{}}
+}
+
+// Load the unexpired revocations from the database
+func (l *JwtRevocationList) Load(database *db.Sqlite) error {
+	revocations, err := l.list(database)
+	if err != nil {
+		return err
+	}
+	tokens := map[string]time.Time{}
+	accesstokens := map[string]time.Time{}
+	devices := map[string]time.Time{}
+	for _, revocation := range revocations {
+		switch revocation.Kind {
+		case JwtRevocationToken:
+			tokens[revocation.Subject] = revocation.RevokedAt
+		case JwtRevocationAccesstoken:
+			accesstokens[revocation.Subject] = revocation.RevokedAt
+		case JwtRevocationDevice:
+			devices[revocation.Subject] = revocation.RevokedAt
+		}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.tokens = tokens
+	l.accesstokens = accesstokens
+	l.devices = devices
+	return nil
+}
+
+// List the unexpired revocations
+func (l *JwtRevocationList) List(database *db.Sqlite) ([]*JwtRevocation, int, error) {
+	revocations, err := l.list(database)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return revocations, http.StatusOK, nil
+}
+
+func (l *JwtRevocationList) list(database *db.Sqlite) ([]*JwtRevocation, error) {
+	stmt, err := database.Prepare("SELECT kind, subject, date_revoked, date_expires FROM jwt_revocations WHERE date_expires > ? ORDER BY date_revoked")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(time.Now().UTC().Format(db.SqliteDateLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revocations := []*JwtRevocation{}
+	for rows.Next() {
+		revocation := &JwtRevocation{}
+		var date_revoked, date_expires string
+		if err := rows.Scan(&revocation.Kind, &revocation.Subject, &date_revoked, &date_expires); err != nil {
+			return nil, err
+		}
+		revocation.RevokedAt, err = time.Parse(db.SqliteDateLayout, date_revoked)
+		if err != nil {
+			return nil, err
+		}
+		revocation.ExpiresAt, err = time.Parse(db.SqliteDateLayout, date_expires)
+		if err != nil {
+			return nil, err
+		}
+		revocations = append(revocations, revocation)
+	}
+	return revocations, rows.Err()
+}
+
+// Revoke a jwt or all jwts of a device
+func (l *JwtRevocationList) Revoke(database *db.Sqlite, create *JwtRevocationCreate, auditor *Auditor) (*JwtRevocation, int, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	revocation, status, err := revokeJwts(tx, create, auditor)
+	if err != nil {
+		return nil, status, err
+	}
+	if err := tx.Commit(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	l.apply(revocation)
+	return revocation, http.StatusCreated, nil
+}
+
+// revokeJwts writes and audits a revocation within a transaction, it is applied to the list once committed
+func revokeJwts(tx *sql.Tx, create *JwtRevocationCreate, auditor *Auditor) (*JwtRevocation, int, error) {
+	tNow := time.Now()
+	// Every covered jwt expires within its lifetime from now
+	revocation := &JwtRevocation{RevokedAt: tNow, ExpiresAt: tNow.Add(config.JwtTTL)}
+	switch {
+	case len(create.JwtId) > 0 && len(create.DeviceId) == 0:
+		revocation.Kind = JwtRevocationToken
+		revocation.Subject = create.JwtId
+	case len(create.DeviceId) > 0 && len(create.JwtId) == 0:
+		revocation.Kind = JwtRevocationDevice
+		revocation.Subject = create.DeviceId
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("either a jwt id or a device id has to be given")
+	}
+	return writeJwtRevocation(tx, revocation, create.DeviceId, auditor)
+}
+
+// writeJwtRevocation stores and audits a revocation within a transaction
+func writeJwtRevocation(tx *sql.Tx, revocation *JwtRevocation, deviceId string, auditor *Auditor) (*JwtRevocation, int, error) {
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO jwt_revocations (kind, subject, date_revoked, date_expires) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	_, err = stmt.Exec(revocation.Kind, revocation.Subject, revocation.RevokedAt.UTC().Format(db.SqliteDateLayout),
+		revocation.ExpiresAt.UTC().Format(db.SqliteDateLayout))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	err = auditor.record(tx, AuditDelete, AuditResourceJwt, revocation.Subject, deviceId, nil, revocation)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return revocation, http.StatusCreated, nil
+}
+
+// revokeAccesstokenJwts exchanged from an accesstoken, within the transaction that deletes the accesstoken
+func revokeAccesstokenJwts(tx *sql.Tx, accesstokenId string, deviceId string, auditor *Auditor) (*JwtRevocation, int, error) {
+	tNow := time.Now()
+	revocation := &JwtRevocation{Kind: JwtRevocationAccesstoken, Subject: accesstokenId, RevokedAt: tNow, ExpiresAt: tNow.Add(config.JwtTTL)}
+	return writeJwtRevocation(tx, revocation, deviceId, auditor)
+}
+
+// revokeDeviceJwts of a device that may no longer authenticate, within the transaction that changes the device.
+// Jwts are not checked against the device, a change must not be committed without its revocation.
+func revokeDeviceJwts(tx *sql.Tx, deviceId string, auditor *Auditor) (*JwtRevocation, int, error) {
+	return revokeJwts(tx, &JwtRevocationCreate{DeviceId: deviceId}, auditor)
+}
+
+// apply a committed revocation to the list
+func (l *JwtRevocationList) apply(revocation *JwtRevocation) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	switch revocation.Kind {
+	case JwtRevocationToken:
+		l.tokens[revocation.Subject] = revocation.RevokedAt
+	case JwtRevocationAccesstoken:
+		l.accesstokens[revocation.Subject] = revocation.RevokedAt
+	case JwtRevocationDevice:
+		l.devices[revocation.Subject] = revocation.RevokedAt
+	}
+}
+
+// revoked checks the claims of a jwt against the list
+func (l *JwtRevocationList) revoked(claims *JwtClaims) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if _, ok := l.tokens[claims.Id]; ok {
+		return true
+	}
+	if _, ok := l.accesstokens[claims.TokenId]; ok && len(claims.TokenId) > 0 {
+		return true
+	}
+	revokedAt, ok := l.devices[claims.Subject]
+	return ok && claims.IssuedAt <= revokedAt.Unix()
+}
+
+// SweepJwtRevocations removes expired revocations and retired jwt keys
+func SweepJwtRevocations(database *db.Sqlite) {
+	stmt, err := database.Prepare("DELETE FROM jwt_revocations WHERE date_expires <= ?")
+	if err != nil {
+		util.Log.Error(err)
+		return
+	}
+	_, err = stmt.Exec(time.Now().UTC().Format(db.SqliteDateLayout))
+	if err != nil {
+		util.Log.Error(err)
+		return
+	}
+	if err := JwtRevocations.Load(database); err != nil {
+		util.Log.Error(err)
+	}
+	if err := JwtKeys.Prune(database); err != nil {
+		util.Log.Error(err)
+	}
+}
@@ -0,0 +1,80 @@
+package business
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// sealedPrefix marks private keys stored encrypted, keys of older versions are stored in clear text
+const sealedPrefix = "sealed:"
+
+// sealingKey encrypts the private keys kept in the database, it is derived from the token pepper so a leaked
+// database alone can not be used to sign anything
+func sealingKey() ([]byte, error) {
+	if len(TokenPepper) == 0 {
+		return nil, fmt.Errorf("no token pepper to seal private keys with")
+	}
+	mac := hmac.New(sha256.New, TokenPepper)
+	mac.Write([]byte("schism private keys"))
+	return mac.Sum(nil), nil
+}
+
+func sealingCipher() (cipher.AEAD, error) {
+	key, err := sealingKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealPrivateKey encrypts a private key with AES-GCM, the name binds it to its row
+func sealPrivateKey(name string, private []byte) (string, error) {
+	gcm, err := sealingCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, private, []byte(name))
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// isSealed tells stored private keys apart from clear text ones of older versions
+func isSealed(stored string) bool {
+	return strings.HasPrefix(stored, sealedPrefix)
+}
+
+// openPrivateKey decrypts a private key sealed under the same name
+func openPrivateKey(name string, stored string) ([]byte, error) {
+	if !isSealed(stored) {
+		return nil, fmt.Errorf("private key '%s' is not sealed", name)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedPrefix))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := sealingCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("private key '%s' is too short", name)
+	}
+	private, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("private key '%s' can not be opened, was the token pepper changed: %s", name, err)
+	}
+	return private, nil
+}
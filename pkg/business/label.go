@@ -0,0 +1,100 @@
+package business
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// labelKeyPattern restricts label keys to something usable as an influx tag key
+var labelKeyPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]{0,63}$`)
+
+const labelValueMaxLength = 256
+
+// validateLabels checks the keys and values of a label update, a nil value removes the label
+func validateLabels(labels map[string]*string) error {
+	for key, value := range labels {
+		if !labelKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid label key '%s'", key)
+		}
+		if value != nil && (len(*value) == 0 || len(*value) > labelValueMaxLength) {
+			return fmt.Errorf("label '%s' must have a value of 1 to %d characters", key, labelValueMaxLength)
+		}
+	}
+	return nil
+}
+
+// readLabels of a device
+func readLabels(p preparer, deviceId string) (map[string]string, error) {
+	stmt, err := p.Prepare("SELECT key, value FROM device_labels WHERE device_id = ?")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		labels[key] = value
+	}
+	return labels, rows.Err()
+}
+
+// updateLabels sets or removes the given labels of a device
+func updateLabels(p preparer, deviceId string, labels map[string]*string) (int, error) {
+	upsert, err := p.Prepare(`INSERT INTO device_labels (device_id, key, value, date_updated) VALUES (?, ?, ?, ?)
+		ON CONFLICT (device_id, key) DO UPDATE SET value = excluded.value, date_updated = excluded.date_updated`)
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	remove, err := p.Prepare("DELETE FROM device_labels WHERE device_id = ? AND key = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	now := time.Now().UTC().Format(db.SqliteDateLayout)
+	for key, value := range labels {
+		if value == nil {
+			_, err = remove.Exec(deviceId, key)
+		} else {
+			_, err = upsert.Exec(deviceId, key, *value, now)
+		}
+		if err != nil {
+			util.Log.Error(err)
+			return http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// deviceLabelTags reads the labels of a device that are allowed as influx tags
+func deviceLabelTags(database *db.Sqlite, deviceId string) (map[string]string, error) {
+	tags := map[string]string{}
+	if len(config.LabelTags) == 0 {
+		return tags, nil
+	}
+	labels, err := readLabels(database, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range config.LabelTags {
+		if value, ok := labels[key]; ok {
+			tags[key] = value
+		}
+	}
+	return tags, nil
+}
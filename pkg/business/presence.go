@@ -0,0 +1,132 @@
+package business
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// Device status computed from the last seen time
+const (
+	DeviceStatusOnline  = "online"
+	DeviceStatusStale   = "stale"
+	DeviceStatusOffline = "offline"
+)
+
+type presence struct {
+	SeenAt time.Time
+	Source string
+}
+
+// PresenceTracker buffers when devices were last seen and flushes them to sqlite in batches
+type PresenceTracker struct {
+	mutex   sync.Mutex
+	pending map[string]presence
+}
+
+// Presence of all devices, flushed by Run
+var Presence = NewPresenceTracker()
+
+func NewPresenceTracker() *PresenceTracker {
+	return &PresenceTracker{pending: map[string]presence{}}
+}
+
+// Seen marks a device as seen now, an empty source keeps the last known source
+func (p *PresenceTracker) Seen(deviceId string, source string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	seen := presence{SeenAt: time.Now(), Source: source}
+	if len(source) == 0 {
+		seen.Source = p.pending[deviceId].Source
+	}
+	p.pending[deviceId] = seen
+}
+
+// get the buffered presence of a device that is not yet flushed
+func (p *PresenceTracker) get(deviceId string) (presence, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	seen, ok := p.pending[deviceId]
+	return seen, ok
+}
+
+// Flush writes all buffered presences in one transaction
+func (p *PresenceTracker) Flush(database *db.Sqlite) error {
+	p.mutex.Lock()
+	pending := p.pending
+	p.pending = map[string]presence{}
+	p.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	restore := func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		for deviceId, seen := range pending {
+			if newer, ok := p.pending[deviceId]; !ok || newer.SeenAt.Before(seen.SeenAt) {
+				p.pending[deviceId] = seen
+			}
+		}
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		restore()
+		return err
+	}
+	stmt, err := tx.Prepare(`UPDATE devices SET last_seen_at = ?, last_source = COALESCE(NULLIF(?, ''), last_source)
+		WHERE id = ? AND (last_seen_at IS NULL OR last_seen_at < ?)`)
+	if err != nil {
+		tx.Rollback()
+		restore()
+		return err
+	}
+	for deviceId, seen := range pending {
+		seenAt := seen.SeenAt.UTC().Format(db.SqliteDateLayout)
+		_, err = stmt.Exec(seenAt, seen.Source, deviceId, seenAt)
+		if err != nil {
+			tx.Rollback()
+			restore()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		restore()
+		return err
+	}
+	util.Log.Debugf("flushed presence of %d devices", len(pending))
+	return nil
+}
+
+// Run flushes the buffered presences every interval until the context is done
+func (p *PresenceTracker) Run(ctx context.Context, database *db.Sqlite, interval time.Duration) {
+	util.Every(ctx, interval, func() {
+		if err := p.Flush(database); err != nil {
+			util.Log.Error(err)
+		}
+	})
+}
+
+// deviceStatus from the time a device was last seen
+func deviceStatus(lastSeenAt *time.Time) string {
+	if lastSeenAt == nil {
+		return DeviceStatusOffline
+	}
+	since := time.Since(*lastSeenAt)
+	switch {
+	case since < config.StatusStaleAfter:
+		return DeviceStatusOnline
+	case since < config.StatusOfflineAfter:
+		return DeviceStatusStale
+	}
+	return DeviceStatusOffline
+}
@@ -0,0 +1,63 @@
+package business
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Scopes an accesstoken can be limited to
+const (
+	ScopeDataRead     = "data:read"
+	ScopeDataWrite    = "data:write"
+	ScopeDeviceRead   = "device:read"
+	ScopeDeviceWrite  = "device:write"
+	ScopeDeviceDelete = "device:delete"
+)
+
+// Scopes are all known scopes, tokens get all of them unless fewer are requested
+var Scopes = []string{ScopeDataRead, ScopeDataWrite, ScopeDeviceRead, ScopeDeviceWrite, ScopeDeviceDelete}
+
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		known := false
+		for _, s := range Scopes {
+			if scope == s {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown scope '%s'", scope)
+		}
+	}
+	return nil
+}
+
+// encodeScopes for storage, separated by spaces like oauth scopes
+func encodeScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+// storedScopes decodes the scopes of a token, tokens from before scopes were introduced have all of them
+func storedScopes(scopes sql.NullString) []string {
+	if !scopes.Valid {
+		return Scopes
+	}
+	return strings.Fields(scopes.String)
+}
+
+// containsScope checks if a scope is one of scopes
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope checks if an accesstoken was granted a scope
+func (a *Accesstoken) HasScope(scope string) bool {
+	return containsScope(a.Scopes, scope)
+}
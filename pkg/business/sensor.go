@@ -0,0 +1,222 @@
+package business
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gitlab.void-ptr.org/go/reflection/pkg/sensors"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// SensorField is a single value a sensor measures
+type SensorField struct {
+	Name     string `json:"name"`
+	Unit     string `json:"unit"`
+	UnitName string `json:"unit_name"`
+}
+
+// DeviceSensor is a sensor a device declared in its inventory
+type DeviceSensor struct {
+	DeviceId   string              `json:"device_id"`
+	Name       string              `json:"name"`
+	SensorType *sensors.SensorType `json:"sensor_type"`
+	Fields     []SensorField       `json:"fields"`
+	// Interval is the sampling interval in seconds
+	Interval  *int      `json:"interval"`
+	UpdatedAt time.Time `json:"date_updated"`
+}
+
+// SensorInventory lists the sensors a device has, published by the device itself
+type SensorInventory struct {
+	Database *db.Sqlite      `json:"-"`
+	DeviceId string          `json:"device_id"`
+	Sensors  []*DeviceSensor `json:"sensors"`
+}
+
+type SensorInventoryUpdate struct {
+	Sensors []*DeviceSensor `json:"sensors"`
+}
+
+func NewSensorInventory(deviceId string, database *db.Sqlite) *SensorInventory {
+	return &SensorInventory{DeviceId: deviceId, Database: database}
+}
+
+const sensorColumns = "device_id, name, sensor_type, fields, interval_seconds, date_updated"
+
+// Read sensor inventory, a device that never published one has no sensors
+func (i *SensorInventory) Read() (*SensorInventory, int, error) {
+	device := NewDevice(&i.DeviceId, i.Database)
+	if _, status, err := device.Read(); err != nil {
+		return nil, status, err
+	}
+
+	deviceSensors, err := querySensors(i.Database, fmt.Sprintf("SELECT %s FROM device_sensors WHERE device_id = ? ORDER BY name", sensorColumns), i.DeviceId)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	i.Sensors = deviceSensors
+	return i, http.StatusOK, nil
+}
+
+// Replace the whole sensor inventory of a device
+func (i *SensorInventory) Replace(update *SensorInventoryUpdate) (*SensorInventory, int, error) {
+	device := NewDevice(&i.DeviceId, i.Database)
+	if _, status, err := device.Read(); err != nil {
+		return nil, status, err
+	}
+
+	names := map[string]bool{}
+	for _, sensor := range update.Sensors {
+		if sensor == nil || len(sensor.Name) == 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("every sensor needs a name")
+		}
+		if names[sensor.Name] {
+			return nil, http.StatusBadRequest, fmt.Errorf("sensor '%s' is declared twice", sensor.Name)
+		}
+		names[sensor.Name] = true
+		if sensor.Interval != nil && *sensor.Interval <= 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid interval for sensor '%s'", sensor.Name)
+		}
+	}
+
+	tx, err := i.Database.Begin()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM device_sensors WHERE device_id = ?", i.DeviceId)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO device_sensors (%s) VALUES (?, ?, ?, ?, ?, ?)", sensorColumns))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer stmt.Close()
+
+	tNow := time.Now()
+	now := tNow.UTC().Format(db.SqliteDateLayout)
+	for _, sensor := range update.Sensors {
+		if sensor.Fields == nil {
+			sensor.Fields = []SensorField{}
+		}
+		fields, err := json.Marshal(sensor.Fields)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("marshal error")
+		}
+		_, err = stmt.Exec(i.DeviceId, sensor.Name, sensor.SensorType, string(fields), sensor.Interval, now)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		sensor.DeviceId = i.DeviceId
+		sensor.UpdatedAt = tNow
+	}
+	if err := tx.Commit(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	i.Sensors = update.Sensors
+	return i, http.StatusOK, nil
+}
+
+// FindSensors lists the declared sensors of all devices, optionally only those of a sensor type
+func FindSensors(database *db.Sqlite, sensorType *sensors.SensorType) ([]*DeviceSensor, int, error) {
+	query := fmt.Sprintf(`SELECT %s FROM device_sensors
+		WHERE device_id IN ( SELECT id FROM devices WHERE date_deleted IS NULL )`, sensorColumns)
+	args := []interface{}{}
+	if sensorType != nil {
+		query += " AND sensor_type = ?"
+		args = append(args, *sensorType)
+	}
+	query += " ORDER BY device_id, name"
+
+	deviceSensors, err := querySensors(database, query, args...)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return deviceSensors, http.StatusOK, nil
+}
+
+func querySensors(database *db.Sqlite, query string, args ...interface{}) ([]*DeviceSensor, error) {
+	stmt, err := database.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deviceSensors := []*DeviceSensor{}
+	for rows.Next() {
+		sensor := &DeviceSensor{}
+		var fields, date_updated string
+		var sensor_type, interval_seconds sql.NullInt64
+		err = rows.Scan(&sensor.DeviceId, &sensor.Name, &sensor_type, &fields, &interval_seconds, &date_updated)
+		if err != nil {
+			return nil, err
+		}
+		if sensor_type.Valid {
+			t := sensors.SensorType(sensor_type.Int64)
+			sensor.SensorType = &t
+		}
+		if interval_seconds.Valid {
+			interval := int(interval_seconds.Int64)
+			sensor.Interval = &interval
+		}
+		if err := json.Unmarshal([]byte(fields), &sensor.Fields); err != nil {
+			return nil, err
+		}
+		sensor.UpdatedAt, err = time.Parse(db.SqliteDateLayout, date_updated)
+		if err != nil {
+			return nil, err
+		}
+		deviceSensors = append(deviceSensors, sensor)
+	}
+	return deviceSensors, rows.Err()
+}
+
+// declaredSensors maps the sensor names of a device inventory to their types, nil without an inventory
+func declaredSensors(database *db.Sqlite, deviceId string) (map[string]*sensors.SensorType, error) {
+	deviceSensors, err := querySensors(database, fmt.Sprintf("SELECT %s FROM device_sensors WHERE device_id = ?", sensorColumns), deviceId)
+	if err != nil {
+		return nil, err
+	}
+	if len(deviceSensors) == 0 {
+		return nil, nil
+	}
+	declared := map[string]*sensors.SensorType{}
+	for _, sensor := range deviceSensors {
+		declared[sensor.Name] = sensor.SensorType
+	}
+	return declared, nil
+}
+
+// isDeclared checks a payload against an inventory, devices without one are not checked
+func isDeclared(declared map[string]*sensors.SensorType, sensorName *string, sensorType *sensors.SensorType) bool {
+	if declared == nil {
+		return true
+	}
+	if sensorName == nil {
+		return false
+	}
+	declaredType, ok := declared[*sensorName]
+	if !ok {
+		return false
+	}
+	return declaredType == nil || sensorType == nil || *declaredType == *sensorType
+}
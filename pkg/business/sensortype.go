@@ -0,0 +1,493 @@
+package business
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.void-ptr.org/go/reflection/pkg/sensors"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// Value types of sensor type fields, all are written as numbers with booleans as 0 and 1
+const (
+	SensorValueFloat   = "float"
+	SensorValueInteger = "integer"
+	SensorValueBoolean = "boolean"
+)
+
+var sensorValueTypes = map[string]bool{SensorValueFloat: true, SensorValueInteger: true, SensorValueBoolean: true}
+
+// sensorTypeNamePattern limits the names of sensor types, they are sent by devices in sensor.type
+var sensorTypeNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// SensorTypeField maps a value in the payload to a field, the unit is the default for payloads without one
+type SensorTypeField struct {
+	SensorField
+	// Path of the value in the payload, keys separated by dots and array indexes as numbers, e.g. readings.co2
+	Path      string `json:"path"`
+	ValueType string `json:"value_type"`
+}
+
+// SensorTypeDefinition describes how the payloads of a sensor type are parsed, builtin ones are those compiled into reflection
+type SensorTypeDefinition struct {
+	Database *db.Sqlite `json:"-"`
+	Name     string     `json:"name"`
+	// SensorType is the number of a builtin type, custom types are named in sensor.type of the payload instead
+	SensorType *sensors.SensorType `json:"sensor_type"`
+	Builtin    bool                `json:"builtin"`
+	Fields     []SensorTypeField   `json:"fields"`
+	CreatedAt  time.Time           `json:"date_created"`
+	UpdatedAt  time.Time           `json:"date_updated"`
+	Auditor    *Auditor            `json:"-"`
+}
+
+type SensorTypeCreate struct {
+	Name   string            `json:"name"`
+	Fields []SensorTypeField `json:"fields"`
+}
+
+type SensorTypeUpdate struct {
+	Fields []SensorTypeField `json:"fields"`
+}
+
+// builtinSensorTypes are the sensor types compiled into reflection, their fields are read from the payload structs
+var builtinSensorTypes = []struct {
+	sensorType sensors.SensorType
+	payload    interface{}
+}{
+	{sensors.SensorType_BMP, sensors.BMPSensorData{}},
+	{sensors.SensorType_SI1145, sensors.SI1145SensorData{}},
+	{sensors.SensorType_NU40C16, sensors.NU40C16SensorData{}},
+	{sensors.SensorType_SoilMoisture, sensors.SoilMoistureSensorData{}},
+	{sensors.SensorType_AirQuality, sensors.AirQualitySensorData{}},
+	{sensors.SensorType_Loudness, sensors.LoudnessSensorData{}},
+}
+
+func NewSensorTypeDefinition(name string, database *db.Sqlite) *SensorTypeDefinition {
+	return &SensorTypeDefinition{Name: name, Database: database}
+}
+
+// builtinDefinition reflects over a payload struct, every sensor value is a field named like the struct field
+// at the path of its json tag, e.g. BMPSensorData becomes bmp
+func builtinDefinition(sensorType sensors.SensorType, payload interface{}) *SensorTypeDefinition {
+	t := reflect.TypeOf(payload)
+	valueType := reflect.TypeOf(&sensors.SensorValue{})
+	definition := &SensorTypeDefinition{
+		Name:       strings.ToLower(strings.TrimSuffix(t.Name(), "SensorData")),
+		SensorType: &sensorType,
+		Builtin:    true,
+		Fields:     []SensorTypeField{},
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Type != valueType {
+			continue
+		}
+		path := strings.Split(field.Tag.Get("json"), ",")[0]
+		if len(path) == 0 || path == "-" {
+			path = field.Name
+		}
+		definition.Fields = append(definition.Fields, SensorTypeField{
+			SensorField: SensorField{Name: strings.ToLower(field.Name[:1]) + field.Name[1:]},
+			Path:        path,
+			ValueType:   SensorValueFloat,
+		})
+	}
+	return definition
+}
+
+// LoadBuiltinSensorTypes writes the definitions of the builtin sensor types, updating those of older versions
+func LoadBuiltinSensorTypes(database *db.Sqlite) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Format(db.SqliteDateLayout)
+	for _, builtin := range builtinSensorTypes {
+		definition := builtinDefinition(builtin.sensorType, builtin.payload)
+		fields, err := json.Marshal(definition.Fields)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf(`INSERT INTO sensor_types (%s) VALUES (?, ?, 1, ?, ?, ?)
+			ON CONFLICT ( name ) DO UPDATE SET sensor_type = excluded.sensor_type, builtin = 1, fields = excluded.fields, date_updated = excluded.date_updated`,
+			sensorTypeColumns), definition.Name, int(builtin.sensorType), string(fields), now, now)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	sensorTypes.invalidate()
+	return nil
+}
+
+// validateSensorTypeFields of a custom sensor type, filling in the default path and value type
+func validateSensorTypeFields(fields []SensorTypeField) error {
+	if len(fields) == 0 {
+		return fmt.Errorf("a sensor type needs at least one field")
+	}
+	names := map[string]bool{}
+	for i := range fields {
+		field := &fields[i]
+		if len(field.Name) == 0 || field.Name == "sensor" {
+			return fmt.Errorf("invalid field name '%s'", field.Name)
+		}
+		if names[field.Name] {
+			return fmt.Errorf("field '%s' is defined twice", field.Name)
+		}
+		names[field.Name] = true
+		field.Path = strings.TrimPrefix(field.Path, "$.")
+		if len(field.Path) == 0 {
+			field.Path = field.Name
+		}
+		if len(field.ValueType) == 0 {
+			field.ValueType = SensorValueFloat
+		}
+		if !sensorValueTypes[field.ValueType] {
+			return fmt.Errorf("invalid value type '%s' of field '%s'", field.ValueType, field.Name)
+		}
+	}
+	return nil
+}
+
+// Create a custom sensor type
+func (s *SensorTypeDefinition) Create(create *SensorTypeCreate) (*SensorTypeDefinition, int, error) {
+	if !sensorTypeNamePattern.MatchString(create.Name) {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid sensor type name '%s'", create.Name)
+	}
+	if err := validateSensorTypeFields(create.Fields); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	fields, err := json.Marshal(create.Fields)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("marshal error")
+	}
+
+	stmt, err := s.Database.Prepare(fmt.Sprintf("INSERT INTO sensor_types (%s) VALUES (?, NULL, 0, ?, ?, ?)", sensorTypeColumns))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	tNow := time.Now()
+	now := tNow.UTC().Format(db.SqliteDateLayout)
+	_, err = stmt.Exec(create.Name, string(fields), now, now)
+	if err != nil && isUniqueViolation(err) {
+		return nil, http.StatusConflict, fmt.Errorf("sensor type '%s' already exists", create.Name)
+	}
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	s.Name = create.Name
+	s.Fields = create.Fields
+	s.CreatedAt = tNow
+	s.UpdatedAt = tNow
+	sensorTypes.invalidate()
+	s.Auditor.recordAfter(s.Database, AuditCreate, AuditResourceSensorType, s.Name, "", nil, s.Fields)
+	return s, http.StatusCreated, nil
+}
+
+const sensorTypeColumns = "name, sensor_type, builtin, fields, date_created, date_updated"
+
+func scanSensorType(row rowScanner, database *db.Sqlite) (*SensorTypeDefinition, error) {
+	definition := &SensorTypeDefinition{Database: database}
+	var sensor_type sql.NullInt64
+	var fields, date_created, date_updated string
+	err := row.Scan(&definition.Name, &sensor_type, &definition.Builtin, &fields, &date_created, &date_updated)
+	if err != nil {
+		return nil, err
+	}
+	if sensor_type.Valid {
+		t := sensors.SensorType(sensor_type.Int64)
+		definition.SensorType = &t
+	}
+	if err := json.Unmarshal([]byte(fields), &definition.Fields); err != nil {
+		return nil, err
+	}
+	definition.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
+	if err != nil {
+		return nil, err
+	}
+	definition.UpdatedAt, err = time.Parse(db.SqliteDateLayout, date_updated)
+	if err != nil {
+		return nil, err
+	}
+	return definition, nil
+}
+
+// Read sensor type
+func (s *SensorTypeDefinition) Read() (*SensorTypeDefinition, int, error) {
+	stmt, err := s.Database.Prepare(fmt.Sprintf("SELECT %s FROM sensor_types WHERE name = ?", sensorTypeColumns))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	definition, err := scanSensorType(stmt.QueryRow(s.Name), s.Database)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, http.StatusNotFound, fmt.Errorf("sensor type '%s' does not exist", s.Name)
+	case err != nil:
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	definition.Auditor = s.Auditor
+	return definition, http.StatusOK, nil
+}
+
+// List sensor types, builtin ones first
+func (s *SensorTypeDefinition) List() ([]*SensorTypeDefinition, int, error) {
+	definitions, err := querySensorTypes(s.Database)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return definitions, http.StatusOK, nil
+}
+
+// Update replaces the fields of a custom sensor type
+func (s *SensorTypeDefinition) Update(update *SensorTypeUpdate) (*SensorTypeDefinition, int, error) {
+	definition, status, err := s.Read()
+	if err != nil {
+		return nil, status, err
+	}
+	if definition.Builtin {
+		return nil, http.StatusConflict, fmt.Errorf("builtin sensor type '%s' can not be changed", definition.Name)
+	}
+	if err := validateSensorTypeFields(update.Fields); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	fields, err := json.Marshal(update.Fields)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("marshal error")
+	}
+
+	stmt, err := s.Database.Prepare("UPDATE sensor_types SET fields = ?, date_updated = ? WHERE name = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	tNow := time.Now()
+	_, err = stmt.Exec(string(fields), tNow.UTC().Format(db.SqliteDateLayout), definition.Name)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	before := definition.Fields
+	definition.Fields = update.Fields
+	definition.UpdatedAt = tNow
+	sensorTypes.invalidate()
+	s.Auditor.recordAfter(s.Database, AuditUpdate, AuditResourceSensorType, definition.Name, "", before, definition.Fields)
+	return definition, http.StatusOK, nil
+}
+
+// Delete a custom sensor type, payloads naming it are decoded generically afterwards
+func (s *SensorTypeDefinition) Delete() (*SensorTypeDefinition, int, error) {
+	definition, status, err := s.Read()
+	if err != nil {
+		return nil, status, err
+	}
+	if definition.Builtin {
+		return nil, http.StatusConflict, fmt.Errorf("builtin sensor type '%s' can not be deleted", definition.Name)
+	}
+	stmt, err := s.Database.Prepare("DELETE FROM sensor_types WHERE name = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	_, err = stmt.Exec(definition.Name)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	sensorTypes.invalidate()
+	s.Auditor.recordAfter(s.Database, AuditDelete, AuditResourceSensorType, definition.Name, "", definition.Fields, nil)
+	return definition, http.StatusOK, nil
+}
+
+func querySensorTypes(database *db.Sqlite) ([]*SensorTypeDefinition, error) {
+	stmt, err := database.Prepare(fmt.Sprintf("SELECT %s FROM sensor_types ORDER BY builtin DESC, sensor_type, name", sensorTypeColumns))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	definitions := []*SensorTypeDefinition{}
+	for rows.Next() {
+		definition, err := scanSensorType(rows, database)
+		if err != nil {
+			return nil, err
+		}
+		definitions = append(definitions, definition)
+	}
+	return definitions, rows.Err()
+}
+
+// sensorTypeRegistry finds the definitions of payloads, builtin ones by number and custom ones by name
+type sensorTypeRegistry struct {
+	byType map[sensors.SensorType]*SensorTypeDefinition
+	byName map[string]*SensorTypeDefinition
+}
+
+func loadSensorTypeRegistry(database *db.Sqlite) (*sensorTypeRegistry, error) {
+	definitions, err := querySensorTypes(database)
+	if err != nil {
+		return nil, err
+	}
+	registry := &sensorTypeRegistry{byType: map[sensors.SensorType]*SensorTypeDefinition{}, byName: map[string]*SensorTypeDefinition{}}
+	for _, definition := range definitions {
+		if definition.SensorType != nil {
+			registry.byType[*definition.SensorType] = definition
+		}
+		registry.byName[definition.Name] = definition
+	}
+	return registry, nil
+}
+
+// sensorTypeCache keeps the registry between payloads, changes to the definitions invalidate it
+type sensorTypeCache struct {
+	mutex    sync.Mutex
+	registry *sensorTypeRegistry
+}
+
+// sensorTypes used to decode every payload, loaded on first use
+var sensorTypes = &sensorTypeCache{}
+
+// get the cached registry, loading it if none is cached
+func (c *sensorTypeCache) get(database *db.Sqlite) (*sensorTypeRegistry, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.registry == nil {
+		registry, err := loadSensorTypeRegistry(database)
+		if err != nil {
+			return nil, err
+		}
+		c.registry = registry
+	}
+	return c.registry, nil
+}
+
+// invalidate the cached registry after a definition changed
+func (c *sensorTypeCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.registry = nil
+}
+
+// lookupJsonPath finds the value at a path of keys and array indexes separated by dots
+func lookupJsonPath(value interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// convert a payload value to the number written for a value type, booleans may be given as 0 and 1
+func (f *SensorTypeField) convert(value interface{}) (float64, bool) {
+	switch f.ValueType {
+	case SensorValueBoolean:
+		if n, ok := value.(float64); ok {
+			return n, n == 0 || n == 1
+		}
+		b, ok := value.(bool)
+		if !ok {
+			return 0, false
+		}
+		if b {
+			return 1, true
+		}
+		return 0, true
+	case SensorValueInteger:
+		n, ok := value.(float64)
+		return n, ok && n == math.Trunc(n)
+	}
+	n, ok := value.(float64)
+	return n, ok
+}
+
+// Decode a payload into its sensor name and values, fields missing in the payload are skipped.
+// A value is either given directly or as a sensor value object, the units of the field are the default of those.
+func (s *SensorTypeDefinition) Decode(payload string) (*string, map[string]sensors.SensorValue, int, error) {
+	var document map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &document); err != nil {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("payload of sensor type '%s' is no json object", s.Name)
+	}
+
+	var sensorName *string
+	if sensor, ok := document["sensor"].(map[string]interface{}); ok {
+		if name, ok := sensor["name"].(string); ok && len(name) > 0 {
+			sensorName = &name
+		}
+	}
+
+	values := map[string]sensors.SensorValue{}
+	for i := range s.Fields {
+		field := &s.Fields[i]
+		raw, ok := lookupJsonPath(document, field.Path)
+		if !ok || raw == nil {
+			continue
+		}
+		unit, unitName := field.Unit, field.UnitName
+		if object, ok := raw.(map[string]interface{}); ok {
+			var sensorValue sensors.SensorValue
+			encoded, err := json.Marshal(object)
+			if err == nil {
+				err = json.Unmarshal(encoded, &sensorValue)
+			}
+			if err != nil {
+				return nil, nil, http.StatusBadRequest, fmt.Errorf("field '%s' of sensor type '%s' is no sensor value", field.Name, s.Name)
+			}
+			raw = sensorValue.Value
+			if len(sensorValue.Unit) > 0 {
+				unit = sensorValue.Unit
+			}
+			if len(sensorValue.UnitName) > 0 {
+				unitName = sensorValue.UnitName
+			}
+		}
+		value, ok := field.convert(raw)
+		if !ok {
+			return nil, nil, http.StatusBadRequest, fmt.Errorf("field '%s' of sensor type '%s' is no %s", field.Name, s.Name, field.ValueType)
+		}
+		values[field.Name] = sensors.SensorValue{Value: value, Unit: unit, UnitName: unitName}
+	}
+	return sensorName, values, http.StatusCreated, nil
+}
@@ -0,0 +1,113 @@
+package business
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"gitlab.void-ptr.org/go/reflection/pkg/sensors"
+)
+
+func TestLookupJsonPath(t *testing.T) {
+	var document interface{}
+	err := json.Unmarshal([]byte(`{"co2": 412, "readings": {"temperature": [21.5, 22.5], "nested": {"deep": true}}, "empty": null}`), &document)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		want  interface{}
+		found bool
+	}{
+		{"top level", "co2", 412.0, true},
+		{"nested object", "readings.nested.deep", true, true},
+		{"array index", "readings.temperature.1", 22.5, true},
+		{"array index out of range", "readings.temperature.2", nil, false},
+		{"negative array index", "readings.temperature.-1", nil, false},
+		{"key on an array", "readings.temperature.first", nil, false},
+		{"key on a number", "co2.value", nil, false},
+		{"missing key", "readings.humidity", nil, false},
+		{"null", "empty", nil, true},
+		{"empty path", "", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := lookupJsonPath(document, tt.path)
+			if found != tt.found || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lookupJsonPath() = %v, %v, want %v, %v", got, found, tt.want, tt.found)
+			}
+		})
+	}
+}
+
+func TestSensorTypeDefinitionDecode(t *testing.T) {
+	definition := &SensorTypeDefinition{
+		Name: "air",
+		Fields: []SensorTypeField{
+			{SensorField: SensorField{Name: "co2", Unit: "ppm", UnitName: "parts per million"}, Path: "readings.co2", ValueType: SensorValueFloat},
+			{SensorField: SensorField{Name: "count"}, Path: "count", ValueType: SensorValueInteger},
+			{SensorField: SensorField{Name: "open"}, Path: "open", ValueType: SensorValueBoolean},
+		},
+	}
+	name := "living room"
+
+	tests := []struct {
+		name       string
+		payload    string
+		sensorName *string
+		want       map[string]sensors.SensorValue
+		status     int
+	}{
+		{
+			"direct values",
+			`{"sensor": {"name": "living room"}, "readings": {"co2": 412.5}, "count": 3, "open": true}`,
+			&name,
+			map[string]sensors.SensorValue{
+				"co2":   {Value: 412.5, Unit: "ppm", UnitName: "parts per million"},
+				"count": {Value: 3},
+				"open":  {Value: 1},
+			},
+			http.StatusCreated,
+		},
+		{
+			"sensor value objects override the units",
+			`{"readings": {"co2": {"value": 0.04, "unit": "%", "unit_name": "percent"}}, "open": {"value": 0}}`,
+			nil,
+			map[string]sensors.SensorValue{
+				"co2":  {Value: 0.04, Unit: "%", UnitName: "percent"},
+				"open": {Value: 0},
+			},
+			http.StatusCreated,
+		},
+		{
+			"sensor value object keeps the units of the field",
+			`{"readings": {"co2": {"value": 412}}}`,
+			nil,
+			map[string]sensors.SensorValue{"co2": {Value: 412, Unit: "ppm", UnitName: "parts per million"}},
+			http.StatusCreated,
+		},
+		{"missing and null fields are skipped", `{"readings": {"co2": null}, "sensor": {"name": ""}}`, nil, map[string]sensors.SensorValue{}, http.StatusCreated},
+		{"no json object", `[1, 2]`, nil, nil, http.StatusBadRequest},
+		{"string value", `{"readings": {"co2": "412"}}`, nil, nil, http.StatusBadRequest},
+		{"fraction of an integer", `{"count": 1.5}`, nil, nil, http.StatusBadRequest},
+		{"boolean out of range", `{"open": 2}`, nil, nil, http.StatusBadRequest},
+		{"invalid sensor value object", `{"readings": {"co2": {"value": "high"}}}`, nil, nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sensorName, values, status, err := definition.Decode(tt.payload)
+			if status != tt.status {
+				t.Fatalf("Decode() = %d (%v), want %d", status, err, tt.status)
+			}
+			if !reflect.DeepEqual(sensorName, tt.sensorName) {
+				t.Errorf("Decode() sensor name = %v, want %v", sensorName, tt.sensorName)
+			}
+			if !reflect.DeepEqual(values, tt.want) {
+				t.Errorf("Decode() values = %v, want %v", values, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package business
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Session of a logged in user, like accesstokens only the hash of its token is stored
+type Session struct {
+	Database  *db.Sqlite `json:"-"`
+	Id        *string    `json:"id"`
+	Token     *string    `json:"token,omitempty"`
+	User      *User      `json:"user"`
+	ExpiresAt time.Time  `json:"date_expires"`
+	CreatedAt time.Time  `json:"date_created"`
+	Auditor   *Auditor   `json:"-"`
+}
+
+type SessionLogin struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// sessionDummyHash is compared against for unknown users, so they take as long as wrong passwords
+var sessionDummyHash, _ = bcrypt.GenerateFromPassword([]byte("schism-dummy-password"), bcrypt.DefaultCost)
+
+func NewSession(id *string, database *db.Sqlite) *Session {
+	return &Session{Id: id, Database: database}
+}
+
+// auditSession is the audited view of a session, never the token itself
+func auditSession(s *Session) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       s.Id,
+		"user_id":  s.User.Id,
+		"username": s.User.Username,
+	}
+}
+
+// Login a user with its password and start a new session
+func (s *Session) Login(login *SessionLogin) (*Session, int, error) {
+	stmt, err := s.Database.Prepare("SELECT id, password_hash FROM users WHERE username = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	var id, hash string
+	err = stmt.QueryRow(strings.TrimSpace(login.Username)).Scan(&id, &hash)
+	switch {
+	case err == sql.ErrNoRows:
+		bcrypt.CompareHashAndPassword(sessionDummyHash, []byte(login.Password))
+		return nil, http.StatusUnauthorized, fmt.Errorf("invalid username or password")
+	case err != nil:
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(login.Password)) != nil {
+		return nil, http.StatusUnauthorized, fmt.Errorf("invalid username or password")
+	}
+
+	user, status, err := NewUser(&id, s.Database).Read()
+	if err != nil {
+		return nil, status, err
+	}
+
+	u, err := uuid.NewUUID()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("uuid error")
+	}
+	sessionId := u.String()
+	token, err := util.RandomHex(64)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("token error")
+	}
+
+	tNow := time.Now()
+	expires := tNow.Add(config.SessionTTL)
+	stmt, err = s.Database.Prepare("INSERT INTO sessions (id, user_id, token_prefix, token_hash, date_expires, date_created) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	_, err = stmt.Exec(sessionId, id, tokenPrefix(token), hashToken(token),
+		expires.UTC().Format(db.SqliteDateLayout), tNow.UTC().Format(db.SqliteDateLayout))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	s.Id = &sessionId
+	s.Token = &token
+	s.User = user
+	s.ExpiresAt = expires
+	s.CreatedAt = tNow
+	// Nobody is logged in yet, the user itself is the actor of its login
+	auditor := &Auditor{Actor: "user:" + id}
+	if s.Auditor != nil {
+		auditor.RequestId = s.Auditor.RequestId
+	}
+	auditor.recordAfter(s.Database, AuditLogin, AuditResourceSession, sessionId, "", nil, auditSession(s))
+	return s, http.StatusCreated, nil
+}
+
+// Authenticate a session token, expired sessions are rejected
+func (s *Session) Authenticate(token string) (*Session, int, error) {
+	match, err := matchToken(s.Database, "sessions", "token", token, "")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if match == nil {
+		return nil, http.StatusUnauthorized, fmt.Errorf("session does not exist")
+	}
+
+	stmt, err := s.Database.Prepare("SELECT user_id, date_expires, date_created FROM sessions WHERE id = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	var userId, date_expires, date_created string
+	err = stmt.QueryRow(*match).Scan(&userId, &date_expires, &date_created)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	session := NewSession(match, s.Database)
+	session.ExpiresAt, err = time.Parse(db.SqliteDateLayout, date_expires)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+	}
+	session.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+	}
+	if !time.Now().Before(session.ExpiresAt) {
+		return nil, http.StatusUnauthorized, fmt.Errorf("session has expired")
+	}
+
+	session.User, _, err = NewUser(&userId, s.Database).Read()
+	if err != nil {
+		return nil, http.StatusUnauthorized, fmt.Errorf("session does not exist")
+	}
+	return session, http.StatusOK, nil
+}
+
+// Logout ends a session
+func (s *Session) Logout() (*Session, int, error) {
+	if s.Id == nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("no session id given to logout")
+	}
+	stmt, err := s.Database.Prepare("DELETE FROM sessions WHERE id = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	_, err = stmt.Exec(*s.Id)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	s.Token = nil
+	s.Auditor.recordAfter(s.Database, AuditLogout, AuditResourceSession, *s.Id, "", auditSession(s), nil)
+	return s, http.StatusOK, nil
+}
+
+// SweepExpiredSessions removes sessions past their lifetime
+func SweepExpiredSessions(database *db.Sqlite) {
+	stmt, err := database.Prepare("DELETE FROM sessions WHERE date_expires <= ?")
+	if err != nil {
+		util.Log.Error(err)
+		return
+	}
+	_, err = stmt.Exec(time.Now().UTC().Format(db.SqliteDateLayout))
+	if err != nil {
+		util.Log.Error(err)
+	}
+}
@@ -0,0 +1,217 @@
+package business
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// Shadow holds the configuration an admin desires for a device and the one the device reports
+type Shadow struct {
+	Database          *db.Sqlite             `json:"-"`
+	DeviceId          string                 `json:"device_id"`
+	Desired           map[string]interface{} `json:"desired"`
+	DesiredVersion    int64                  `json:"desired_version"`
+	DesiredUpdatedAt  *time.Time             `json:"date_desired_updated"`
+	Reported          map[string]interface{} `json:"reported"`
+	ReportedVersion   int64                  `json:"reported_version"`
+	ReportedUpdatedAt *time.Time             `json:"date_reported_updated"`
+	// Delta of all desired values the device did not report yet
+	Delta map[string]interface{} `json:"delta"`
+}
+
+func NewShadow(deviceId string, database *db.Sqlite) *Shadow {
+	return &Shadow{DeviceId: deviceId, Database: database}
+}
+
+// shadowNotifier wakes up requests waiting for a change of the desired state
+type shadowNotifier struct {
+	mutex   sync.Mutex
+	changed map[string]chan struct{}
+}
+
+var shadowChanges = &shadowNotifier{changed: map[string]chan struct{}{}}
+
+// WatchShadow returns a channel that is closed on the next change of the desired state of a device
+func WatchShadow(deviceId string) <-chan struct{} {
+	shadowChanges.mutex.Lock()
+	defer shadowChanges.mutex.Unlock()
+
+	ch, ok := shadowChanges.changed[deviceId]
+	if !ok {
+		ch = make(chan struct{})
+		shadowChanges.changed[deviceId] = ch
+	}
+	return ch
+}
+
+func (n *shadowNotifier) notify(deviceId string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if ch, ok := n.changed[deviceId]; ok {
+		close(ch)
+		delete(n.changed, deviceId)
+	}
+}
+
+// Read shadow, a device without one has an empty shadow at version 0
+func (s *Shadow) Read() (*Shadow, int, error) {
+	device := NewDevice(&s.DeviceId, s.Database)
+	if _, status, err := device.Read(); err != nil {
+		return nil, status, err
+	}
+
+	stmt, err := s.Database.Prepare(`SELECT desired, desired_version, date_desired_updated, reported, reported_version, date_reported_updated
+		FROM device_shadows WHERE device_id = ?`)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	shadow := NewShadow(s.DeviceId, s.Database)
+	shadow.Desired = map[string]interface{}{}
+	shadow.Reported = map[string]interface{}{}
+
+	var desired, reported string
+	var date_desired_updated, date_reported_updated sql.NullString
+	err = stmt.QueryRow(s.DeviceId).Scan(&desired, &shadow.DesiredVersion, &date_desired_updated, &reported, &shadow.ReportedVersion, &date_reported_updated)
+	switch {
+	case err == sql.ErrNoRows:
+		shadow.Delta = map[string]interface{}{}
+		return shadow, http.StatusOK, nil
+	case err != nil:
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	if err := json.Unmarshal([]byte(desired), &shadow.Desired); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("unmarshal error")
+	}
+	if err := json.Unmarshal([]byte(reported), &shadow.Reported); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("unmarshal error")
+	}
+	for _, date := range []struct {
+		value  sql.NullString
+		target **time.Time
+	}{
+		{date_desired_updated, &shadow.DesiredUpdatedAt},
+		{date_reported_updated, &shadow.ReportedUpdatedAt},
+	} {
+		if !date.value.Valid {
+			continue
+		}
+		t, err := time.Parse(db.SqliteDateLayout, date.value.String)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+		}
+		*date.target = &t
+	}
+	shadow.Delta = shadowDelta(shadow.Desired, shadow.Reported)
+
+	return shadow, http.StatusOK, nil
+}
+
+// UpdateDesired replaces the desired state and bumps its version, with a version it is only replaced if that is still the current one
+func (s *Shadow) UpdateDesired(desired map[string]interface{}, version *int64) (*Shadow, int, error) {
+	status, err := s.write("desired", desired, version)
+	if err != nil {
+		return nil, status, err
+	}
+	shadowChanges.notify(s.DeviceId)
+	return s.Read()
+}
+
+// UpdateReported replaces the reported state and bumps its version
+func (s *Shadow) UpdateReported(reported map[string]interface{}) (*Shadow, int, error) {
+	status, err := s.write("reported", reported, nil)
+	if err != nil {
+		return nil, status, err
+	}
+	return s.Read()
+}
+
+// write one side of the shadow, side is either desired or reported. With a version the write is conditional,
+// a shadow without a row is at version 0.
+func (s *Shadow) write(side string, state map[string]interface{}, version *int64) (int, error) {
+	if state == nil {
+		return http.StatusBadRequest, fmt.Errorf("the %s state must be a json object", side)
+	}
+	device := NewDevice(&s.DeviceId, s.Database)
+	if _, status, err := device.Read(); err != nil {
+		return status, err
+	}
+
+	bytes, err := json.Marshal(state)
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("marshal error")
+	}
+
+	now := time.Now().UTC().Format(db.SqliteDateLayout)
+	query := `INSERT INTO device_shadows (device_id, %[1]s, %[1]s_version, date_%[1]s_updated) VALUES (?, ?, 1, ?)
+		ON CONFLICT (device_id) DO UPDATE SET %[1]s = excluded.%[1]s, %[1]s_version = %[1]s_version + 1, date_%[1]s_updated = excluded.date_%[1]s_updated`
+	args := []interface{}{s.DeviceId, string(bytes), now}
+	switch {
+	case version != nil && *version == 0:
+		query += " WHERE %[1]s_version = 0"
+	case version != nil:
+		query = `UPDATE device_shadows SET %[1]s = ?, %[1]s_version = %[1]s_version + 1, date_%[1]s_updated = ?
+			WHERE device_id = ? AND %[1]s_version = ?`
+		args = []interface{}{string(bytes), now, s.DeviceId, *version}
+	}
+
+	stmt, err := s.Database.Prepare(fmt.Sprintf(query, side))
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	result, err := stmt.Exec(args...)
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if rows != 1 {
+		return http.StatusPreconditionFailed, fmt.Errorf("%s state was changed in the meantime", side)
+	}
+	return http.StatusOK, nil
+}
+
+// shadowDelta collects all desired values that differ from the reported ones, nested objects are compared per key
+func shadowDelta(desired map[string]interface{}, reported map[string]interface{}) map[string]interface{} {
+	delta := map[string]interface{}{}
+	for key, want := range desired {
+		have, ok := reported[key]
+		if !ok {
+			delta[key] = want
+			continue
+		}
+		wantObject, wantIsObject := want.(map[string]interface{})
+		haveObject, haveIsObject := have.(map[string]interface{})
+		if wantIsObject && haveIsObject {
+			if nested := shadowDelta(wantObject, haveObject); len(nested) > 0 {
+				delta[key] = nested
+			}
+			continue
+		}
+		if !reflect.DeepEqual(want, have) {
+			delta[key] = want
+		}
+	}
+	return delta
+}
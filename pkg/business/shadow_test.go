@@ -0,0 +1,68 @@
+package business
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestShadowUpdateDesired(t *testing.T) {
+	database := testDatabase(t)
+	testDevice(t, database, "device", "b8:27:eb:00:00:01")
+	version := func(v int64) *int64 { return &v }
+
+	// Steps run in order on the same shadow
+	steps := []struct {
+		name     string
+		side     string
+		state    map[string]interface{}
+		version  *int64
+		status   int
+		desired  int64
+		reported int64
+	}{
+		{"stale version of a new shadow", "desired", map[string]interface{}{"interval": 60.0}, version(1), http.StatusPreconditionFailed, 0, 0},
+		{"first version", "desired", map[string]interface{}{"interval": 60.0}, version(0), http.StatusOK, 1, 0},
+		{"first version again", "desired", map[string]interface{}{"interval": 30.0}, version(0), http.StatusPreconditionFailed, 1, 0},
+		{"current version", "desired", map[string]interface{}{"interval": 30.0}, version(1), http.StatusOK, 2, 0},
+		{"stale version", "desired", map[string]interface{}{"interval": 10.0}, version(1), http.StatusPreconditionFailed, 2, 0},
+		{"reported keeps the desired version", "reported", map[string]interface{}{"interval": 60.0}, nil, http.StatusOK, 2, 1},
+		{"without version", "desired", map[string]interface{}{"interval": 30.0, "led": true}, nil, http.StatusOK, 3, 1},
+		{"no json object", "desired", nil, nil, http.StatusBadRequest, 3, 1},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			shadow := NewShadow("device", database)
+			var status int
+			var err error
+			if step.side == "desired" {
+				_, status, err = shadow.UpdateDesired(step.state, step.version)
+			} else {
+				_, status, err = shadow.UpdateReported(step.state)
+			}
+			if status != step.status {
+				t.Fatalf("update of the %s state = %d (%v), want %d", step.side, status, err, step.status)
+			}
+
+			current, _, err := shadow.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if current.DesiredVersion != step.desired || current.ReportedVersion != step.reported {
+				t.Errorf("Read() versions = %d and %d, want %d and %d", current.DesiredVersion, current.ReportedVersion, step.desired, step.reported)
+			}
+		})
+	}
+
+	shadow, _, err := NewShadow("device", database).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"interval": 30.0, "led": true}; !reflect.DeepEqual(shadow.Delta, want) {
+		t.Errorf("Read() delta = %v, want %v", shadow.Delta, want)
+	}
+
+	if _, status, _ := NewShadow("unknown", database).UpdateDesired(map[string]interface{}{}, nil); status != http.StatusNotFound {
+		t.Errorf("UpdateDesired() of an unknown device = %d, want %d", status, http.StatusNotFound)
+	}
+}
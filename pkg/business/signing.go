@@ -0,0 +1,309 @@
+package business
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// Limits of the nonce of a signed request
+const (
+	signatureNonceMinLength = 8
+	signatureNonceMaxLength = 64
+)
+
+// SigningKey of a device, once a device has one all its authenticated requests have to be signed with it.
+// Unlike tokens the key has to be known to verify signatures, so it is stored sealed instead of hashed.
+type SigningKey struct {
+	Database *db.Sqlite `json:"-"`
+	DeviceId string     `json:"device_id"`
+	// Key is only handed out on creation
+	Key       *string   `json:"key,omitempty"`
+	CreatedAt time.Time `json:"date_created"`
+	Auditor   *Auditor  `json:"-"`
+}
+
+// SignedRequest are the parts of a request covered by its signature
+type SignedRequest struct {
+	Method    string
+	Uri       string
+	Timestamp string
+	Nonce     string
+	Body      []byte
+	Signature string
+}
+
+func NewSigningKey(deviceId string, database *db.Sqlite) *SigningKey {
+	return &SigningKey{DeviceId: deviceId, Database: database}
+}
+
+// signingKeyName the key of a device is sealed under
+func signingKeyName(deviceId string) string {
+	return "signing_key:" + deviceId
+}
+
+// SignaturePayload is the string a device signs: method, request uri, unix timestamp, nonce and the sha256 of the body, one per line
+func SignaturePayload(method, uri, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return fmt.Sprintf("%s\n%s\n%s\n%s\n%s", method, uri, timestamp, nonce, hex.EncodeToString(bodyHash[:]))
+}
+
+// sign a payload with a key, hex encoded
+func sign(key string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Create a new signing key for the device, an existing one is replaced
+func (k *SigningKey) Create() (*SigningKey, int, error) {
+	device := NewDevice(&k.DeviceId, k.Database)
+	if _, status, err := device.Read(); err != nil {
+		return nil, status, err
+	}
+
+	key, err := util.RandomHex(32)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("key error")
+	}
+	sealed, err := sealPrivateKey(signingKeyName(k.DeviceId), []byte(key))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("key error")
+	}
+
+	_, status, err := k.Read()
+	action := AuditUpdate
+	switch {
+	case status == http.StatusNotFound:
+		action = AuditCreate
+	case err != nil:
+		return nil, status, err
+	}
+
+	stmt, err := k.Database.Prepare("INSERT OR REPLACE INTO device_signing_keys (device_id, key, date_created) VALUES (?, ?, ?)")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	tNow := time.Now()
+	_, err = stmt.Exec(k.DeviceId, sealed, tNow.UTC().Format(db.SqliteDateLayout))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	k.Key = &key
+	k.CreatedAt = tNow
+	k.Auditor.recordAfter(k.Database, action, AuditResourceSigningKey, k.DeviceId, k.DeviceId, nil, map[string]interface{}{"date_created": tNow})
+	return k, http.StatusCreated, nil
+}
+
+// Read when the signing key of a device was created, never the key itself
+func (k *SigningKey) Read() (*SigningKey, int, error) {
+	stmt, err := k.Database.Prepare("SELECT date_created FROM device_signing_keys WHERE device_id = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	var date_created string
+	err = stmt.QueryRow(k.DeviceId).Scan(&date_created)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, http.StatusNotFound, fmt.Errorf("device '%s' has no signing key", k.DeviceId)
+	case err != nil:
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	key := NewSigningKey(k.DeviceId, k.Database)
+	key.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+	}
+	return key, http.StatusOK, nil
+}
+
+// Delete the signing key, the device may send unsigned requests again
+func (k *SigningKey) Delete() (*SigningKey, int, error) {
+	key, status, err := k.Read()
+	if err != nil {
+		return nil, status, err
+	}
+	stmt, err := k.Database.Prepare("DELETE FROM device_signing_keys WHERE device_id = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	_, err = stmt.Exec(k.DeviceId)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	k.Auditor.recordAfter(k.Database, AuditDelete, AuditResourceSigningKey, k.DeviceId, k.DeviceId,
+		map[string]interface{}{"date_created": key.CreatedAt}, nil)
+	return key, http.StatusOK, nil
+}
+
+// Exists checks if the device has a signing key, without one its requests are not read for a signature
+func (k *SigningKey) Exists() (bool, int, error) {
+	stmt, err := k.Database.Prepare("SELECT count(*) FROM device_signing_keys WHERE device_id = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return false, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	var count int
+	err = stmt.QueryRow(k.DeviceId).Scan(&count)
+	if err != nil {
+		util.Log.Error(err)
+		return false, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return count > 0, http.StatusOK, nil
+}
+
+// Verify the signature of a request of the device, devices without a signing key may send unsigned requests
+func (k *SigningKey) Verify(request *SignedRequest) (int, error) {
+	stmt, err := k.Database.Prepare("SELECT key FROM device_signing_keys WHERE device_id = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	var sealed string
+	err = stmt.QueryRow(k.DeviceId).Scan(&sealed)
+	switch {
+	case err == sql.ErrNoRows:
+		if len(request.Signature) > 0 {
+			return http.StatusBadRequest, fmt.Errorf("device has no signing key")
+		}
+		return http.StatusOK, nil
+	case err != nil:
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	if len(request.Signature) == 0 {
+		return http.StatusUnauthorized, fmt.Errorf("request is not signed")
+	}
+	opened, err := openPrivateKey(signingKeyName(k.DeviceId), sealed)
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("key error")
+	}
+	key := string(opened)
+	unix, err := strconv.ParseInt(request.Timestamp, 10, 64)
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("invalid signature timestamp")
+	}
+	if skew := time.Since(time.Unix(unix, 0)); math.Abs(float64(skew)) > float64(config.SignatureWindow) {
+		return http.StatusUnauthorized, fmt.Errorf("signature timestamp is outside of the allowed window")
+	}
+	if len(request.Nonce) < signatureNonceMinLength || len(request.Nonce) > signatureNonceMaxLength {
+		return http.StatusUnauthorized, fmt.Errorf("invalid signature nonce")
+	}
+
+	expected := sign(key, SignaturePayload(request.Method, request.Uri, request.Timestamp, request.Nonce, request.Body))
+	if !hmac.Equal([]byte(expected), []byte(request.Signature)) {
+		return http.StatusUnauthorized, fmt.Errorf("invalid signature")
+	}
+
+	// Only valid signatures use up a nonce, others could block it for the device
+	if !Nonces.Use(k.DeviceId+":"+request.Nonce, time.Unix(unix, 0).Add(config.SignatureWindow)) {
+		return http.StatusUnauthorized, fmt.Errorf("signature nonce was already used")
+	}
+	return http.StatusOK, nil
+}
+
+// SealSigningKeys encrypts the signing keys stored in clear text by older versions
+func SealSigningKeys(database *db.Sqlite) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT device_id, key FROM device_signing_keys")
+	if err != nil {
+		return err
+	}
+	plain := map[string]string{}
+	for rows.Next() {
+		var deviceId, key string
+		if err := rows.Scan(&deviceId, &key); err != nil {
+			rows.Close()
+			return err
+		}
+		if !isSealed(key) {
+			plain[deviceId] = key
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for deviceId, key := range plain {
+		sealed, err := sealPrivateKey(signingKeyName(deviceId), []byte(key))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE device_signing_keys SET key = ? WHERE device_id = ?", sealed, deviceId); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(plain) > 0 {
+		util.Log.Infof("sealed %d clear text signing keys", len(plain))
+	}
+	return nil
+}
+
+// NonceCache remembers used nonces until their signed timestamp leaves the window
+type NonceCache struct {
+	mutex     sync.Mutex
+	used      map[string]time.Time
+	lastPrune time.Time
+}
+
+// Nonces used by all devices
+var Nonces = NewNonceCache()
+
+func NewNonceCache() *NonceCache {
+	return &NonceCache{used: map[string]time.Time{}, lastPrune: time.Now()}
+}
+
+// Use a nonce until it expires, false if it is already in use
+func (c *NonceCache) Use(nonce string, expires time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	tNow := time.Now()
+	if tNow.Sub(c.lastPrune) > config.SignatureWindow {
+		for n, until := range c.used {
+			if tNow.After(until) {
+				delete(c.used, n)
+			}
+		}
+		c.lastPrune = tNow
+	}
+
+	if until, ok := c.used[nonce]; ok && !tNow.After(until) {
+		return false
+	}
+	c.used[nonce] = expires
+	return true
+}
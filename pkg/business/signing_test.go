@@ -0,0 +1,90 @@
+package business
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/config"
+)
+
+func TestSigningKeyVerify(t *testing.T) {
+	testPepper(t, "pepper")
+	database := testDatabase(t)
+	Nonces = NewNonceCache()
+	const key = "0123456789abcdef0123456789abcdef"
+	// Keys are stored in clear text like older versions did and sealed on startup
+	for _, deviceId := range []string{"signed", "second"} {
+		testExec(t, database, "INSERT INTO device_signing_keys (device_id, key, date_created) VALUES (?, ?, '')", deviceId, key)
+	}
+	if err := SealSigningKeys(database); err != nil {
+		t.Fatal(err)
+	}
+	// Running it again must not seal the sealed keys
+	if err := SealSigningKeys(database); err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := database.Prepare("SELECT count(*) FROM device_signing_keys WHERE key = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plain int
+	if err := stmt.QueryRow(key).Scan(&plain); err != nil {
+		t.Fatal(err)
+	}
+	if plain != 0 {
+		t.Errorf("%d signing keys are stored in clear text, want 0", plain)
+	}
+
+	// signed builds a request of the device signed with its key
+	signed := func(at time.Time, nonce string, body string) *SignedRequest {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		return &SignedRequest{
+			Method:    "POST",
+			Uri:       "/data",
+			Timestamp: timestamp,
+			Nonce:     nonce,
+			Body:      []byte(body),
+			Signature: sign(key, SignaturePayload("POST", "/data", timestamp, nonce, []byte(body))),
+		}
+	}
+	tamper := func(request *SignedRequest, change func(*SignedRequest)) *SignedRequest {
+		change(request)
+		return request
+	}
+	now := time.Now()
+	skew := config.SignatureWindow + time.Minute
+
+	// Cases run in order, replays rely on the nonces used before
+	tests := []struct {
+		name     string
+		deviceId string
+		request  *SignedRequest
+		want     int
+	}{
+		{"valid", "signed", signed(now, "nonce-valid", `{"a":1}`), http.StatusOK},
+		{"nonce replayed", "signed", signed(now, "nonce-valid", `{"a":1}`), http.StatusUnauthorized},
+		{"nonce replayed with other body", "signed", signed(now, "nonce-valid", `{"a":2}`), http.StatusUnauthorized},
+		{"same nonce of other device", "second", signed(now, "nonce-valid", `{"a":1}`), http.StatusOK},
+		{"signed without a key", "other", signed(now, "nonce-nokey", ""), http.StatusBadRequest},
+		{"skew within window", "signed", signed(now.Add(-config.SignatureWindow+time.Minute), "nonce-past", ""), http.StatusOK},
+		{"skew in the past", "signed", signed(now.Add(-skew), "nonce-late", ""), http.StatusUnauthorized},
+		{"skew in the future", "signed", signed(now.Add(skew), "nonce-early", ""), http.StatusUnauthorized},
+		{"invalid timestamp", "signed", tamper(signed(now, "nonce-time", ""), func(r *SignedRequest) { r.Timestamp = "now" }), http.StatusUnauthorized},
+		{"body tampered", "signed", tamper(signed(now, "nonce-body", `{"a":1}`), func(r *SignedRequest) { r.Body = []byte(`{"a":2}`) }), http.StatusUnauthorized},
+		{"uri tampered", "signed", tamper(signed(now, "nonce-uri", ""), func(r *SignedRequest) { r.Uri = "/commands" }), http.StatusUnauthorized},
+		{"tampered nonce is not used up", "signed", signed(now, "nonce-body", `{"a":1}`), http.StatusOK},
+		{"nonce too short", "signed", signed(now, "short", ""), http.StatusUnauthorized},
+		{"not signed", "signed", tamper(signed(now, "nonce-unsigned", ""), func(r *SignedRequest) { r.Signature = "" }), http.StatusUnauthorized},
+		{"no key and not signed", "other", tamper(signed(now, "nonce-other", ""), func(r *SignedRequest) { r.Signature = "" }), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := NewSigningKey(tt.deviceId, database).Verify(tt.request)
+			if status != tt.want {
+				t.Errorf("Verify() = %d (%v), want %d", status, err, tt.want)
+			}
+		})
+	}
+}
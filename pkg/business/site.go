@@ -0,0 +1,250 @@
+package business
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+type GroupSupport struct {
+	Enabled bool
+}
+
+// Site groups zones, e.g. a greenhouse or a building
+type Site struct {
+	Database  *db.Sqlite `json:"-"`
+	Id        *string    `json:"id"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"date_created"`
+	UpdatedAt time.Time  `json:"date_updated"`
+}
+
+type SiteCreate struct {
+	Name string `json:"name"`
+}
+
+type SiteUpdate struct {
+	Name *string `json:"name"`
+}
+
+func NewSite(id *string, database *db.Sqlite) *Site {
+	return &Site{Id: id, Database: database}
+}
+
+func (s *Site) Exists() (bool, error) {
+	if s.Id == nil {
+		return false, fmt.Errorf("no site id given to read")
+	}
+	stmt, err := s.Database.Prepare("SELECT count(*) from sites where id = ?")
+	if err != nil {
+		return false, err
+	}
+	var count int
+	err = stmt.QueryRow(*s.Id).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Create site
+func (s *Site) Create(create *SiteCreate) (*Site, int, error) {
+	if s.Id != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("the site was already created with id '%s'", *s.Id)
+	}
+	if len(create.Name) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("no site name given")
+	}
+
+	u, err := uuid.NewUUID()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("uuid error")
+	}
+	id := u.String()
+	s.Id = &id
+
+	stmt, err := s.Database.Prepare("INSERT INTO sites (id, name, date_created, date_updated) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	tNow := time.Now()
+	now := tNow.UTC().Format(db.SqliteDateLayout)
+	_, err = stmt.Exec(s.Id, create.Name, now, now)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	s.Name = create.Name
+	s.CreatedAt = tNow
+	s.UpdatedAt = tNow
+
+	return s, http.StatusCreated, nil
+}
+
+// Read site
+func (s *Site) Read() (*Site, int, error) {
+	if s.Id == nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("no site id given to read")
+	}
+	id := *s.Id
+
+	exists, err := s.Exists()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if !exists {
+		return s, http.StatusNotFound, fmt.Errorf("site with id '%s' does not exist", id)
+	}
+
+	stmt, err := s.Database.Prepare(fmt.Sprintf("SELECT %s FROM sites WHERE id = ?", siteColumns))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return scanSite(stmt.QueryRow(id), s.Database)
+}
+
+// List sites
+func (s *Site) List() ([]*Site, int, error) {
+	stmt, err := s.Database.Prepare(fmt.Sprintf("SELECT %s FROM sites ORDER BY name", siteColumns))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer rows.Close()
+
+	sites := []*Site{}
+	for rows.Next() {
+		site, status, err := scanSite(rows, s.Database)
+		if err != nil {
+			return nil, status, err
+		}
+		sites = append(sites, site)
+	}
+	if err := rows.Err(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return sites, http.StatusOK, nil
+}
+
+// Update site
+func (s *Site) Update(update *SiteUpdate) (*Site, int, error) {
+	site, status, err := s.Read()
+	if err != nil {
+		return site, status, err
+	}
+
+	if update.Name != nil {
+		if len(*update.Name) == 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("no site name given")
+		}
+		site.Name = *update.Name
+	}
+	tNow := time.Now()
+	site.UpdatedAt = tNow
+	now := tNow.UTC().Format(db.SqliteDateLayout)
+
+	stmt, err := s.Database.Prepare("UPDATE sites SET name = ?, date_updated = ? where id = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	_, err = stmt.Exec(site.Name, now, *site.Id)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	return site, http.StatusOK, nil
+}
+
+// Delete site, only possible when it has no zones left
+func (s *Site) Delete() (*Site, int, error) {
+	site, status, err := s.Read()
+	if err != nil {
+		return site, status, err
+	}
+
+	stmt, err := s.Database.Prepare("SELECT count(*) FROM zones WHERE site_id = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	var zones int
+	err = stmt.QueryRow(*site.Id).Scan(&zones)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if zones > 0 {
+		return nil, http.StatusConflict, fmt.Errorf("site with id '%s' still has %d zones", *site.Id, zones)
+	}
+
+	for _, query := range []string{
+		"DELETE FROM grants WHERE resource_kind = 'site' AND resource_id = ?",
+		"DELETE FROM sites WHERE id = ?",
+	} {
+		stmt, err = s.Database.Prepare(query)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		_, err = stmt.Exec(*site.Id)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+	}
+	return site, http.StatusOK, nil
+}
+
+// DeviceIds of all devices in any zone of the site
+func (s *Site) DeviceIds() ([]string, int, error) {
+	stmt, err := s.Database.Prepare(`SELECT zd.device_id FROM zone_devices zd
+		JOIN zones z ON z.id = zd.zone_id WHERE z.site_id = ? ORDER BY zd.device_id`)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return queryIds(stmt, *s.Id)
+}
+
+const siteColumns = "id, name, date_created, date_updated"
+
+func scanSite(row rowScanner, database *db.Sqlite) (*Site, int, error) {
+	var id, name, date_created, date_updated string
+	err := row.Scan(&id, &name, &date_created, &date_updated)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	site := NewSite(&id, database)
+	site.Name = name
+	site.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+	}
+	site.UpdatedAt, err = time.Parse(db.SqliteDateLayout, date_updated)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+	}
+	return site, http.StatusOK, nil
+}
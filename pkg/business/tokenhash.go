@@ -0,0 +1,109 @@
+package business
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// TokenPepper keys the hashes of stored tokens, it is read from the secrets on startup
+var TokenPepper []byte
+
+// tokenPrefixLength of the clear text prefix tokens are looked up by
+const tokenPrefixLength = 16
+
+func tokenPrefix(token string) string {
+	if len(token) < tokenPrefixLength {
+		return token
+	}
+	return token[:tokenPrefixLength]
+}
+
+// hashToken with HMAC-SHA256 keyed by the pepper, a leaked database alone does not reveal usable tokens
+func hashToken(token string) string {
+	mac := hmac.New(sha256.New, TokenPepper)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// matchToken finds the id of the row whose hash matches a token, kind is the column prefix: token or refresh
+func matchToken(p preparer, table string, kind string, token string, where string, args ...interface{}) (*string, error) {
+	stmt, err := p.Prepare(fmt.Sprintf("SELECT id, %s_hash FROM %s WHERE %s_prefix = ? %s", kind, table, kind, where))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(append([]interface{}{tokenPrefix(token)}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hash := []byte(hashToken(token))
+	var match *string
+	for rows.Next() {
+		var id, candidate string
+		if err := rows.Scan(&id, &candidate); err != nil {
+			return nil, err
+		}
+		if hmac.Equal(hash, []byte(candidate)) {
+			match = &id
+		}
+	}
+	return match, rows.Err()
+}
+
+// MigrateAccesstokens hashes tokens still stored in clear text, devices keep their tokens
+func MigrateAccesstokens(database *db.Sqlite) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(fmt.Sprintf("SELECT id, token, coalesce(refresh_token, '') FROM %s WHERE token != ''", Table))
+	if err != nil {
+		return err
+	}
+	plain := map[string][2]string{}
+	for rows.Next() {
+		var id, token, refreshToken string
+		if err := rows.Scan(&id, &token, &refreshToken); err != nil {
+			rows.Close()
+			return err
+		}
+		plain[id] = [2]string{token, refreshToken}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(fmt.Sprintf(`UPDATE %s SET token = '', token_prefix = ?, token_hash = ?,
+		refresh_token = NULL, refresh_prefix = ?, refresh_hash = ? WHERE id = ?`, Table))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, tokens := range plain {
+		var refreshPrefix, refreshHash *string
+		if len(tokens[1]) > 0 {
+			prefix, hash := tokenPrefix(tokens[1]), hashToken(tokens[1])
+			refreshPrefix, refreshHash = &prefix, &hash
+		}
+		_, err = stmt.Exec(tokenPrefix(tokens[0]), hashToken(tokens[0]), refreshPrefix, refreshHash, id)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(plain) > 0 {
+		util.Log.Infof("hashed %d clear text accesstokens", len(plain))
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package business
+
+import "testing"
+
+// testPepper sets the token pepper for a test
+func testPepper(t *testing.T, pepper string) {
+	t.Helper()
+	previous := TokenPepper
+	TokenPepper = []byte(pepper)
+	t.Cleanup(func() { TokenPepper = previous })
+}
+
+func TestHashToken(t *testing.T) {
+	testPepper(t, "pepper")
+	hash := hashToken("0123456789abcdef-token")
+
+	tests := []struct {
+		name   string
+		pepper string
+		token  string
+		same   bool
+	}{
+		{"same token and pepper", "pepper", "0123456789abcdef-token", true},
+		{"other token", "pepper", "0123456789abcdef-other", false},
+		{"other pepper", "salt", "0123456789abcdef-token", false},
+		{"empty token", "pepper", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testPepper(t, tt.pepper)
+			got := hashToken(tt.token)
+			if len(got) != 64 {
+				t.Errorf("hashToken() has length %d, want 64", len(got))
+			}
+			if (got == hash) != tt.same {
+				t.Errorf("hashToken() = %s, same as %s is %v, want %v", got, hash, got == hash, tt.same)
+			}
+		})
+	}
+}
+
+func TestMatchToken(t *testing.T) {
+	testPepper(t, "pepper")
+	database := testDatabase(t)
+
+	// Both tokens share the prefix, only the hash tells them apart
+	for id, token := range map[string]string{"first": "0123456789abcdef-first", "second": "0123456789abcdef-second"} {
+		testExec(t, database, `INSERT INTO accesstokens (id, device_id, token, token_prefix, token_hash, date_created, date_updated)
+			VALUES (?, 'device', '', ?, ?, '', '')`, id, tokenPrefix(token), hashToken(token))
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		where string
+		args  []interface{}
+		want  string
+	}{
+		{"first", "0123456789abcdef-first", "", nil, "first"},
+		{"second", "0123456789abcdef-second", "", nil, "second"},
+		{"same prefix", "0123456789abcdef-third", "", nil, ""},
+		{"unknown prefix", "fedcba9876543210-first", "", nil, ""},
+		{"short token", "first", "", nil, ""},
+		{"filtered out", "0123456789abcdef-first", "AND id != ?", []interface{}{"first"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, err := matchToken(database, Table, "token", tt.token, tt.where, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if match != nil {
+				got = *match
+			}
+			if got != tt.want {
+				t.Errorf("matchToken() = '%s', want '%s'", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrateAccesstokens(t *testing.T) {
+	testPepper(t, "pepper")
+	database := testDatabase(t)
+
+	tests := []struct {
+		name         string
+		token        string
+		refreshToken interface{}
+	}{
+		{"with refresh token", "0123456789abcdef-token", "0123456789abcdef-refresh"},
+		{"without refresh token", "fedcba9876543210-token", nil},
+	}
+	for _, tt := range tests {
+		testExec(t, database, `INSERT INTO accesstokens (id, device_id, token, refresh_token, date_created, date_updated)
+			VALUES (?, 'device', ?, ?, '', '')`, tt.name, tt.token, tt.refreshToken)
+	}
+	if err := MigrateAccesstokens(database); err != nil {
+		t.Fatal(err)
+	}
+	// Running it again must not touch the hashed tokens
+	if err := MigrateAccesstokens(database); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt, err := database.Prepare("SELECT token, refresh_token IS NULL FROM accesstokens WHERE id = ?")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var token string
+			var refreshCleared bool
+			if err := stmt.QueryRow(tt.name).Scan(&token, &refreshCleared); err != nil {
+				t.Fatal(err)
+			}
+			if token != "" || !refreshCleared {
+				t.Errorf("clear text tokens are kept: token '%s', refresh token cleared %v", token, refreshCleared)
+			}
+
+			match, err := matchToken(database, Table, "token", tt.token, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match == nil || *match != tt.name {
+				t.Errorf("token does not match '%s' after the migration", tt.name)
+			}
+
+			refreshToken, ok := tt.refreshToken.(string)
+			if !ok {
+				return
+			}
+			match, err = matchToken(database, Table, "refresh", refreshToken, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match == nil || *match != tt.name {
+				t.Errorf("refresh token does not match '%s' after the migration", tt.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package business
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// tokenUserAgentMaxLength truncates user agents, they are only informational
+const tokenUserAgentMaxLength = 256
+
+type tokenUse struct {
+	UsedAt    time.Time
+	Ip        string
+	UserAgent string
+}
+
+// TokenUsageTracker buffers when accesstokens were last used and flushes them to sqlite in batches
+type TokenUsageTracker struct {
+	mutex   sync.Mutex
+	pending map[string]tokenUse
+}
+
+// TokenUsage of all accesstokens, flushed by Run
+var TokenUsage = NewTokenUsageTracker()
+
+func NewTokenUsageTracker() *TokenUsageTracker {
+	return &TokenUsageTracker{pending: map[string]tokenUse{}}
+}
+
+// Used marks an accesstoken as used now by a client
+func (t *TokenUsageTracker) Used(tokenId string, ip string, userAgent string) {
+	if len(userAgent) > tokenUserAgentMaxLength {
+		userAgent = userAgent[:tokenUserAgentMaxLength]
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.pending[tokenId] = tokenUse{UsedAt: time.Now(), Ip: ip, UserAgent: userAgent}
+}
+
+// get the buffered usage of an accesstoken that is not yet flushed
+func (t *TokenUsageTracker) get(tokenId string) (tokenUse, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	used, ok := t.pending[tokenId]
+	return used, ok
+}
+
+// Flush writes all buffered usages in one transaction
+func (t *TokenUsageTracker) Flush(database *db.Sqlite) error {
+	t.mutex.Lock()
+	pending := t.pending
+	t.pending = map[string]tokenUse{}
+	t.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	restore := func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		for tokenId, used := range pending {
+			if newer, ok := t.pending[tokenId]; !ok || newer.UsedAt.Before(used.UsedAt) {
+				t.pending[tokenId] = used
+			}
+		}
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		restore()
+		return err
+	}
+	// Revoked tokens are simply not updated anymore
+	stmt, err := tx.Prepare(fmt.Sprintf("UPDATE %s SET last_used_at = ?, last_ip = ?, user_agent = ? WHERE id = ?", Table))
+	if err != nil {
+		tx.Rollback()
+		restore()
+		return err
+	}
+	for tokenId, used := range pending {
+		_, err = stmt.Exec(used.UsedAt.UTC().Format(db.SqliteDateLayout), used.Ip, used.UserAgent, tokenId)
+		if err != nil {
+			tx.Rollback()
+			restore()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		restore()
+		return err
+	}
+	util.Log.Debugf("flushed usage of %d accesstokens", len(pending))
+	return nil
+}
+
+// Run flushes the buffered usages every interval until the context is done
+func (t *TokenUsageTracker) Run(ctx context.Context, database *db.Sqlite, interval time.Duration) {
+	util.Every(ctx, interval, func() {
+		if err := t.Flush(database); err != nil {
+			util.Log.Error(err)
+		}
+	})
+}
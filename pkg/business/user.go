@@ -0,0 +1,301 @@
+package business
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type UserSupport struct {
+	Enabled bool
+}
+
+// User roles, each one includes the ones before it
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// UserMinPasswordLength is the shortest password accepted
+const UserMinPasswordLength = 10
+
+// User is a team member logging in with a password instead of sharing the api secret
+type User struct {
+	Database  *db.Sqlite `json:"-"`
+	Id        *string    `json:"id"`
+	Username  string     `json:"username"`
+	Role      string     `json:"role"`
+	CreatedAt time.Time  `json:"date_created"`
+	UpdatedAt time.Time  `json:"date_updated"`
+	Auditor   *Auditor   `json:"-"`
+}
+
+type UserCreate struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+type UserUpdate struct {
+	Password *string `json:"password"`
+	Role     *string `json:"role"`
+}
+
+func NewUser(id *string, database *db.Sqlite) *User {
+	return &User{Id: id, Database: database}
+}
+
+// HasRole checks if a user has a role or one including it
+func (u *User) HasRole(role string) bool {
+	required, ok := roleRank[role]
+	return ok && roleRank[u.Role] >= required
+}
+
+func validateRole(role string) error {
+	if _, ok := roleRank[role]; !ok {
+		return fmt.Errorf("invalid role '%s'", role)
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, int, error) {
+	if len(password) < UserMinPasswordLength {
+		return "", http.StatusBadRequest, fmt.Errorf("password needs at least %d characters", UserMinPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		util.Log.Error(err)
+		return "", http.StatusInternalServerError, fmt.Errorf("password error")
+	}
+	return string(hash), http.StatusOK, nil
+}
+
+// auditUser is the audited view of a user, never the password
+func auditUser(u *User) map[string]interface{} {
+	return map[string]interface{}{
+		"username": u.Username,
+		"role":     u.Role,
+	}
+}
+
+// Create user
+func (u *User) Create(create *UserCreate) (*User, int, error) {
+	if u.Id != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("the user was already created with id '%s'", *u.Id)
+	}
+	username := strings.TrimSpace(create.Username)
+	if len(username) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("no username given")
+	}
+	if err := validateRole(create.Role); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	hash, status, err := hashPassword(create.Password)
+	if err != nil {
+		return nil, status, err
+	}
+
+	newId, err := uuid.NewUUID()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("uuid error")
+	}
+	id := newId.String()
+
+	stmt, err := u.Database.Prepare("INSERT INTO users (id, username, password_hash, role, date_created, date_updated) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	tNow := time.Now()
+	now := tNow.UTC().Format(db.SqliteDateLayout)
+	_, err = stmt.Exec(id, username, hash, create.Role, now, now)
+	if err != nil && isUniqueViolation(err) {
+		return nil, http.StatusConflict, fmt.Errorf("user '%s' already exists", username)
+	}
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	u.Id = &id
+	u.Username = username
+	u.Role = create.Role
+	u.CreatedAt = tNow
+	u.UpdatedAt = tNow
+	u.Auditor.recordAfter(u.Database, AuditCreate, AuditResourceUser, id, "", nil, auditUser(u))
+	return u, http.StatusCreated, nil
+}
+
+const userColumns = "id, username, role, date_created, date_updated"
+
+func scanUser(row rowScanner, database *db.Sqlite) (*User, error) {
+	var id, date_created, date_updated string
+	user := NewUser(&id, database)
+	err := row.Scan(&id, &user.Username, &user.Role, &date_created, &date_updated)
+	if err != nil {
+		return nil, err
+	}
+	user.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
+	if err != nil {
+		return nil, err
+	}
+	user.UpdatedAt, err = time.Parse(db.SqliteDateLayout, date_updated)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Read user
+func (u *User) Read() (*User, int, error) {
+	if u.Id == nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("no user id given to read")
+	}
+	stmt, err := u.Database.Prepare(fmt.Sprintf("SELECT %s FROM users WHERE id = ?", userColumns))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	user, err := scanUser(stmt.QueryRow(*u.Id), u.Database)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, http.StatusNotFound, fmt.Errorf("user with id '%s' does not exist", *u.Id)
+	case err != nil:
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	user.Auditor = u.Auditor
+	return user, http.StatusOK, nil
+}
+
+// List users, ordered by username
+func (u *User) List() ([]*User, int, error) {
+	stmt, err := u.Database.Prepare(fmt.Sprintf("SELECT %s FROM users ORDER BY username", userColumns))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		user, err := scanUser(rows, u.Database)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return users, http.StatusOK, nil
+}
+
+// Update the role or password of a user, a new password ends all sessions of the user
+func (u *User) Update(update *UserUpdate) (*User, int, error) {
+	user, status, err := u.Read()
+	if err != nil {
+		return nil, status, err
+	}
+	before := auditUser(user)
+
+	tx, err := u.Database.Begin()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	tNow := time.Now()
+	now := tNow.UTC().Format(db.SqliteDateLayout)
+	if update.Role != nil {
+		if err := validateRole(*update.Role); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		user.Role = *update.Role
+		if _, err := tx.Exec("UPDATE users SET role = ?, date_updated = ? WHERE id = ?", user.Role, now, *user.Id); err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+	}
+	if update.Password != nil {
+		hash, status, err := hashPassword(*update.Password)
+		if err != nil {
+			return nil, status, err
+		}
+		if _, err := tx.Exec("UPDATE users SET password_hash = ?, date_updated = ? WHERE id = ?", hash, now, *user.Id); err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", *user.Id); err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+	}
+	user.UpdatedAt = tNow
+
+	err = u.Auditor.record(tx, AuditUpdate, AuditResourceUser, *user.Id, "", before, auditUser(user))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if err := tx.Commit(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return user, http.StatusOK, nil
+}
+
+// Delete user and all sessions and grants of it
+func (u *User) Delete() (*User, int, error) {
+	user, status, err := u.Read()
+	if err != nil {
+		return nil, status, err
+	}
+
+	tx, err := u.Database.Begin()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM grants WHERE principal_kind = 'user' AND principal_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	} {
+		if _, err := execCount(tx, query, *user.Id); err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+	}
+	err = u.Auditor.record(tx, AuditDelete, AuditResourceUser, *user.Id, "", auditUser(user), nil)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if err := tx.Commit(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return user, http.StatusOK, nil
+}
@@ -0,0 +1,346 @@
+package business
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"gitlab.void-ptr.org/go/schism/pkg/db"
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// Zone is part of a site and holds devices, e.g. a room or a bed in a greenhouse
+type Zone struct {
+	Database  *db.Sqlite `json:"-"`
+	Id        *string    `json:"id"`
+	SiteId    string     `json:"site_id"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"date_created"`
+	UpdatedAt time.Time  `json:"date_updated"`
+}
+
+type ZoneCreate struct {
+	SiteId string `json:"site_id"`
+	Name   string `json:"name"`
+}
+
+type ZoneUpdate struct {
+	SiteId *string `json:"site_id"`
+	Name   *string `json:"name"`
+}
+
+type ZoneDevice struct {
+	DeviceId string `json:"device_id"`
+}
+
+func NewZone(id *string, database *db.Sqlite) *Zone {
+	return &Zone{Id: id, Database: database}
+}
+
+func (z *Zone) Exists() (bool, error) {
+	if z.Id == nil {
+		return false, fmt.Errorf("no zone id given to read")
+	}
+	stmt, err := z.Database.Prepare("SELECT count(*) from zones where id = ?")
+	if err != nil {
+		return false, err
+	}
+	var count int
+	err = stmt.QueryRow(*z.Id).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// checkSite makes sure the site of a zone exists
+func (z *Zone) checkSite(siteId string) (int, error) {
+	exists, err := NewSite(&siteId, z.Database).Exists()
+	if err != nil {
+		util.Log.Error(err)
+		return http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if !exists {
+		return http.StatusBadRequest, fmt.Errorf("site with id '%s' does not exist", siteId)
+	}
+	return http.StatusOK, nil
+}
+
+// Create zone
+func (z *Zone) Create(create *ZoneCreate) (*Zone, int, error) {
+	if z.Id != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("the zone was already created with id '%s'", *z.Id)
+	}
+	if len(create.Name) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("no zone name given")
+	}
+	if status, err := z.checkSite(create.SiteId); err != nil {
+		return nil, status, err
+	}
+
+	u, err := uuid.NewUUID()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("uuid error")
+	}
+	id := u.String()
+	z.Id = &id
+
+	stmt, err := z.Database.Prepare("INSERT INTO zones (id, site_id, name, date_created, date_updated) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	tNow := time.Now()
+	now := tNow.UTC().Format(db.SqliteDateLayout)
+	_, err = stmt.Exec(z.Id, create.SiteId, create.Name, now, now)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	z.SiteId = create.SiteId
+	z.Name = create.Name
+	z.CreatedAt = tNow
+	z.UpdatedAt = tNow
+
+	return z, http.StatusCreated, nil
+}
+
+// Read zone
+func (z *Zone) Read() (*Zone, int, error) {
+	if z.Id == nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("no zone id given to read")
+	}
+	id := *z.Id
+
+	exists, err := z.Exists()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if !exists {
+		return z, http.StatusNotFound, fmt.Errorf("zone with id '%s' does not exist", id)
+	}
+
+	stmt, err := z.Database.Prepare(fmt.Sprintf("SELECT %s FROM zones WHERE id = ?", zoneColumns))
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return scanZone(stmt.QueryRow(id), z.Database)
+}
+
+// List zones, optionally only the ones of a site
+func (z *Zone) List(siteId string) ([]*Zone, int, error) {
+	query := fmt.Sprintf("SELECT %s FROM zones", zoneColumns)
+	args := []interface{}{}
+	if len(siteId) > 0 {
+		query += " WHERE site_id = ?"
+		args = append(args, siteId)
+	}
+	stmt, err := z.Database.Prepare(query + " ORDER BY name")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	defer rows.Close()
+
+	zones := []*Zone{}
+	for rows.Next() {
+		zone, status, err := scanZone(rows, z.Database)
+		if err != nil {
+			return nil, status, err
+		}
+		zones = append(zones, zone)
+	}
+	if err := rows.Err(); err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return zones, http.StatusOK, nil
+}
+
+// Update zone
+func (z *Zone) Update(update *ZoneUpdate) (*Zone, int, error) {
+	zone, status, err := z.Read()
+	if err != nil {
+		return zone, status, err
+	}
+
+	if update.Name != nil {
+		if len(*update.Name) == 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("no zone name given")
+		}
+		zone.Name = *update.Name
+	}
+	if update.SiteId != nil {
+		if status, err := z.checkSite(*update.SiteId); err != nil {
+			return nil, status, err
+		}
+		zone.SiteId = *update.SiteId
+	}
+	tNow := time.Now()
+	zone.UpdatedAt = tNow
+	now := tNow.UTC().Format(db.SqliteDateLayout)
+
+	stmt, err := z.Database.Prepare("UPDATE zones SET site_id = ?, name = ?, date_updated = ? where id = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	_, err = stmt.Exec(zone.SiteId, zone.Name, now, *zone.Id)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	return zone, http.StatusOK, nil
+}
+
+// Delete zone, release its devices and drop the grants on it
+func (z *Zone) Delete() (*Zone, int, error) {
+	zone, status, err := z.Read()
+	if err != nil {
+		return zone, status, err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM zone_devices WHERE zone_id = ?",
+		"DELETE FROM grants WHERE resource_kind = 'zone' AND resource_id = ?",
+		"DELETE FROM zones WHERE id = ?",
+	} {
+		stmt, err := z.Database.Prepare(query)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+		_, err = stmt.Exec(*zone.Id)
+		if err != nil {
+			util.Log.Error(err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+		}
+	}
+	return zone, http.StatusOK, nil
+}
+
+// DeviceIds of all devices in the zone
+func (z *Zone) DeviceIds() ([]string, int, error) {
+	stmt, err := z.Database.Prepare("SELECT device_id FROM zone_devices WHERE zone_id = ? ORDER BY device_id")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return queryIds(stmt, *z.Id)
+}
+
+// AddDevice moves a device into the zone, a device is member of one zone at most
+func (z *Zone) AddDevice(deviceId string) (*ZoneDevice, int, error) {
+	if _, status, err := z.Read(); err != nil {
+		return nil, status, err
+	}
+	device := NewDevice(&deviceId, z.Database)
+	if _, status, err := device.Read(); err != nil {
+		return nil, status, err
+	}
+
+	stmt, err := z.Database.Prepare(`INSERT INTO zone_devices (device_id, zone_id, date_created) VALUES (?, ?, ?)
+		ON CONFLICT (device_id) DO UPDATE SET zone_id = excluded.zone_id, date_created = excluded.date_created`)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	now := time.Now().UTC().Format(db.SqliteDateLayout)
+	_, err = stmt.Exec(deviceId, *z.Id, now)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	return &ZoneDevice{DeviceId: deviceId}, http.StatusCreated, nil
+}
+
+// RemoveDevice from the zone
+func (z *Zone) RemoveDevice(deviceId string) (*ZoneDevice, int, error) {
+	if z.Id == nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("no zone id given to update")
+	}
+	stmt, err := z.Database.Prepare("DELETE FROM zone_devices WHERE zone_id = ? AND device_id = ?")
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	result, err := stmt.Exec(*z.Id, deviceId)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+	if rows == 0 {
+		return nil, http.StatusNotFound, fmt.Errorf("device with id '%s' is not in zone '%s'", deviceId, *z.Id)
+	}
+	return &ZoneDevice{DeviceId: deviceId}, http.StatusOK, nil
+}
+
+const zoneColumns = "id, site_id, name, date_created, date_updated"
+
+func scanZone(row rowScanner, database *db.Sqlite) (*Zone, int, error) {
+	var id, site_id, name, date_created, date_updated string
+	err := row.Scan(&id, &site_id, &name, &date_created, &date_updated)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("database error")
+	}
+
+	zone := NewZone(&id, database)
+	zone.SiteId = site_id
+	zone.Name = name
+	zone.CreatedAt, err = time.Parse(db.SqliteDateLayout, date_created)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+	}
+	zone.UpdatedAt, err = time.Parse(db.SqliteDateLayout, date_updated)
+	if err != nil {
+		util.Log.Error(err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("parse error")
+	}
+	return zone, http.StatusOK, nil
+}
+
+// deviceGroupTags reads the zone and site names of a device, used as influx tags
+func deviceGroupTags(database *db.Sqlite, deviceId string) (map[string]string, error) {
+	stmt, err := database.Prepare(`SELECT z.name, s.name FROM zone_devices zd
+		JOIN zones z ON z.id = zd.zone_id
+		JOIN sites s ON s.id = z.site_id
+		WHERE zd.device_id = ?`)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := map[string]string{}
+	for rows.Next() {
+		var zone, site string
+		if err := rows.Scan(&zone, &site); err != nil {
+			return nil, err
+		}
+		tags["zone"] = zone
+		tags["site"] = site
+	}
+	return tags, rows.Err()
+}
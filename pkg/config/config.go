@@ -0,0 +1,97 @@
+package config
+
+import "time"
+
+// LabelTags are the device label keys written as influx tags, all other labels are only stored
+var LabelTags = getEnvList("SCHISM_LABEL_TAGS")
+
+// PresenceFlushInterval between writes of the buffered last seen values to sqlite
+var PresenceFlushInterval = getEnvDuration("SCHISM_PRESENCE_FLUSH_INTERVAL", 30*time.Second)
+
+// StatusStaleAfter a device without requests is no longer online but stale
+var StatusStaleAfter = getEnvDuration("SCHISM_STATUS_STALE_AFTER", 5*time.Minute)
+
+// StatusOfflineAfter a device without requests is considered offline
+var StatusOfflineAfter = getEnvDuration("SCHISM_STATUS_OFFLINE_AFTER", time.Hour)
+
+// ClaimCodeTTL is the default lifetime of a claim code
+var ClaimCodeTTL = getEnvDuration("SCHISM_CLAIM_CODE_TTL", 24*time.Hour)
+
+// DeviceDeleteGrace soft deleted devices can be restored within
+var DeviceDeleteGrace = getEnvDuration("SCHISM_DEVICE_DELETE_GRACE", 7*24*time.Hour)
+
+// DeviceSweepInterval between removals of soft deleted devices past their grace period
+var DeviceSweepInterval = getEnvDuration("SCHISM_DEVICE_SWEEP_INTERVAL", time.Hour)
+
+// ShadowMaxWait caps how long a device may long-poll for changes of its shadow
+var ShadowMaxWait = getEnvDuration("SCHISM_SHADOW_MAX_WAIT", 55*time.Second)
+
+// CommandTTL is the default time a device has to fetch and acknowledge a command
+var CommandTTL = getEnvDuration("SCHISM_COMMAND_TTL", time.Hour)
+
+// AccesstokenTTL is the lifetime of an accesstoken, it can be refreshed until its refresh token expires
+var AccesstokenTTL = getEnvDuration("SCHISM_ACCESSTOKEN_TTL", 24*time.Hour)
+
+// RefreshTokenTTL is the lifetime of a refresh token
+var RefreshTokenTTL = getEnvDuration("SCHISM_REFRESH_TOKEN_TTL", 30*24*time.Hour)
+
+// TokenSweepInterval between removals of accesstokens past their refresh token lifetime
+var TokenSweepInterval = getEnvDuration("SCHISM_TOKEN_SWEEP_INTERVAL", time.Hour)
+
+// SessionTTL is the lifetime of a user session
+var SessionTTL = getEnvDuration("SCHISM_SESSION_TTL", 12*time.Hour)
+
+// MaxAccesstokensPerDevice caps the concurrent accesstokens of a device, a login beyond evicts the oldest, 0 disables the cap
+var MaxAccesstokensPerDevice = getEnvInt("SCHISM_MAX_ACCESSTOKENS_PER_DEVICE", 10)
+
+// TrustForwardedFor takes the client ip from the x-forwarded-for header, only enable it behind a proxy setting it
+var TrustForwardedFor = getEnvBool("SCHISM_TRUST_FORWARDED_FOR", false)
+
+// SignatureWindow is the clock skew allowed for signed requests, their nonces are remembered as long
+var SignatureWindow = getEnvDuration("SCHISM_SIGNATURE_WINDOW", 5*time.Minute)
+
+// SignedBodyLimit is the largest body of a request of a device with a signing key, it is read to verify the signature
+var SignedBodyLimit = getEnvInt("SCHISM_SIGNED_BODY_LIMIT", 1<<20)
+
+// JwtTTL is the lifetime of a jwt, revocations and retired signing keys are kept as long
+var JwtTTL = getEnvDuration("SCHISM_JWT_TTL", 5*time.Minute)
+
+// JwtKeyRotationInterval between automatic rotations of the jwt signing key
+var JwtKeyRotationInterval = getEnvDuration("SCHISM_JWT_KEY_ROTATION_INTERVAL", 30*24*time.Hour)
+
+// TlsAddress the mutual tls server listens on, e.g. :8443, it is disabled if empty
+var TlsAddress = getEnvString("SCHISM_TLS_ADDRESS", "")
+
+// TlsHosts are the host names and ips of the tls server certificate
+var TlsHosts = getEnvList("SCHISM_TLS_HOSTS")
+
+// DeviceCertTTL is the lifetime of a device client certificate
+var DeviceCertTTL = getEnvDuration("SCHISM_DEVICE_CERT_TTL", 90*24*time.Hour)
+
+// ApiKeysReloadInterval is how often the api key secret files are checked for changes
+var ApiKeysReloadInterval = getEnvDuration("SCHISM_API_KEYS_RELOAD_INTERVAL", 30*time.Second)
+
+// DefaultRateLimit applies to every route per device, or per client ip before a device is known
+var DefaultRateLimit = getEnvRateLimit("SCHISM_RATE_LIMIT", RateLimit{Rate: 20, Burst: 40})
+
+// RateLimits override the default for single routes, e.g. "POST /data=5/s:10,/auth/login=10/m"
+var RateLimits = getEnvRateLimits("SCHISM_RATE_LIMITS")
+
+// IpRateLimit applies to all requests of a client ip before they are authenticated, so rejected credentials are limited too
+var IpRateLimit = getEnvRateLimit("SCHISM_IP_RATE_LIMIT", RateLimit{Rate: 100, Burst: 200})
+
+// LockoutThreshold failed attempts of a client ip, or of a device id or username from an ip start its lockout, 0 disables lockouts
+var LockoutThreshold = getEnvInt("SCHISM_LOCKOUT_THRESHOLD", 5)
+
+// LockoutIdThreshold failed attempts of a device id or username from any ip start its lockout, it is higher so others
+// can not easily lock out a device or user, 0 disables these lockouts
+var LockoutIdThreshold = getEnvInt("SCHISM_LOCKOUT_ID_THRESHOLD", 50)
+
+// LockoutDuration is the first lockout, every further failed attempt doubles it
+var LockoutDuration = getEnvDuration("SCHISM_LOCKOUT_DURATION", time.Minute)
+
+// LockoutMaxDuration caps lockouts, failed attempts are forgotten after as long
+var LockoutMaxDuration = getEnvDuration("SCHISM_LOCKOUT_MAX_DURATION", time.Hour)
+
+// DeviceIdFromMac derives uuid v5 device ids from the mac address so reflashed devices keep their id
+var DeviceIdFromMac = getEnvBool("SCHISM_DEVICE_ID_FROM_MAC", false)
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// getEnvList reads a comma separated list, empty entries are dropped
+func getEnvList(key string) []string {
+	list := []string{}
+	for _, entry := range strings.Split(os.Getenv(key), ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) > 0 {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// getEnvDuration reads a duration like 5m or returns the fallback if unset or invalid
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		util.Log.Warningf("invalid duration for %s: %s", key, value)
+		return fallback
+	}
+	return d
+}
+
+// getEnvBool reads a boolean like true or 1 or returns the fallback if unset or invalid
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		util.Log.Warningf("invalid boolean for %s: %s", key, value)
+		return fallback
+	}
+	return b
+}
+
+// getEnvInt reads a non negative integer or returns the fallback if unset or invalid
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		util.Log.Warningf("invalid integer for %s: %s", key, value)
+		return fallback
+	}
+	return n
+}
+
+// getEnvString reads a string or returns the fallback if unset
+func getEnvString(key string, fallback string) string {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+	return value
+}
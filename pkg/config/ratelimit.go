@@ -0,0 +1,79 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.void-ptr.org/go/schism/pkg/util"
+)
+
+// RateLimit is a token bucket refilled with Rate requests per second holding up to Burst, a zero rate disables it
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+var rateLimitPeriods = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+
+// parseRateLimit parses limits like 10/s, 600/m:50 or 0, the burst defaults to the request count
+func parseRateLimit(value string) (RateLimit, bool) {
+	value = strings.TrimSpace(value)
+	if value == "0" {
+		return RateLimit{}, true
+	}
+	burst := ""
+	if i := strings.LastIndex(value, ":"); i >= 0 {
+		value, burst = value[:i], value[i+1:]
+	}
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, false
+	}
+	requests, err := strconv.Atoi(parts[0])
+	period, ok := rateLimitPeriods[parts[1]]
+	if err != nil || requests <= 0 || !ok {
+		return RateLimit{}, false
+	}
+	limit := RateLimit{Rate: float64(requests) / period.Seconds(), Burst: requests}
+	if len(burst) > 0 {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst <= 0 {
+			return RateLimit{}, false
+		}
+	}
+	return limit, true
+}
+
+// getEnvRateLimit reads a rate limit like 10/s:20 or returns the fallback if unset or invalid
+func getEnvRateLimit(key string, fallback RateLimit) RateLimit {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+	limit, ok := parseRateLimit(value)
+	if !ok {
+		util.Log.Warningf("invalid rate limit for %s: %s", key, value)
+		return fallback
+	}
+	return limit
+}
+
+// getEnvRateLimits reads a comma separated list of route=limit, routes are path templates optionally prefixed by a method
+func getEnvRateLimits(key string) map[string]RateLimit {
+	limits := map[string]RateLimit{}
+	for _, entry := range getEnvList(key) {
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			util.Log.Warningf("invalid rate limit for %s: %s", key, entry)
+			continue
+		}
+		limit, ok := parseRateLimit(entry[i+1:])
+		if !ok {
+			util.Log.Warningf("invalid rate limit for %s: %s", key, entry)
+			continue
+		}
+		limits[strings.Join(strings.Fields(entry[:i]), " ")] = limit
+	}
+	return limits
+}
@@ -18,6 +18,7 @@ type Influx struct {
 	Client    influxdb2.Client
 	Write     api.WriteAPIBlocking
 	Query     api.QueryAPI
+	Delete    api.DeleteAPI
 }
 
 func NewInflux(serverURL string, org string, bucket string) *Influx {
@@ -45,6 +46,8 @@ func (i *Influx) Create() error {
 	i.Write = writeAPI
 	// Create normal query API
 	i.Query = i.Client.QueryAPI(i.Org)
+	// Delete API to purge measurements
+	i.Delete = i.Client.DeleteAPI()
 	return nil
 }
 
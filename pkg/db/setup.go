@@ -1,5 +1,32 @@
 package db
 
+import (
+	"fmt"
+)
+
+// addColumn adds a column to an existing table unless it is already present
+func (s *Sqlite) addColumn(table string, column string, definition string) error {
+	stmt, err := s.Prepare(fmt.Sprintf("SELECT count(*) FROM pragma_table_info('%s') WHERE name = ?", table))
+	if err != nil {
+		return err
+	}
+	var count int
+	err = stmt.QueryRow(column).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	stmt, err = s.Prepare(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	return err
+}
+
 func (s *Sqlite) setupDatabase() error {
 	stmt, err := s.Prepare(`CREATE TABLE IF NOT EXISTS devices ( 
 		id          	text NOT NULL,
@@ -34,5 +61,409 @@ func (s *Sqlite) setupDatabase() error {
 		return err
 	}
 
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS sites ( 
+		id          	text NOT NULL,
+		name        	text NOT NULL,
+		date_created	text NOT NULL,
+		date_updated	text NOT NULL,
+		CONSTRAINT 		Pk_sites_id PRIMARY KEY ( id )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS zones ( 
+		id          	text NOT NULL,
+		site_id     	text NOT NULL,
+		name        	text NOT NULL,
+		date_created	text NOT NULL,
+		date_updated	text NOT NULL,
+		CONSTRAINT 		Pk_zones_id PRIMARY KEY ( id )
+		FOREIGN KEY 	( site_id ) REFERENCES sites( id )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS zone_devices ( 
+		device_id     text NOT NULL,
+		zone_id     	text NOT NULL,
+		date_created	text NOT NULL,
+		CONSTRAINT 		Pk_zone_devices_device_id PRIMARY KEY ( device_id )
+		FOREIGN KEY 	( device_id ) REFERENCES devices( id )
+		FOREIGN KEY 	( zone_id ) REFERENCES zones( id )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS device_labels ( 
+		device_id     text NOT NULL,
+		key         	text NOT NULL,
+		value       	text NOT NULL,
+		date_updated	text NOT NULL,
+		CONSTRAINT 		Pk_device_labels PRIMARY KEY ( device_id, key )
+		FOREIGN KEY 	( device_id ) REFERENCES devices( id )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS claim_codes ( 
+		id          	text NOT NULL,
+		code        	text NOT NULL UNIQUE,
+		device_id     text,
+		date_expires	text NOT NULL,
+		date_used   	text,
+		date_created	text NOT NULL,
+		CONSTRAINT 		Pk_claim_codes_id PRIMARY KEY ( id )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS device_shadows ( 
+		device_id           	text NOT NULL,
+		desired             	text NOT NULL DEFAULT '{}',
+		desired_version     	integer NOT NULL DEFAULT 0,
+		date_desired_updated	text,
+		reported            	text NOT NULL DEFAULT '{}',
+		reported_version    	integer NOT NULL DEFAULT 0,
+		date_reported_updated	text,
+		CONSTRAINT          	Pk_device_shadows_device_id PRIMARY KEY ( device_id )
+		FOREIGN KEY         	( device_id ) REFERENCES devices( id )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS device_commands ( 
+		id            	text NOT NULL,
+		device_id     	text NOT NULL,
+		name          	text NOT NULL,
+		payload       	text NOT NULL,
+		state         	text NOT NULL,
+		result        	text,
+		date_expires  	text NOT NULL,
+		date_created  	text NOT NULL,
+		date_delivered	text,
+		date_completed	text,
+		CONSTRAINT    	Pk_device_commands_id PRIMARY KEY ( id )
+		FOREIGN KEY   	( device_id ) REFERENCES devices( id )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS device_sensors ( 
+		device_id       	text NOT NULL,
+		name            	text NOT NULL,
+		sensor_type     	integer,
+		fields          	text NOT NULL DEFAULT '[]',
+		interval_seconds	integer,
+		date_updated    	text NOT NULL,
+		CONSTRAINT      	Pk_device_sensors PRIMARY KEY ( device_id, name )
+		FOREIGN KEY     	( device_id ) REFERENCES devices( id )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare("CREATE INDEX IF NOT EXISTS Idx_device_sensors_sensor_type ON device_sensors ( sensor_type )")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS calibrations ( 
+		id          	text NOT NULL,
+		device_id   	text NOT NULL,
+		sensor      	text NOT NULL,
+		field       	text NOT NULL,
+		kind        	text NOT NULL,
+		value_offset	real NOT NULL DEFAULT 0,
+		gain        	real NOT NULL DEFAULT 1,
+		points      	text NOT NULL DEFAULT '[]',
+		version     	integer NOT NULL,
+		date_created	text NOT NULL,
+		CONSTRAINT  	Pk_calibrations_id PRIMARY KEY ( id )
+		CONSTRAINT  	Uq_calibrations_version UNIQUE ( device_id, sensor, field, version )
+		FOREIGN KEY 	( device_id ) REFERENCES devices( id )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS audit ( 
+		id          	integer PRIMARY KEY AUTOINCREMENT,
+		actor       	text NOT NULL,
+		request_id  	text,
+		action      	text NOT NULL,
+		resource    	text NOT NULL,
+		resource_id 	text NOT NULL,
+		device_id   	text NOT NULL,
+		before      	text,
+		after       	text,
+		date_created	text NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare("CREATE INDEX IF NOT EXISTS Idx_audit_device_id ON audit ( device_id, date_created )")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS users ( 
+		id           	text NOT NULL,
+		username     	text NOT NULL COLLATE NOCASE,
+		password_hash	text NOT NULL,
+		role         	text NOT NULL,
+		date_created 	text NOT NULL,
+		date_updated 	text NOT NULL,
+		CONSTRAINT   	Pk_users_id PRIMARY KEY ( id )
+		CONSTRAINT   	Uq_users_username UNIQUE ( username )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS sessions ( 
+		id          	text NOT NULL,
+		user_id     	text NOT NULL,
+		token_prefix	text NOT NULL,
+		token_hash  	text NOT NULL,
+		date_expires	text NOT NULL,
+		date_created	text NOT NULL,
+		CONSTRAINT  	Pk_sessions_id PRIMARY KEY ( id )
+		FOREIGN KEY 	( user_id ) REFERENCES users( id )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare("CREATE INDEX IF NOT EXISTS Idx_sessions_token_prefix ON sessions ( token_prefix )")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS device_signing_keys ( 
+		device_id   	text NOT NULL,
+		key         	text NOT NULL,
+		date_created	text NOT NULL,
+		CONSTRAINT  	Pk_device_signing_keys_device_id PRIMARY KEY ( device_id )
+		FOREIGN KEY 	( device_id ) REFERENCES devices( id )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS jwt_keys ( 
+		kid         	text NOT NULL,
+		private_key 	text NOT NULL,
+		date_created	text NOT NULL,
+		date_retired	text,
+		CONSTRAINT  	Pk_jwt_keys_kid PRIMARY KEY ( kid )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS jwt_revocations ( 
+		kind        	text NOT NULL,
+		subject     	text NOT NULL,
+		date_revoked	text NOT NULL,
+		date_expires	text NOT NULL,
+		CONSTRAINT  	Pk_jwt_revocations PRIMARY KEY ( kind, subject )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS device_ca ( 
+		id          	integer NOT NULL,
+		certificate 	text NOT NULL,
+		private_key 	text NOT NULL,
+		date_created	text NOT NULL,
+		CONSTRAINT  	Pk_device_ca_id PRIMARY KEY ( id )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS device_certificates ( 
+		serial        	text NOT NULL,
+		device_id     	text NOT NULL,
+		fingerprint   	text NOT NULL,
+		date_not_after	text NOT NULL,
+		date_revoked  	text,
+		date_created  	text NOT NULL,
+		CONSTRAINT    	Pk_device_certificates_serial PRIMARY KEY ( serial )
+		FOREIGN KEY   	( device_id ) REFERENCES devices( id )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS grants ( 
+		id            	text NOT NULL,
+		resource_kind 	text NOT NULL,
+		resource_id   	text NOT NULL,
+		principal_kind	text NOT NULL,
+		principal_id  	text NOT NULL,
+		action        	text NOT NULL,
+		date_created  	text NOT NULL,
+		CONSTRAINT    	Pk_grants_id PRIMARY KEY ( id )
+		CONSTRAINT    	Uq_grants UNIQUE ( principal_kind, principal_id, action, resource_kind, resource_id )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	stmt, err = s.Prepare(`CREATE TABLE IF NOT EXISTS sensor_types ( 
+		name        	text NOT NULL,
+		sensor_type 	integer,
+		builtin     	integer NOT NULL DEFAULT 0,
+		fields      	text NOT NULL,
+		date_created	text NOT NULL,
+		date_updated	text NOT NULL,
+		CONSTRAINT  	Pk_sensor_types_name PRIMARY KEY ( name )
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		return err
+	}
+
+	// Columns added after the initial schema
+	for _, column := range [][3]string{
+		{"devices", "last_seen_at", "text"},
+		{"devices", "last_source", "text"},
+		{"devices", "state", "text NOT NULL DEFAULT 'active'"},
+		{"devices", "enrollment_token", "text"},
+		{"devices", "date_deleted", "text"},
+		{"devices", "purge_data", "integer NOT NULL DEFAULT 0"},
+		{"accesstokens", "refresh_token", "text"},
+		{"accesstokens", "date_expires", "text"},
+		{"accesstokens", "date_refresh_expires", "text"},
+		{"accesstokens", "token_prefix", "text"},
+		{"accesstokens", "token_hash", "text"},
+		{"accesstokens", "refresh_prefix", "text"},
+		{"accesstokens", "refresh_hash", "text"},
+		{"accesstokens", "scopes", "text"},
+		{"accesstokens", "last_used_at", "text"},
+		{"accesstokens", "last_ip", "text"},
+		{"accesstokens", "user_agent", "text"},
+		{"device_certificates", "scopes", "text"},
+	} {
+		err = s.addColumn(column[0], column[1], column[2])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, index := range []string{
+		"CREATE INDEX IF NOT EXISTS Idx_accesstokens_token_prefix ON accesstokens ( token_prefix )",
+		"CREATE INDEX IF NOT EXISTS Idx_accesstokens_refresh_prefix ON accesstokens ( refresh_prefix )",
+		"CREATE INDEX IF NOT EXISTS Idx_accesstokens_device_id ON accesstokens ( device_id, date_created )",
+		"CREATE INDEX IF NOT EXISTS Idx_device_certificates_device_id ON device_certificates ( device_id )",
+		"CREATE INDEX IF NOT EXISTS Idx_grants_resource ON grants ( resource_kind, resource_id )",
+	} {
+		stmt, err = s.Prepare(index)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.Exec()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -10,11 +10,17 @@ import (
 var SqliteDateLayout = "2006-01-02T15:04:05-0700"
 
 type Sqlite struct {
+	path string
 	conn *sql.DB
 }
 
 func NewSqlite() *Sqlite {
-	return &Sqlite{conn: nil}
+	return NewSqliteAt("/db/schism.sqlite")
+}
+
+// NewSqliteAt uses the database file at path instead of the one of the container
+func NewSqliteAt(path string) *Sqlite {
+	return &Sqlite{path: path, conn: nil}
 }
 
 func (s *Sqlite) Create() error {
@@ -22,7 +28,7 @@ func (s *Sqlite) Create() error {
 		return nil
 	}
 
-	db, err := sql.Open("sqlite3", "/db/schism.sqlite")
+	db, err := sql.Open("sqlite3", s.path)
 	if err != nil {
 		return err
 	}
@@ -50,3 +56,10 @@ func (s *Sqlite) Prepare(queryStmt string) (*sql.Stmt, error) {
 	}
 	return stmt, nil
 }
+
+func (s *Sqlite) Begin() (*sql.Tx, error) {
+	if s.conn == nil {
+		return nil, fmt.Errorf("database connection is missing, use s.Create() before any other function")
+	}
+	return s.conn.Begin()
+}
@@ -0,0 +1,20 @@
+package util
+
+import (
+	"context"
+	"time"
+)
+
+// Every runs fn each interval until the context is done
+func Every(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}